@@ -22,19 +22,35 @@ package codec
 
 import (
 	"encoding/binary"
+	"math"
 )
 
+// InvalidLength is returned by Decode as v for a malformed header,
+// it exceeds any max length, so the conn is closed by the read loop.
+const InvalidLength uint32 = math.MaxUint32
+
 type HeaderCodec interface {
 	// Decode returns the integer value and its length
-	// It returns (0, 0) if there is a parse error
+	// It returns (0, 0) if b is too short to parse the header,
+	// and (InvalidLength, 0) if the header is malformed
 	// b: [header...]
 	// v: the value of header, is the length of body
+	// n: the length of header, skipped when reading the body, may be 0
 	Decode(b []byte) (v uint32, n uint32)
 	// Encode returns header + body
+	// It returns nil if data can not be encoded, e.g. too large
 	// data: body data
 	Encode(data []byte) []byte
 }
 
+// HeaderEncoder optional interface of HeaderCodec, the header is encoded separately,
+// so that the body is written without being copied
+type HeaderEncoder interface {
+	// AppendHeader appends the header of a body of bodyLen bytes to dst,
+	// ok is false if it can not be encoded, e.g. too large
+	AppendHeader(dst []byte, bodyLen int) (b []byte, ok bool)
+}
+
 type CodecFixed32 struct {
 }
 
@@ -56,20 +72,57 @@ func (c *CodecFixed32) Encode(data []byte) []byte {
 	return b
 }
 
-// codec for protobuf varint
-//type CodecProtoVarint struct {
-//}
-//
-//// Decode parses a protobuf varint encoded integer from b,
-//// returning the integer value and the length of the varint
-//func (c *CodecProtoVarint) Decode(b []byte) (uint32, uint32) {
-//	v64, n := proto.DecodeVarint(b)
-//	return uint32(v64), uint32(n)
-//}
-//
-//// Encode returns header(protobuf varint)+body
-//func (c *CodecProtoVarint) Encode(data []byte) []byte {
-//	b := proto.EncodeVarint(uint64(len(data)))
-//	b = append(b, data...)
-//	return b
-//}
+// AppendHeader appends header(4 bytes, big-endian uint32) to dst
+func (c *CodecFixed32) AppendHeader(dst []byte, bodyLen int) ([]byte, bool) {
+	if uint64(bodyLen) > math.MaxUint32 {
+		return dst, false
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(bodyLen))
+	return append(dst, b[:]...), true
+}
+
+// CodecProtoVarint the header is the length of body encoded as
+// a protobuf varint(base 128, at most 5 bytes for uint32), without depending on protobuf
+type CodecProtoVarint struct {
+}
+
+// Decode parses a protobuf varint encoded integer from b,
+// returning the integer value and the length of the varint
+func (c *CodecProtoVarint) Decode(b []byte) (uint32, uint32) {
+	var x uint64
+	for i := 0; i < len(b) && i < binary.MaxVarintLen32; i++ {
+		x |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i] < 0x80 {
+			if x > math.MaxUint32 {
+				return InvalidLength, 0
+			}
+			return uint32(x), uint32(i + 1)
+		}
+	}
+	if len(b) >= binary.MaxVarintLen32 {
+		return InvalidLength, 0
+	}
+	return 0, 0
+}
+
+// Encode returns header(protobuf varint)+body
+func (c *CodecProtoVarint) Encode(data []byte) []byte {
+	if uint64(len(data)) > math.MaxUint32 {
+		return nil
+	}
+	b := make([]byte, binary.MaxVarintLen32, binary.MaxVarintLen32+len(data))
+	n := binary.PutUvarint(b, uint64(len(data)))
+	b = append(b[:n], data...)
+	return b
+}
+
+// AppendHeader appends header(protobuf varint) to dst
+func (c *CodecProtoVarint) AppendHeader(dst []byte, bodyLen int) ([]byte, bool) {
+	if uint64(bodyLen) > math.MaxUint32 {
+		return dst, false
+	}
+	var b [binary.MaxVarintLen32]byte
+	n := binary.PutUvarint(b[:], uint64(bodyLen))
+	return append(dst, b[:n]...), true
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package codec_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/izhw/gnet/codec"
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/frame"
+)
+
+const maxFrameLen = 1 << 20
+
+var byteOrders = []struct {
+	name  string
+	order binary.ByteOrder
+}{
+	{"big", binary.BigEndian},
+	{"little", binary.LittleEndian},
+}
+
+func TestLengthFieldDecodeField(t *testing.T) {
+	tests := []struct {
+		fieldLen int
+		order    binary.ByteOrder
+		field    []byte
+		want     uint32
+	}{
+		{1, binary.BigEndian, []byte{0x05}, 5},
+		{2, binary.BigEndian, []byte{0x01, 0x02}, 0x0102},
+		{2, binary.LittleEndian, []byte{0x01, 0x02}, 0x0201},
+		{3, binary.BigEndian, []byte{0x01, 0x02, 0x03}, 0x010203},
+		{3, binary.LittleEndian, []byte{0x01, 0x02, 0x03}, 0x030201},
+		{4, binary.BigEndian, []byte{0x01, 0x02, 0x03, 0x04}, 0x01020304},
+		{4, binary.LittleEndian, []byte{0x01, 0x02, 0x03, 0x04}, 0x04030201},
+		{8, binary.BigEndian, []byte{0, 0, 0, 0, 0x01, 0x02, 0x03, 0x04}, 0x01020304},
+		{8, binary.LittleEndian, []byte{0x01, 0x02, 0x03, 0x04, 0, 0, 0, 0}, 0x04030201},
+	}
+	for _, tt := range tests {
+		c := &codec.LengthFieldCodec{
+			ByteOrder:           tt.order,
+			LengthFieldOffset:   2,
+			LengthFieldLength:   tt.fieldLen,
+			InitialBytesToStrip: 2 + tt.fieldLen,
+		}
+		b := append([]byte{0xaa, 0xbb}, tt.field...)
+		if v, n := c.Decode(b); v != tt.want || n != uint32(2+tt.fieldLen) {
+			t.Errorf("%d-byte %v field %x: Decode = (%d, %d), want (%d, %d)",
+				tt.fieldLen, tt.order, tt.field, v, n, tt.want, 2+tt.fieldLen)
+		}
+	}
+}
+
+func TestLengthFieldRoundTrip(t *testing.T) {
+	body := []byte("hello, length field")
+	for _, fieldLen := range []int{1, 2, 3, 4, 8} {
+		for _, bo := range byteOrders {
+			for _, adjust := range []int{0, -fieldLen} {
+				c := &codec.LengthFieldCodec{
+					ByteOrder:           bo.order,
+					LengthFieldOffset:   2,
+					LengthFieldLength:   fieldLen,
+					LengthAdjustment:    adjust,
+					InitialBytesToStrip: 2 + fieldLen,
+					Prefix:              []byte{0xca, 0xfe},
+				}
+				f := c.Encode(body)
+				if f == nil {
+					t.Fatalf("%d-byte %s adjust %d: Encode failed", fieldLen, bo.name, adjust)
+				}
+				if !bytes.HasPrefix(f, c.Prefix) {
+					t.Errorf("%d-byte %s adjust %d: frame %x without prefix", fieldLen, bo.name, adjust, f)
+				}
+				// every truncation point is incomplete
+				for i := 0; i < len(f); i++ {
+					if _, n, err := frame.Decode(c, f[:i], maxFrameLen); n != 0 || err != nil {
+						t.Fatalf("%d-byte %s adjust %d: truncated at %d: n=%d err=%v",
+							fieldLen, bo.name, adjust, i, n, err)
+					}
+				}
+				got, n, err := frame.Decode(c, f, maxFrameLen)
+				if err != nil || n != len(f) || !bytes.Equal(got, body) {
+					t.Errorf("%d-byte %s adjust %d: Decode = (%q, %d, %v), want (%q, %d, nil)",
+						fieldLen, bo.name, adjust, got, n, err, body, len(f))
+				}
+			}
+		}
+	}
+}
+
+func TestLengthFieldNoStrip(t *testing.T) {
+	// the zero value keeps the header in the body, Encode and Decode don't round trip
+	c := &codec.LengthFieldCodec{}
+	f := c.Encode([]byte("abc"))
+	got, n, err := frame.Decode(c, f, maxFrameLen)
+	if err != nil || n != len(f) || !bytes.Equal(got, f) {
+		t.Errorf("Decode = (%x, %d, %v), want (%x, %d, nil)", got, n, err, f, len(f))
+	}
+}
+
+func TestLengthFieldDecodeInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		c    *codec.LengthFieldCodec
+		b    []byte
+	}{
+		{
+			"negative adjusted length",
+			&codec.LengthFieldCodec{LengthFieldLength: 1, LengthAdjustment: -5, InitialBytesToStrip: 1},
+			[]byte{0x02, 'a', 'b'},
+		},
+		{
+			"strip more than the frame",
+			&codec.LengthFieldCodec{LengthFieldLength: 2, InitialBytesToStrip: 8},
+			[]byte{0x00, 0x03, 'a', 'b', 'c'},
+		},
+		{
+			"8-byte length above MaxUint32",
+			&codec.LengthFieldCodec{LengthFieldLength: 8, InitialBytesToStrip: 8},
+			[]byte{0, 0, 0, 0x01, 0, 0, 0, 0},
+		},
+		{
+			"8-byte length of the max uint64",
+			&codec.LengthFieldCodec{LengthFieldLength: 8, InitialBytesToStrip: 8},
+			[]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		},
+		{
+			"unsupported field length",
+			&codec.LengthFieldCodec{LengthFieldLength: 5},
+			[]byte{0, 0, 0, 0, 1},
+		},
+		{
+			"negative offset",
+			&codec.LengthFieldCodec{LengthFieldOffset: -1},
+			[]byte{0, 0, 0, 1},
+		},
+	}
+	for _, tt := range tests {
+		if v, n := tt.c.Decode(tt.b); v != codec.InvalidLength || n != 0 {
+			t.Errorf("%s: Decode = (%d, %d), want InvalidLength", tt.name, v, n)
+		}
+		if _, _, err := frame.Decode(tt.c, tt.b, maxFrameLen); !errors.Is(err, gcore.ErrTooLarge) {
+			t.Errorf("%s: frame.Decode error %v, want %v", tt.name, err, gcore.ErrTooLarge)
+		}
+	}
+}
+
+func TestLengthFieldDecodeAboveMax(t *testing.T) {
+	c := &codec.LengthFieldCodec{LengthFieldLength: 8, InitialBytesToStrip: 8}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, maxFrameLen)
+	if _, _, err := frame.Decode(c, b, maxFrameLen); !errors.Is(err, gcore.ErrTooLarge) {
+		t.Errorf("length above max: %v, want %v", err, gcore.ErrTooLarge)
+	}
+	binary.BigEndian.PutUint64(b, maxFrameLen-8)
+	if _, n, err := frame.Decode(c, b, maxFrameLen); n != 0 || err != nil {
+		t.Errorf("length of max: n=%d err=%v, want incomplete", n, err)
+	}
+}
+
+func TestProtoVarintDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		b     []byte
+		wantV uint32
+		wantN uint32
+	}{
+		{"1 byte", []byte{0x05}, 5, 1},
+		{"2 bytes", []byte{0xac, 0x02}, 300, 2},
+		{"max uint32", []byte{0xff, 0xff, 0xff, 0xff, 0x0f}, math.MaxUint32, 5},
+		{"empty", nil, 0, 0},
+		{"truncated", []byte{0x80, 0x80}, 0, 0},
+		{"truncated at 4 bytes", []byte{0xff, 0xff, 0xff, 0xff}, 0, 0},
+		{"6 bytes", []byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x01}, codec.InvalidLength, 0},
+		{"5 bytes unterminated", []byte{0x80, 0x80, 0x80, 0x80, 0x80}, codec.InvalidLength, 0},
+		{"overflows uint32", []byte{0x80, 0x80, 0x80, 0x80, 0x10}, codec.InvalidLength, 0},
+	}
+	c := &codec.CodecProtoVarint{}
+	for _, tt := range tests {
+		if v, n := c.Decode(tt.b); v != tt.wantV || n != tt.wantN {
+			t.Errorf("%s: Decode(%x) = (%d, %d), want (%d, %d)", tt.name, tt.b, v, n, tt.wantV, tt.wantN)
+		}
+	}
+}
+
+func TestProtoVarintRoundTrip(t *testing.T) {
+	c := &codec.CodecProtoVarint{}
+	for _, size := range []int{0, 1, 127, 128, 300, 1 << 14, 1 << 16} {
+		body := bytes.Repeat([]byte{'x'}, size)
+		f := c.Encode(body)
+		for i := 0; i < len(f); i++ {
+			if _, n, err := frame.Decode(c, f[:i], maxFrameLen); n != 0 || err != nil {
+				t.Fatalf("size %d truncated at %d: n=%d err=%v", size, i, n, err)
+			}
+		}
+		got, n, err := frame.Decode(c, f, maxFrameLen)
+		if err != nil || n != len(f) || !bytes.Equal(got, body) {
+			t.Errorf("size %d: Decode = (%d bytes, %d, %v)", size, len(got), n, err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package codec
+
+import (
+	"bytes"
+	"errors"
+)
+
+var ErrFrameTooLong = errors.New("codec: frame too long")
+
+// FrameDecoder is implemented by codecs whose frames are not length-prefixed,
+// the read loops use DecodeFrame instead of HeaderCodec.Decode if implemented
+type FrameDecoder interface {
+	// DecodeFrame finds the first frame in b,
+	// returns the offset and length of its body and the length of the whole frame
+	// It returns frameLen == 0 if b does not contain a complete frame
+	DecodeFrame(b []byte) (bodyOffset, bodyLen, frameLen int, err error)
+}
+
+// DelimiterCodec frames end with a delimiter, e.g. for line-oriented text protocols
+type DelimiterCodec struct {
+	// Delimiters a frame ends with the earliest match of any of them,
+	// the longest one wins on ties. Encode appends Delimiters[0]
+	Delimiters [][]byte
+	// MaxFrameLen max length of a frame including the delimiter,
+	// 0 means limited by MaxReadBufLen only
+	MaxFrameLen int
+	// KeepDelimiter keeps the delimiter at the end of the body
+	KeepDelimiter bool
+}
+
+// NewDelimiterCodec returns a DelimiterCodec splitting on delimiters
+func NewDelimiterCodec(maxFrameLen int, delimiters ...[]byte) *DelimiterCodec {
+	return &DelimiterCodec{
+		Delimiters:  delimiters,
+		MaxFrameLen: maxFrameLen,
+	}
+}
+
+// NewLineCodec returns a DelimiterCodec splitting on "\n" or "\r\n", Encode appends "\n"
+func NewLineCodec(maxFrameLen int) *DelimiterCodec {
+	return NewDelimiterCodec(maxFrameLen, []byte("\n"), []byte("\r\n"))
+}
+
+// DecodeFrame implements FrameDecoder
+func (c *DelimiterCodec) DecodeFrame(b []byte) (bodyOffset, bodyLen, frameLen int, err error) {
+	idx, delimLen := -1, 0
+	for _, d := range c.Delimiters {
+		if len(d) == 0 {
+			continue
+		}
+		// only search where an earlier match is possible
+		search := b
+		if idx >= 0 && idx+len(d) <= len(b) {
+			search = b[:idx+len(d)]
+		}
+		i := bytes.Index(search, d)
+		if i < 0 {
+			continue
+		}
+		if idx < 0 || i < idx || (i == idx && len(d) > delimLen) {
+			idx, delimLen = i, len(d)
+		}
+	}
+	if idx < 0 {
+		if c.MaxFrameLen > 0 && len(b) >= c.MaxFrameLen {
+			return 0, 0, 0, ErrFrameTooLong
+		}
+		return 0, 0, 0, nil
+	}
+	frameLen = idx + delimLen
+	if c.MaxFrameLen > 0 && frameLen > c.MaxFrameLen {
+		return 0, 0, 0, ErrFrameTooLong
+	}
+	bodyLen = idx
+	if c.KeepDelimiter {
+		bodyLen = frameLen
+	}
+	return 0, bodyLen, frameLen, nil
+}
+
+// Decode DelimiterCodec frames have no header, it always returns (InvalidLength, 0),
+// the read loops use DecodeFrame
+func (c *DelimiterCodec) Decode(b []byte) (v uint32, n uint32) {
+	return InvalidLength, 0
+}
+
+// Encode returns data + Delimiters[0]
+// It returns nil if no delimiter is configured or the frame exceeds MaxFrameLen
+func (c *DelimiterCodec) Encode(data []byte) []byte {
+	if len(c.Delimiters) == 0 || len(c.Delimiters[0]) == 0 {
+		return nil
+	}
+	d := c.Delimiters[0]
+	if c.MaxFrameLen > 0 && len(data)+len(d) > c.MaxFrameLen {
+		return nil
+	}
+	b := make([]byte, 0, len(data)+len(d))
+	b = append(b, data...)
+	return append(b, d...)
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// +build gofuzz
+
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Fuzz targets for go-fuzz, checking Decode on truncated and malicious input:
+//	go-fuzz-build -func FuzzLengthField github.com/izhw/gnet/codec
+//	go-fuzz -bin codec-fuzz.zip
+
+var fieldLengths = [...]int{1, 2, 3, 4, 8}
+
+// FuzzLengthField data[0:4] configures the codec, the rest is decoded
+func FuzzLengthField(data []byte) int {
+	if len(data) < 4 {
+		return -1
+	}
+	c := &LengthFieldCodec{
+		LengthFieldLength:   fieldLengths[int(data[0]&0x7f)%len(fieldLengths)],
+		LengthFieldOffset:   int(data[1] % 8),
+		LengthAdjustment:    int(int8(data[2])),
+		InitialBytesToStrip: int(data[3] % 16),
+	}
+	if data[0]&0x80 != 0 {
+		c.ByteOrder = binary.LittleEndian
+	}
+	b := data[4:]
+	v, n := c.Decode(b)
+	if v == InvalidLength || (v == 0 && n == 0) {
+		return 0
+	}
+	headerLen := c.LengthFieldOffset + c.LengthFieldLength
+	if uint64(v)+uint64(n) < uint64(headerLen) {
+		panic("frame shorter than header")
+	}
+	checkTruncated(c, b, headerLen, v, n)
+	// round trip when the whole header is stripped
+	if int(n) == c.LengthFieldOffset+c.LengthFieldLength && int(v) <= len(b)-int(n) {
+		body := b[n : n+v]
+		frame := c.Encode(body)
+		if frame == nil {
+			panic("encode failed")
+		}
+		v2, n2 := c.Decode(frame)
+		if v2 != v || n2 != n || !bytes.Equal(frame[n2:], body) {
+			panic("round trip mismatch")
+		}
+		checkAppendHeader(c, frame, body)
+	}
+	return 1
+}
+
+// FuzzProtoVarint decodes data as a varint header
+func FuzzProtoVarint(data []byte) int {
+	c := &CodecProtoVarint{}
+	v, n := c.Decode(data)
+	if v == InvalidLength || (v == 0 && n == 0) {
+		return 0
+	}
+	if n > binary.MaxVarintLen32 {
+		panic("varint too long")
+	}
+	if x, m := binary.Uvarint(data); x != uint64(v) || m != int(n) {
+		panic("varint mismatch")
+	}
+	checkTruncated(c, data, int(n), v, n)
+	return 1
+}
+
+// FuzzFixed32 decodes data as a fixed 4-byte header
+func FuzzFixed32(data []byte) int {
+	c := &CodecFixed32{}
+	v, n := c.Decode(data)
+	if v == 0 && n == 0 {
+		return 0
+	}
+	checkTruncated(c, data, 4, v, n)
+	return 1
+}
+
+// checkTruncated Decode only depends on the first headerLen bytes of b,
+// shorter input is reported as incomplete
+func checkTruncated(c HeaderCodec, b []byte, headerLen int, v, n uint32) {
+	if v2, n2 := c.Decode(b[:headerLen]); v2 != v || n2 != n {
+		panic("decode depends on bytes after header")
+	}
+	for i := 0; i < headerLen; i++ {
+		if v2, n2 := c.Decode(b[:i]); v2 != 0 || n2 != 0 {
+			panic("truncated header decoded")
+		}
+	}
+}
+
+// checkAppendHeader the header appended by he is the same as the one encoded by Encode
+func checkAppendHeader(he HeaderEncoder, frame, body []byte) {
+	h, ok := he.AppendHeader([]byte{0xff}, len(body))
+	if !ok || h[0] != 0xff || !bytes.Equal(h[1:], frame[:len(frame)-len(body)]) {
+		panic("AppendHeader mismatch")
+	}
+}
+
+// FuzzLine decodes data with a line codec
+func FuzzLine(data []byte) int {
+	c := NewLineCodec(64)
+	offset, bodyLen, frameLen, err := c.DecodeFrame(data)
+	if err != nil || frameLen == 0 {
+		return 0
+	}
+	if offset != 0 || bodyLen >= frameLen || frameLen > len(data) || frameLen > 64 {
+		panic("frame out of range")
+	}
+	if bytes.IndexByte(data[:bodyLen], '\n') >= 0 {
+		panic("body contains delimiter")
+	}
+	return 1
+}
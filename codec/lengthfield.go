@@ -0,0 +1,185 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package codec
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// LengthFieldCodec a configurable length-field based codec,
+// the frame layout is the same as Netty's LengthFieldBasedFrameDecoder:
+//
+//	frame: [LengthFieldOffset bytes][length field][...]
+//	frame length = length field value + LengthAdjustment + LengthFieldOffset + LengthFieldLength
+//
+// The first InitialBytesToStrip bytes of a frame are stripped, the rest is the body.
+// The zero value is a 4-byte big-endian length field at offset 0 excluding the header,
+// without stripping, so the body contains the header.
+// e.g. the same frames as CodecFixed32:
+//
+//	&LengthFieldCodec{LengthFieldLength: 4, InitialBytesToStrip: 4}
+type LengthFieldCodec struct {
+	// ByteOrder of the length field, default: binary.BigEndian
+	ByteOrder binary.ByteOrder
+	// LengthFieldOffset offset of the length field in the frame
+	LengthFieldOffset int
+	// LengthFieldLength 1, 2, 3, 4 or 8, default: 4
+	LengthFieldLength int
+	// LengthAdjustment added to the length field value, e.g. -LengthFieldLength
+	// if the value includes the length field itself
+	LengthAdjustment int
+	// InitialBytesToStrip number of bytes stripped from the beginning of a frame
+	InitialBytesToStrip int
+	// Prefix written by Encode before the length field,
+	// truncated or padded with zeros to LengthFieldOffset
+	Prefix []byte
+}
+
+func (c *LengthFieldCodec) byteOrder() binary.ByteOrder {
+	if c.ByteOrder == nil {
+		return binary.BigEndian
+	}
+	return c.ByteOrder
+}
+
+func (c *LengthFieldCodec) fieldLength() int {
+	if c.LengthFieldLength == 0 {
+		return 4
+	}
+	return c.LengthFieldLength
+}
+
+// Decode parses the length field, returns the body length and the bytes to strip
+func (c *LengthFieldCodec) Decode(b []byte) (v uint32, n uint32) {
+	if c.LengthFieldOffset < 0 || c.InitialBytesToStrip < 0 {
+		return InvalidLength, 0
+	}
+	fieldLen := c.fieldLength()
+	headerLen := c.LengthFieldOffset + fieldLen
+	if len(b) < headerLen {
+		return 0, 0
+	}
+	value, ok := c.getLength(b[c.LengthFieldOffset:headerLen])
+	if !ok || value > math.MaxUint32 {
+		return InvalidLength, 0
+	}
+	frameLen := int64(value) + int64(c.LengthAdjustment) + int64(headerLen)
+	if frameLen < int64(headerLen) || frameLen < int64(c.InitialBytesToStrip) {
+		return InvalidLength, 0
+	}
+	bodyLen := frameLen - int64(c.InitialBytesToStrip)
+	if bodyLen >= int64(InvalidLength) {
+		return InvalidLength, 0
+	}
+	return uint32(bodyLen), uint32(c.InitialBytesToStrip)
+}
+
+// Encode returns Prefix + length field + data,
+// the length field value is len(data) - LengthAdjustment
+// It returns nil if the value can not be represented by the length field.
+// Decode returns data back only if InitialBytesToStrip is LengthFieldOffset + LengthFieldLength,
+// otherwise the body decoded keeps the header bytes not stripped
+func (c *LengthFieldCodec) Encode(data []byte) []byte {
+	if c.LengthFieldOffset < 0 {
+		return nil
+	}
+	b, ok := c.AppendHeader(make([]byte, 0, c.LengthFieldOffset+c.fieldLength()+len(data)), len(data))
+	if !ok {
+		return nil
+	}
+	return append(b, data...)
+}
+
+// AppendHeader appends prefix + length field to dst
+func (c *LengthFieldCodec) AppendHeader(dst []byte, bodyLen int) ([]byte, bool) {
+	if c.LengthFieldOffset < 0 {
+		return dst, false
+	}
+	value := int64(bodyLen) - int64(c.LengthAdjustment)
+	if value < 0 {
+		return dst, false
+	}
+	n := len(dst)
+	for i := c.LengthFieldOffset + c.fieldLength(); i > 0; i-- {
+		dst = append(dst, 0)
+	}
+	copy(dst[n:n+c.LengthFieldOffset], c.Prefix)
+	if !c.putLength(dst[n+c.LengthFieldOffset:], uint64(value)) {
+		return dst[:n], false
+	}
+	return dst, true
+}
+
+func (c *LengthFieldCodec) getLength(b []byte) (uint64, bool) {
+	order := c.byteOrder()
+	switch len(b) {
+	case 1:
+		return uint64(b[0]), true
+	case 2:
+		return uint64(order.Uint16(b)), true
+	case 3:
+		if order == binary.LittleEndian {
+			return uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16, true
+		}
+		return uint64(b[2]) | uint64(b[1])<<8 | uint64(b[0])<<16, true
+	case 4:
+		return uint64(order.Uint32(b)), true
+	case 8:
+		return order.Uint64(b), true
+	}
+	return 0, false
+}
+
+func (c *LengthFieldCodec) putLength(b []byte, v uint64) bool {
+	order := c.byteOrder()
+	switch len(b) {
+	case 1:
+		if v > math.MaxUint8 {
+			return false
+		}
+		b[0] = byte(v)
+	case 2:
+		if v > math.MaxUint16 {
+			return false
+		}
+		order.PutUint16(b, uint16(v))
+	case 3:
+		if v > 1<<24-1 {
+			return false
+		}
+		if order == binary.LittleEndian {
+			b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+		} else {
+			b[0], b[1], b[2] = byte(v>>16), byte(v>>8), byte(v)
+		}
+	case 4:
+		if v > math.MaxUint32 {
+			return false
+		}
+		order.PutUint32(b, uint32(v))
+	case 8:
+		order.PutUint64(b, v)
+	default:
+		return false
+	}
+	return true
+}
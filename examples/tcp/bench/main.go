@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/izhw/gnet"
+	"github.com/izhw/gnet/gcore"
+)
+
+// Compares the goroutine-per-conn server with the epoll event-loop server:
+// memory held by idle connections and echo throughput.
+// Clients run in the same process, both ends of each conn need an fd,
+// raise `ulimit -n` before using a large -idle.
+//
+//	go run ./examples/tcp/bench -idle 5000 -clients 64 -duration 5s
+
+var (
+	idle     = flag.Int("idle", 5000, "number of idle connections")
+	clients  = flag.Int("clients", 64, "number of concurrent echo clients")
+	duration = flag.Duration("duration", 5*time.Second, "echo duration")
+	size     = flag.Int("size", 64, "echo message size")
+)
+
+type echoHandler struct {
+	*gcore.NetEventHandler
+}
+
+func (h *echoHandler) OnReadMsg(c gcore.Conn, data []byte) error {
+	return c.Write(data)
+}
+
+func main() {
+	flag.Parse()
+	modes := []struct {
+		name string
+		typ  gcore.ServiceType
+		addr string
+	}{
+		{"goroutine", gcore.SvcTypeTCPServer, "127.0.0.1:7790"},
+		{"eventloop", gcore.SvcTypeTCPEventLoopServer, "127.0.0.1:7791"},
+	}
+	for _, m := range modes {
+		if err := bench(m.name, m.typ, m.addr); err != nil {
+			fmt.Println(m.name, "error:", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func bench(name string, typ gcore.ServiceType, addr string) error {
+	svc := gnet.NewService(
+		gcore.WithServiceType(typ),
+		gcore.WithAddr(addr),
+		gcore.WithEventHandler(&echoHandler{}),
+	)
+	s := svc.Server()
+	if err := s.Init(); err != nil {
+		return err
+	}
+	go s.Serve()
+	defer s.Stop()
+
+	// memory of idle conns
+	before := memInUse()
+	goroutines := runtime.NumGoroutine()
+	conns := make([]net.Conn, 0, *idle)
+	for i := 0; i < *idle; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, c)
+	}
+	for s.ConnNum() < uint32(*idle) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	after := memInUse()
+	fmt.Printf("[%s] idle conns:%d, memory:%.1fKB/conn, goroutines:%d\n",
+		name, *idle, float64(after-before)/float64(*idle)/1024, runtime.NumGoroutine()-goroutines)
+	for _, c := range conns {
+		c.Close()
+	}
+
+	// echo throughput
+	var ops uint64
+	var wg sync.WaitGroup
+	data := make([]byte, *size)
+	deadline := time.Now().Add(*duration)
+	for i := 0; i < *clients; i++ {
+		c := gnet.NewService(
+			gcore.WithServiceType(gcore.SvcTypeTCPClient),
+			gcore.WithAddr(addr),
+		).Client()
+		if err := c.Init(); err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer c.Close()
+			for time.Now().Before(deadline) {
+				if _, err := c.WriteRead(data); err != nil {
+					return
+				}
+				atomic.AddUint64(&ops, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	fmt.Printf("[%s] echo clients:%d, size:%d, %.0f msg/s\n",
+		name, *clients, *size, float64(ops)/duration.Seconds())
+	return nil
+}
+
+func memInUse() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapInuse + m.StackInuse
+}
@@ -27,7 +27,7 @@ func main() {
 		AsyncPool(ctx)
 	}()
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
 	select {
 	case sig := <-c:
@@ -0,0 +1,53 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gcore
+
+import (
+	"encoding/binary"
+)
+
+// CallIDLen length of the request ID prepended to the body of each frame
+// when Options.Multiplex is enabled, 4 bytes, big-endian uint32.
+// ID 0 is reserved for one-way messages, e.g. AsyncClient.Write or server push.
+const CallIDLen = 4
+
+// EncodeCall returns id+data
+func EncodeCall(id uint32, data []byte) []byte {
+	b := make([]byte, CallIDLen, CallIDLen+len(data))
+	binary.BigEndian.PutUint32(b, id)
+	return append(b, data...)
+}
+
+// DecodeCall splits a frame body written in multiplex mode into request ID and payload,
+// payload shares the memory of data
+func DecodeCall(data []byte) (id uint32, payload []byte, err error) {
+	if len(data) < CallIDLen {
+		return 0, nil, ErrCallInvalidFrame
+	}
+	return binary.BigEndian.Uint32(data), data[CallIDLen:], nil
+}
+
+// Reply writes resp to c as the response to request id,
+// used in EventHandler.OnReadMsg of the server serving multiplexed AsyncClients.
+// id 0 sends a one-way message which is passed to OnReadMsg of the client.
+func Reply(c Conn, id uint32, resp []byte) error {
+	return c.Write(EncodeCall(id, resp))
+}
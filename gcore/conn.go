@@ -21,10 +21,14 @@
 package gcore
 
 import (
+	"context"
+	"crypto/x509"
 	"net"
 )
 
 type Conn interface {
+	// ID returns the id of Conn, unique in the process
+	ID() uint64
 	// Init initiates Conn with options
 	Init(opts ...Option) error
 	// Read reads data from the connection, only for sync Client.
@@ -38,15 +42,44 @@ type Conn interface {
 	// returning msg body, without header
 	WriteRead(req []byte) (body []byte, err error)
 	// Write writes data to the connection.
+	// If the send queue is full, it behaves as SendQueuePolicy in Options.
+	// data must not be modified after Write, it may be written without being copied.
 	Write(data []byte) error
+	// TryWrite is like Write, but never blocks, returns ErrSendQueueFull instead.
+	TryWrite(data []byte) error
+	// WriteContext is like Write, blocking is bounded by ctx.
+	WriteContext(ctx context.Context, data []byte) error
 	// Close closes the connection.
 	Close() error
 	// Closed
 	Closed() bool
-	// RemoteAddr returns the remote network address.
+	// RemoteAddr returns the remote network address,
+	// the original client address if a PROXY protocol header is received by the server.
 	RemoteAddr() net.Addr
-	// SetTag sets a tag to Conn
+	// LocalAddr returns the local network address,
+	// the original destination address if a PROXY protocol header is received by the server.
+	LocalAddr() net.Addr
+	// PeerCertificates returns the certificate chain presented by the peer,
+	// nil if TLS is not enabled or the peer sent no certificate.
+	PeerCertificates() []*x509.Certificate
+	// SetTag sets a tag to Conn, server conns can be looked up by tag
 	SetTag(tag string)
 	// GetTag gets the tag
 	GetTag() string
+	// Stats returns the stats of Conn, safe for concurrent use
+	Stats() ConnStats
+}
+
+// PeerCred credentials of the peer process of a unix socket conn
+type PeerCred struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+// PeerCredConn optional interface of Conn, implemented by the conns of Server
+type PeerCredConn interface {
+	// PeerCred returns the credentials of the peer process when it connected, read by SO_PEERCRED,
+	// ErrPeerCredUnavailable if it is not a unix socket conn or not on linux
+	PeerCred() (PeerCred, error)
 }
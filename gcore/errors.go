@@ -25,10 +25,19 @@ import (
 )
 
 var (
-	ErrTooLarge        = errors.New("data:too large")
-	ErrConnClosed      = errors.New("conn:closed")
-	ErrConnInvalidCall = errors.New("conn:invalid call")
-	ErrPoolClosed      = errors.New("pool:closed")
-	ErrPoolTimeout     = errors.New("pool:timeout")
-	ErrPoolInvalidAddr = errors.New("pool:invalid addr")
+	ErrTooLarge            = errors.New("data:too large")
+	ErrConnClosed          = errors.New("conn:closed")
+	ErrConnInvalidCall     = errors.New("conn:invalid call")
+	ErrConnNotFound        = errors.New("conn:not found")
+	ErrConnReadTimeout     = errors.New("conn:read timeout")
+	ErrPeerCredUnavailable = errors.New("conn:peer credentials unavailable")
+	ErrInvalidProxyHeader  = errors.New("conn:invalid PROXY protocol header")
+	ErrMissingProxyHeader  = errors.New("conn:missing PROXY protocol header")
+	ErrSendQueueFull       = errors.New("conn:send queue full")
+	ErrWorkerQueueFull     = errors.New("worker:queue full")
+	ErrConnReconnecting    = errors.New("conn:reconnecting")
+	ErrCallInvalidFrame    = errors.New("call:invalid frame")
+	ErrPoolClosed          = errors.New("pool:closed")
+	ErrPoolTimeout         = errors.New("pool:timeout")
+	ErrPoolInvalidAddr     = errors.New("pool:invalid addr")
 )
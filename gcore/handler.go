@@ -34,6 +34,35 @@ type EventHandler interface {
 	OnWriteError(c Conn, data []byte, err error)
 }
 
+// ReconnectHandler optional callbacks for AsyncClient with reconnecting enabled,
+// implemented by EventHandler
+type ReconnectHandler interface {
+	// OnReconnecting c is broken, attempt: the number of redial attempts, starting from 1
+	OnReconnecting(c Conn, attempt int)
+	// OnReconnected c has been reconnected, called instead of OnOpened
+	OnReconnected(c Conn)
+}
+
+// ShutdownHandler optional callback of EventHandler for Server.Shutdown
+type ShutdownHandler interface {
+	// OnShutdown the server is shutting down, c will be closed after the data written
+	// is flushed, e.g. a goodbye msg. It may be called concurrently with OnReadMsg.
+	OnShutdown(c Conn)
+}
+
+// SendQueueFullHandler optional callback of EventHandler
+type SendQueueFullHandler interface {
+	// OnSendQueueFull data is written while the send queue of c is full,
+	// called before SendQueuePolicy is applied
+	OnSendQueueFull(c Conn, data []byte)
+}
+
+// IdleTimeoutHandler optional callback of EventHandler for HeartTimeout
+type IdleTimeoutHandler interface {
+	// OnIdleTimeout c has received nothing for HeartTimeout, it is closed after OnIdleTimeout returns
+	OnIdleTimeout(c Conn)
+}
+
 func DefaultEventHandler() EventHandler {
 	return &NetEventHandler{}
 }
@@ -54,3 +83,18 @@ func (h *NetEventHandler) OnReadMsg(c Conn, data []byte) (err error) {
 
 func (h *NetEventHandler) OnWriteError(c Conn, data []byte, err error) {
 }
+
+func (h *NetEventHandler) OnReconnecting(c Conn, attempt int) {
+}
+
+func (h *NetEventHandler) OnReconnected(c Conn) {
+}
+
+func (h *NetEventHandler) OnShutdown(c Conn) {
+}
+
+func (h *NetEventHandler) OnSendQueueFull(c Conn, data []byte) {
+}
+
+func (h *NetEventHandler) OnIdleTimeout(c Conn) {
+}
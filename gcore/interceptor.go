@@ -0,0 +1,155 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gcore
+
+// Interceptor wraps the events and outbound writes of Conns, see WithInterceptors.
+// Each method calls next to continue the chain, or skips it to short-circuit,
+// embed BaseInterceptor to wrap only some of them.
+type Interceptor interface {
+	// OnOpened wraps EventHandler.OnOpened
+	OnOpened(c Conn, next func(c Conn))
+	// OnReadMsg wraps EventHandler.OnReadMsg, c is closed if an error is returned
+	OnReadMsg(c Conn, data []byte, next func(c Conn, data []byte) error) error
+	// OnClosed wraps EventHandler.OnClosed
+	OnClosed(c Conn, next func(c Conn))
+	// Write wraps Write, TryWrite and WriteContext of c, data is not encoded yet.
+	// Broadcasts of Server are not intercepted.
+	Write(c Conn, data []byte, next func(c Conn, data []byte) error) error
+}
+
+// BaseInterceptor passes all calls to next
+type BaseInterceptor struct {
+}
+
+func (BaseInterceptor) OnOpened(c Conn, next func(c Conn)) {
+	next(c)
+}
+
+func (BaseInterceptor) OnReadMsg(c Conn, data []byte, next func(c Conn, data []byte) error) error {
+	return next(c, data)
+}
+
+func (BaseInterceptor) OnClosed(c Conn, next func(c Conn)) {
+	next(c)
+}
+
+func (BaseInterceptor) Write(c Conn, data []byte, next func(c Conn, data []byte) error) error {
+	return next(c, data)
+}
+
+// WrapHandler returns h wrapped by interceptors, the first one is the outermost.
+// The optional handler interfaces implemented by h are kept.
+func WrapHandler(h EventHandler, interceptors []Interceptor) EventHandler {
+	if len(interceptors) == 0 {
+		return h
+	}
+	return &chainHandler{h: h, interceptors: interceptors}
+}
+
+// InterceptWrite passes data through interceptors to write
+func InterceptWrite(interceptors []Interceptor, c Conn, data []byte, write func(c Conn, data []byte) error) error {
+	if len(interceptors) == 0 {
+		return write(c, data)
+	}
+	return interceptors[0].Write(c, data, func(c Conn, data []byte) error {
+		return InterceptWrite(interceptors[1:], c, data, write)
+	})
+}
+
+type chainHandler struct {
+	h            EventHandler
+	interceptors []Interceptor
+}
+
+func (ch *chainHandler) OnOpened(c Conn) {
+	ch.onOpened(0, c)
+}
+
+func (ch *chainHandler) onOpened(i int, c Conn) {
+	if i == len(ch.interceptors) {
+		ch.h.OnOpened(c)
+		return
+	}
+	ch.interceptors[i].OnOpened(c, func(c Conn) {
+		ch.onOpened(i+1, c)
+	})
+}
+
+func (ch *chainHandler) OnClosed(c Conn) {
+	ch.onClosed(0, c)
+}
+
+func (ch *chainHandler) onClosed(i int, c Conn) {
+	if i == len(ch.interceptors) {
+		ch.h.OnClosed(c)
+		return
+	}
+	ch.interceptors[i].OnClosed(c, func(c Conn) {
+		ch.onClosed(i+1, c)
+	})
+}
+
+func (ch *chainHandler) OnReadMsg(c Conn, data []byte) error {
+	return ch.onReadMsg(0, c, data)
+}
+
+func (ch *chainHandler) onReadMsg(i int, c Conn, data []byte) error {
+	if i == len(ch.interceptors) {
+		return ch.h.OnReadMsg(c, data)
+	}
+	return ch.interceptors[i].OnReadMsg(c, data, func(c Conn, data []byte) error {
+		return ch.onReadMsg(i+1, c, data)
+	})
+}
+
+func (ch *chainHandler) OnWriteError(c Conn, data []byte, err error) {
+	ch.h.OnWriteError(c, data, err)
+}
+
+func (ch *chainHandler) OnReconnecting(c Conn, attempt int) {
+	if h, ok := ch.h.(ReconnectHandler); ok {
+		h.OnReconnecting(c, attempt)
+	}
+}
+
+func (ch *chainHandler) OnReconnected(c Conn) {
+	if h, ok := ch.h.(ReconnectHandler); ok {
+		h.OnReconnected(c)
+	}
+}
+
+func (ch *chainHandler) OnShutdown(c Conn) {
+	if h, ok := ch.h.(ShutdownHandler); ok {
+		h.OnShutdown(c)
+	}
+}
+
+func (ch *chainHandler) OnSendQueueFull(c Conn, data []byte) {
+	if h, ok := ch.h.(SendQueueFullHandler); ok {
+		h.OnSendQueueFull(c, data)
+	}
+}
+
+func (ch *chainHandler) OnIdleTimeout(c Conn) {
+	if h, ok := ch.h.(IdleTimeoutHandler); ok {
+		h.OnIdleTimeout(c)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gcore
+
+import (
+	"net"
+	"time"
+)
+
+// KCPOptions options of the KCP services, reliable and ordered msgs over UDP, the zero value is the default.
+// NoDelay, Interval, Resend and NoCongestion are the nodelay mode, common presets:
+//
+//	normal: false, 40ms, 0, false
+//	fast:   false, 30ms, 2, true
+//	fast2:  true, 20ms, 2, true
+//	fast3:  true, 10ms, 2, true
+//
+// Both peers should use the same options.
+type KCPOptions struct {
+	// NoDelay lowers the min RTO to 30ms and backs off retransmission by 1.5x instead of 2x
+	NoDelay bool
+	// Interval of flushing segments, 10ms-5s, default: 100ms
+	Interval time.Duration
+	// Resend fast resend a segment after it is skipped by the number of ACKs, default: 0, disabled
+	Resend int
+	// NoCongestion disables the congestion window, only the send and remote windows limit sending
+	NoCongestion bool
+	// SendWindow, RecvWindow in segments, default: 32, 128, RecvWindow is at least 128.
+	// A msg is split into segments of MTU-24 bytes, it must fit in RecvWindow segments.
+	SendWindow int
+	RecvWindow int
+	// MTU max size of a datagram, default: 1400
+	MTU int
+	// DeadLink a conn is closed after a segment is sent DeadLink times without ACK, default: 20
+	DeadLink int
+	// WrapConn wraps the packet conn of servers and clients if not nil,
+	// e.g. netsim.Wrap to simulate packet loss and latency in tests
+	WrapConn func(net.PacketConn) net.PacketConn
+}
@@ -22,6 +22,9 @@ package gcore
 
 import (
 	"context"
+	"crypto/tls"
+	"net"
+	"os"
 	"time"
 
 	"github.com/izhw/gnet/codec"
@@ -35,7 +38,7 @@ const (
 type Option func(o *Options)
 
 type Options struct {
-	Addr           string            // addr for service
+	Addr           string            // addr for service, unix:///path or unix://@name for unix sockets
 	ServiceType    ServiceType       // service type, default SvcTypeTCPServer
 	Handler        EventHandler      // event handler, default &NetEventHandler
 	Logger         logger.Logger     // default: &discardLogger{}
@@ -45,6 +48,21 @@ type Options struct {
 	InitReadBufLen uint32            // default: 1024, init length of conn reading buf
 	MaxReadBufLen  uint32            // default: MaxRWLen
 	ConnLimit      uint32            // default: 0, unlimited, limit of conn num for Server
+	EventLoopNum   int               // default: 0, runtime.NumCPU(), number of event loops for the event-loop Server
+	ListenerNum    int               // default: 0, one listener, see WithReusePort
+
+	// Listener the TCP and WebSocket servers serve the conns accepted from it instead of listening on Addr,
+	// e.g. a listener of tcp/mux. ListenerNum and Restart are not supported with it. default: nil
+	Listener net.Listener
+
+	// ProxyProtocol the TCP server reads PROXY protocol headers of load balancers,
+	// see ProxyProtocolOptions. default: disabled
+	ProxyProtocol ProxyProtocolOptions
+
+	// TLSConfig enables TLS for Server, Client and AsyncClient when not nil.
+	// Server requires Certificates, GetCertificate or GetConfigForClient,
+	// set ClientAuth and ClientCAs to verify client certificates.
+	TLSConfig *tls.Config
 
 	// Context specifies a context for the service.
 	// Can be used to signal shutdown of the service.
@@ -53,10 +71,76 @@ type Options struct {
 	// Tag a tag for gnet.Conn
 	Tag string
 
+	// Socket options of accepted and dialed TCP sockets, and listeners
+	Socket SocketOptions
+
+	// RestartSignal Server.Serve calls Server.Restart on the signal, conns of the old process
+	// are drained within RestartTimeout. default: nil, disabled, RestartTimeout 0 means no limit.
+	// Not supported by the event-loop Server.
+	RestartSignal  os.Signal
+	RestartTimeout time.Duration
+
 	// HeartData heartbeat data, for asyncClient or gnet.Pool
 	HeartData []byte
 	// HeartInterval heartbeat interval, default: 30s
 	HeartInterval time.Duration
+	// HeartTimeout server conns which receive nothing for HeartTimeout are closed,
+	// after OnIdleTimeout is called. Checked on a timing wheel, so ReadTimeout can be 0
+	// to avoid resetting the read deadline on every read. default: 0, disabled
+	HeartTimeout time.Duration
+	// HeartPingInterval server sends HeartData to conns silent for the interval, and every
+	// interval after, peers should reply. Received heartbeats are not echoed. default: 0, disabled
+	HeartPingInterval time.Duration
+
+	// Reconnect AsyncClient redials Addr when the conn is broken, default: false
+	Reconnect bool
+	// ReconnectMinDelay, ReconnectMaxDelay bounds of the jittered exponential backoff,
+	// default: 100ms, 30s
+	ReconnectMinDelay time.Duration
+	ReconnectMaxDelay time.Duration
+	// ReconnectMaxRetries max number of consecutive failed redials,
+	// AsyncClient is closed when exceeded. default: 0, unlimited
+	ReconnectMaxRetries uint32
+	// ReconnectWritePolicy how Write behaves while reconnecting, default: ReconnectWriteBuffer
+	ReconnectWritePolicy ReconnectWritePolicy
+
+	// SendQueueLen max number of msgs in the send queue of a Conn, default: 100
+	// SendQueueBytes max bytes of encoded msgs in the send queue, default: 0, unlimited
+	SendQueueLen   int
+	SendQueueBytes int
+	// SendQueuePolicy how Write behaves when the send queue is full, default: SendQueueBlock
+	SendQueuePolicy SendQueuePolicy
+	// WriteBatchBytes max bytes of queued msgs written by one syscall(writev),
+	// default: 64KB, <= 0 means one msg per write
+	WriteBatchBytes int
+
+	// WorkerNum number of workers calling OnReadMsg of Server, msgs of a Conn are handled
+	// in order by the same worker. default: 0, OnReadMsg is called in the read loop
+	WorkerNum int
+	// WorkerQueueLen max number of msgs queued for a worker, default: 1024
+	WorkerQueueLen int
+	// WorkerQueuePolicy default: WorkerQueueBlock
+	WorkerQueuePolicy WorkerQueuePolicy
+
+	// DatagramFraming each UDP datagram holds one or more msgs encoded with HeaderCodec,
+	// default: false, a datagram is a msg
+	DatagramFraming bool
+
+	// KCP options of the KCP services, see KCPOptions
+	KCP KCPOptions
+
+	// WebSocket options of the WebSocket services, see WebSocketOptions
+	WebSocket WebSocketOptions
+
+	// Multiplex enables AsyncClient.Call, each frame body except heartbeats is prefixed with a request ID,
+	// see EncodeCall, DecodeCall and Reply. default: false
+	Multiplex bool
+
+	// Metrics sink of the metrics of servers, clients and pools, labeled with Tag. default: nil, disabled
+	Metrics MetricsSink
+
+	// Interceptors wrap Handler and outbound writes of Conns, the first one is the outermost
+	Interceptors []Interceptor
 
 	// PoolInitSize number of connections to establish when creating a pool
 	PoolInitSize uint32
@@ -72,21 +156,26 @@ type Options struct {
 
 func DefaultOptions() Options {
 	return Options{
-		ServiceType:    SvcTypeTCPServer,
-		Handler:        DefaultEventHandler(),
-		Logger:         logger.DefaultLogger(),
-		HeaderCodec:    &codec.CodecFixed32{},
-		ReadTimeout:    2 * time.Minute,
-		WriteTimeout:   5 * time.Second,
-		InitReadBufLen: 1024,
-		MaxReadBufLen:  MaxRWLen,
-		ConnLimit:      0,
-		Ctx:            context.Background(),
-		HeartData:      nil,
-		HeartInterval:  30 * time.Second,
-		PoolInitSize:   0,
-		PoolMaxSize:    16,
-		PoolGetTimeout: 3 * time.Second,
+		ServiceType:       SvcTypeTCPServer,
+		Handler:           DefaultEventHandler(),
+		Logger:            logger.DefaultLogger(),
+		HeaderCodec:       &codec.CodecFixed32{},
+		ReadTimeout:       2 * time.Minute,
+		WriteTimeout:      5 * time.Second,
+		InitReadBufLen:    1024,
+		MaxReadBufLen:     MaxRWLen,
+		ConnLimit:         0,
+		Ctx:               context.Background(),
+		HeartData:         nil,
+		HeartInterval:     30 * time.Second,
+		ReconnectMinDelay: 100 * time.Millisecond,
+		ReconnectMaxDelay: 30 * time.Second,
+		SendQueueLen:      100,
+		WriteBatchBytes:   64 * 1024,
+		WorkerQueueLen:    1024,
+		PoolInitSize:      0,
+		PoolMaxSize:       16,
+		PoolGetTimeout:    3 * time.Second,
 	}
 }
 
@@ -166,6 +255,56 @@ func WithConnNumLimit(limit uint32) Option {
 	}
 }
 
+// WithEventLoopNum number of event loops for SvcTypeTCPEventLoopServer
+// default: 0, runtime.NumCPU()
+func WithEventLoopNum(num int) Option {
+	return func(o *Options) {
+		o.EventLoopNum = num
+	}
+}
+
+// WithReusePort opens num listeners of Server on the same address with SO_REUSEPORT,
+// each with its own accept loop, the kernel spreads new conns over them.
+// linux only, a single listener is used on other platforms
+func WithReusePort(num int) Option {
+	return func(o *Options) {
+		o.ListenerNum = num
+	}
+}
+
+// WithListener serves the conns accepted from l instead of listening on Addr,
+// for the TCP and WebSocket servers
+func WithListener(l net.Listener) Option {
+	return func(o *Options) {
+		o.Listener = l
+	}
+}
+
+// WithProxyProtocol the TCP server reads a PROXY protocol v1 or v2 header at the beginning of the conns
+// from trusted, CIDRs or IPs, at least one is required. Conns from them without a header are closed.
+// RemoteAddr and LocalAddr of the conns report the original addresses in it
+func WithProxyProtocol(trusted ...string) Option {
+	return func(o *Options) {
+		o.ProxyProtocol = ProxyProtocolOptions{Enabled: true, TrustedCIDRs: trusted}
+	}
+}
+
+// WithProxyProtocolOptions for the TCP server, see ProxyProtocolOptions
+func WithProxyProtocolOptions(po ProxyProtocolOptions) Option {
+	return func(o *Options) {
+		o.ProxyProtocol = po
+	}
+}
+
+// WithTLSConfig enables TLS, the config is used for every handshake,
+// so certificates returned by GetCertificate can be reloaded at runtime.
+// default: nil, plaintext
+func WithTLSConfig(config *tls.Config) Option {
+	return func(o *Options) {
+		o.TLSConfig = config
+	}
+}
+
 // WithContext
 func WithContext(ctx context.Context) Option {
 	return func(o *Options) {
@@ -191,6 +330,160 @@ func WithHeartbeat(data []byte, interval time.Duration) Option {
 	}
 }
 
+// WithSocketOptions for servers, clients and pools
+func WithSocketOptions(so SocketOptions) Option {
+	return func(o *Options) {
+		o.Socket = so
+	}
+}
+
+// WithGracefulRestart Server hands its listeners over to a new process of the same executable
+// on sig, then shuts down gracefully within timeout, see Server.Restart
+func WithGracefulRestart(sig os.Signal, timeout time.Duration) Option {
+	return func(o *Options) {
+		o.RestartSignal = sig
+		o.RestartTimeout = timeout
+	}
+}
+
+// WithHeartbeatTimeout closes server conns which receive nothing for timeout,
+// see IdleTimeoutHandler
+func WithHeartbeatTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.HeartTimeout = timeout
+	}
+}
+
+// WithServerPing server sends data to conns silent for interval,
+// instead of echoing the heartbeats of clients
+func WithServerPing(data []byte, interval time.Duration) Option {
+	return func(o *Options) {
+		o.HeartData = data
+		o.HeartPingInterval = interval
+	}
+}
+
+// WithReconnect enables reconnecting for AsyncClient,
+// min, max: bounds of the backoff between redials, zero value means default
+// maxRetries: 0 means unlimited
+func WithReconnect(min, max time.Duration, maxRetries uint32) Option {
+	return func(o *Options) {
+		o.Reconnect = true
+		if min > 0 {
+			o.ReconnectMinDelay = min
+		}
+		if max > 0 {
+			o.ReconnectMaxDelay = max
+		}
+		if o.ReconnectMinDelay > o.ReconnectMaxDelay {
+			o.ReconnectMinDelay = o.ReconnectMaxDelay
+		}
+		o.ReconnectMaxRetries = maxRetries
+	}
+}
+
+// WithReconnectWritePolicy default: ReconnectWriteBuffer
+func WithReconnectWritePolicy(p ReconnectWritePolicy) Option {
+	return func(o *Options) {
+		o.ReconnectWritePolicy = p
+	}
+}
+
+// WithSendQueue limits the send queue of a Conn by number of msgs and bytes,
+// zero value means unlimited
+func WithSendQueue(length, bytes int) Option {
+	return func(o *Options) {
+		o.SendQueueLen = length
+		o.SendQueueBytes = bytes
+	}
+}
+
+// WithSendQueuePolicy default: SendQueueBlock
+func WithSendQueuePolicy(p SendQueuePolicy) Option {
+	return func(o *Options) {
+		o.SendQueuePolicy = p
+	}
+}
+
+// WithWriteBatchBytes default: 64KB, <= 0 means one msg per write
+func WithWriteBatchBytes(n int) Option {
+	return func(o *Options) {
+		o.WriteBatchBytes = n
+	}
+}
+
+// WithWorkerPool dispatches msgs to num workers for Server,
+// queueLen: max number of msgs queued for a worker, zero value means default
+func WithWorkerPool(num, queueLen int) Option {
+	return func(o *Options) {
+		o.WorkerNum = num
+		if queueLen > 0 {
+			o.WorkerQueueLen = queueLen
+		}
+	}
+}
+
+// WithWorkerQueuePolicy default: WorkerQueueBlock
+func WithWorkerQueuePolicy(p WorkerQueuePolicy) Option {
+	return func(o *Options) {
+		o.WorkerQueuePolicy = p
+	}
+}
+
+// WithMetrics e.g. metrics.NewRegistry(), metrics are labeled with Tag
+func WithMetrics(sink MetricsSink) Option {
+	return func(o *Options) {
+		o.Metrics = sink
+	}
+}
+
+// WithInterceptors appends interceptors to the chain, the first one is the outermost
+func WithInterceptors(interceptors ...Interceptor) Option {
+	return func(o *Options) {
+		o.Interceptors = append(o.Interceptors[:len(o.Interceptors):len(o.Interceptors)], interceptors...)
+	}
+}
+
+// WithDatagramFraming msgs in UDP datagrams are encoded with HeaderCodec
+// default: false
+func WithDatagramFraming(enable bool) Option {
+	return func(o *Options) {
+		o.DatagramFraming = enable
+	}
+}
+
+// WithKCPOptions for the KCP services
+func WithKCPOptions(ko KCPOptions) Option {
+	return func(o *Options) {
+		o.KCP = ko
+	}
+}
+
+// WithKCPNoDelay sets the nodelay mode of the KCP services, see KCPOptions
+func WithKCPNoDelay(nodelay bool, interval time.Duration, resend int, nc bool) Option {
+	return func(o *Options) {
+		o.KCP.NoDelay = nodelay
+		o.KCP.Interval = interval
+		o.KCP.Resend = resend
+		o.KCP.NoCongestion = nc
+	}
+}
+
+// WithWebSocketOptions for the WebSocket services
+func WithWebSocketOptions(wo WebSocketOptions) Option {
+	return func(o *Options) {
+		o.WebSocket = wo
+	}
+}
+
+// WithMultiplex enables request/response correlation for AsyncClient,
+// the server should reply with Reply
+func WithMultiplex(enable bool) Option {
+	return func(o *Options) {
+		o.Multiplex = enable
+	}
+}
+
 // WithPoolSize
 func WithPoolSize(init, max uint32) Option {
 	return func(o *Options) {
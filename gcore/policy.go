@@ -0,0 +1,69 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gcore
+
+// ReconnectWritePolicy decides how AsyncClient.Write behaves while reconnecting
+type ReconnectWritePolicy uint8
+
+const (
+	// ReconnectWriteBuffer queues data in the send queue, it is sent after reconnected
+	ReconnectWriteBuffer ReconnectWritePolicy = iota
+	// ReconnectWriteReject returns ErrConnReconnecting
+	ReconnectWriteReject
+)
+
+// SlowReceiverPolicy decides how a broadcast treats a conn whose send queue is full
+type SlowReceiverPolicy uint8
+
+const (
+	// SlowReceiverSkip drops the msg for the conn
+	SlowReceiverSkip SlowReceiverPolicy = iota
+	// SlowReceiverBlock waits until the msg is queued, or the conn is closed
+	SlowReceiverBlock
+	// SlowReceiverDisconnect drops the msg and closes the conn
+	SlowReceiverDisconnect
+)
+
+// SendQueuePolicy decides how Conn.Write behaves when the send queue is full
+type SendQueuePolicy uint8
+
+const (
+	// SendQueueBlock waits for room, TryWrite returns ErrSendQueueFull instead
+	SendQueueBlock SendQueuePolicy = iota
+	// SendQueueDropNewest drops data, returns ErrSendQueueFull
+	SendQueueDropNewest
+	// SendQueueDropOldest drops the oldest queued msgs to make room for data
+	SendQueueDropOldest
+	// SendQueueClose drops data and closes the Conn, returns ErrSendQueueFull
+	SendQueueClose
+)
+
+// WorkerQueuePolicy decides how a msg is dispatched when the queue of its worker is full
+type WorkerQueuePolicy uint8
+
+const (
+	// WorkerQueueBlock waits for room, reading of the conn is blocked
+	WorkerQueueBlock WorkerQueuePolicy = iota
+	// WorkerQueueDrop drops the msg
+	WorkerQueueDrop
+	// WorkerQueueClose drops the msg and closes the conn
+	WorkerQueueClose
+)
@@ -0,0 +1,83 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gcore
+
+import (
+	"net"
+)
+
+// ProxyProtocolOptions HAProxy PROXY protocol of the TCP server, see WithProxyProtocol
+type ProxyProtocolOptions struct {
+	// Enabled the server reads a PROXY protocol v1 or v2 header at the beginning of the conns
+	// from trusted sources, before TLS and framing. Conns without one are closed.
+	Enabled bool
+	// TrustedCIDRs sources whose headers are read, e.g. the load balancers, CIDRs or IPs.
+	// Conns from other sources are served as is, their headers can't spoof the addresses.
+	// Required if Enabled
+	TrustedCIDRs []string
+	// Optional conns from trusted sources without a header are served with their own addresses,
+	// for sources sending both, e.g. during a migration. The header is detected by its signature.
+	Optional bool
+}
+
+// types of the TLVs of PROXY protocol v2 headers
+const (
+	ProxyTLVALPN      = 0x01
+	ProxyTLVAuthority = 0x02 // the host name sent by the client, e.g. the SNI
+	ProxyTLVCRC32C    = 0x03 // checked by the server
+	ProxyTLVNoop      = 0x04
+	ProxyTLVUniqueID  = 0x05
+	ProxyTLVSSL       = 0x20
+	ProxyTLVNetNS     = 0x30
+)
+
+// ProxyTLV a type-length-value of a PROXY protocol v2 header
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader the PROXY protocol header received by a server conn
+type ProxyHeader struct {
+	Version int // 1 or 2
+	// Local the v2 LOCAL command or v1 UNKNOWN, e.g. health checks of the load balancer,
+	// Source and Destination are nil, the conn reports its own addresses
+	Local       bool
+	Source      net.Addr // address of the original client
+	Destination net.Addr // address the original client connected to
+	TLVs        []ProxyTLV
+}
+
+// TLV returns the value of the first TLV of typ
+func (h *ProxyHeader) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ProxyHeaderConn optional interface of Conn, implemented by the conns of the TCP server
+type ProxyHeaderConn interface {
+	// ProxyHeader returns the PROXY protocol header received, nil if none
+	ProxyHeader() *ProxyHeader
+}
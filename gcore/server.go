@@ -20,6 +20,10 @@
 
 package gcore
 
+import (
+	"context"
+)
+
 // Server
 // e.g. TCP server, WebSocket server
 type Server interface {
@@ -30,6 +34,29 @@ type Server interface {
 	// Stop can stop the service whenever you want to
 	// it is also called automatically when an interrupt signal arrives
 	Stop()
+	// Shutdown gracefully shuts down the server, it stops accepting, notifies handlers,
+	// waits for conns to finish in-flight msgs and flush queued data, then closes them.
+	// Conns still open when ctx is done are closed forcibly and ctx.Err() is returned.
+	Shutdown(ctx context.Context) error
 	// ConnNum returns the number of currently active connections
 	ConnNum() uint32
+	// GetConn returns the active connection with id
+	GetConn(id uint64) (Conn, bool)
+	// GetConnsByTag returns the active connections tagged with tag
+	GetConnsByTag(tag string) []Conn
+	// RangeConns calls f sequentially for each active connection until f returns false
+	RangeConns(f func(c Conn) bool)
+	// CloseConn closes the active connection with id, reason is logged
+	CloseConn(id uint64, reason string) error
+	// JoinGroup adds c to group, c leaves all groups automatically when closed
+	JoinGroup(group string, c Conn) error
+	// LeaveGroup removes c from group
+	LeaveGroup(group string, c Conn)
+	// Broadcast sends data to all active connections, data is encoded once,
+	// returns the number of connections data is queued to
+	Broadcast(data []byte, policy SlowReceiverPolicy) (n int, err error)
+	// GroupBroadcast sends data to the connections in group, like Broadcast
+	GroupBroadcast(group string, data []byte, policy SlowReceiverPolicy) (n int, err error)
+	// WorkerStats returns the stats of the worker pool, zero value if WorkerNum is 0
+	WorkerStats() WorkerStats
 }
@@ -28,6 +28,16 @@ const (
 	SvcTypeTCPAsyncClient
 	SvcTypeTCPPool
 	SvcTypeTCPAsyncPool
+	SvcTypeTCPEventLoopServer // epoll-based server, linux only
+	SvcTypeUDPServer
+	SvcTypeUDPClient
+	SvcTypeKCPServer
+	SvcTypeKCPClient
+	SvcTypeKCPAsyncClient
+	SvcTypeKCPPool
+	SvcTypeKCPAsyncPool
+	SvcTypeWebSocketServer
+	SvcTypeWebSocketClient
 )
 
 func (t ServiceType) TCPServerType() bool {
@@ -64,3 +74,73 @@ func (t ServiceType) TCPAsyncPoolType() bool {
 	}
 	return false
 }
+
+func (t ServiceType) TCPEventLoopServerType() bool {
+	if t&SvcTypeTCPEventLoopServer != 0 {
+		return true
+	}
+	return false
+}
+
+func (t ServiceType) UDPServerType() bool {
+	if t&SvcTypeUDPServer != 0 {
+		return true
+	}
+	return false
+}
+
+func (t ServiceType) UDPClientType() bool {
+	if t&SvcTypeUDPClient != 0 {
+		return true
+	}
+	return false
+}
+
+func (t ServiceType) KCPServerType() bool {
+	if t&SvcTypeKCPServer != 0 {
+		return true
+	}
+	return false
+}
+
+func (t ServiceType) KCPClientType() bool {
+	if t&SvcTypeKCPClient != 0 {
+		return true
+	}
+	return false
+}
+
+func (t ServiceType) KCPAsyncClientType() bool {
+	if t&SvcTypeKCPAsyncClient != 0 {
+		return true
+	}
+	return false
+}
+
+func (t ServiceType) KCPPoolType() bool {
+	if t&SvcTypeKCPPool != 0 {
+		return true
+	}
+	return false
+}
+
+func (t ServiceType) KCPAsyncPoolType() bool {
+	if t&SvcTypeKCPAsyncPool != 0 {
+		return true
+	}
+	return false
+}
+
+func (t ServiceType) WebSocketServerType() bool {
+	if t&SvcTypeWebSocketServer != 0 {
+		return true
+	}
+	return false
+}
+
+func (t ServiceType) WebSocketClientType() bool {
+	if t&SvcTypeWebSocketClient != 0 {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gcore
+
+import (
+	"time"
+)
+
+// SocketOptions options of TCP sockets, the zero value is the default.
+// Options marked linux only are ignored on other platforms.
+type SocketOptions struct {
+	// KeepAliveIdle idle time before the first keepalive probe, default: 1m, < 0 disables keepalive
+	KeepAliveIdle time.Duration
+	// KeepAliveInterval interval between keepalive probes, linux only, default: 10s
+	KeepAliveInterval time.Duration
+	// KeepAliveCount number of unacknowledged probes before the conn is dropped, linux only, default: 6
+	KeepAliveCount int
+	// Delay enables Nagle's algorithm, default: false, TCP_NODELAY is set
+	Delay bool
+	// ReadBufferSize, WriteBufferSize SO_RCVBUF and SO_SNDBUF, default: 0, the system default
+	ReadBufferSize  int
+	WriteBufferSize int
+	// Linger SO_LINGER in seconds, default: 0, the system default.
+	// < 0: unsent data is discarded and the conn is reset on close
+	Linger int
+	// UserTimeout TCP_USER_TIMEOUT, max time transmitted data may remain unacknowledged
+	// before the conn is dropped, linux only, default: 0, the system default
+	UserTimeout time.Duration
+	// QuickAck sets TCP_QUICKACK once connected, the kernel may leave quickack mode later, linux only
+	QuickAck bool
+	// Backlog listen backlog, linux only, default: 0, the system max (somaxconn)
+	Backlog int
+	// DisableReuseAddr clears SO_REUSEADDR of listeners, linux only, it is set by default
+	DisableReuseAddr bool
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gcore
+
+import (
+	"time"
+)
+
+// WorkerStats stats of the worker pool of Server
+type WorkerStats struct {
+	Workers    int           // number of workers
+	Queued     int           // number of msgs waiting in queues
+	Handled    uint64        // total number of msgs handled
+	Dropped    uint64        // total number of msgs dropped as queues are full
+	HandleTime time.Duration // total time spent in OnReadMsg, HandleTime/Handled is the mean latency
+}
+
+// ConnStats stats of a Conn, see Conn.Stats
+type ConnStats struct {
+	BytesIn    uint64 // bytes read, including headers
+	BytesOut   uint64 // bytes written, including headers
+	MsgsIn     uint64 // msgs read, excluding heartbeats
+	MsgsOut    uint64 // msgs written
+	Heartbeats uint64 // heartbeats received by server conns, sent by clients
+	// ConnectedAt time of the conn being accepted or dialed, the last reconnect for AsyncClient
+	ConnectedAt time.Time
+	LastRead    time.Time // zero if nothing is read
+	LastWrite   time.Time // zero if nothing is written
+	// SendQueueLen and SendQueueBytes msgs waiting in the send queue, zero for Client
+	SendQueueLen   int
+	SendQueueBytes int
+	// ReadBufLen length of the read buffer held by the conn
+	ReadBufLen int
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gcore
+
+import (
+	"net/http"
+)
+
+// WebSocketOptions options of the WebSocket services, the zero value is the default.
+// The client dials Addr as a ws:// or wss:// URL, TLSConfig is used for wss.
+type WebSocketOptions struct {
+	// Path of the endpoint, the server responds 404 to other paths, default: "", any path
+	Path string
+	// Subprotocols in preference order, the server selects the first one offered by the client,
+	// the client offers all of them
+	Subprotocols []string
+	// CheckOrigin the server responds 403 if it returns false, default: nil, any origin
+	CheckOrigin func(r *http.Request) bool
+	// Header extra header of the handshake request of the client, e.g. Origin or Authorization
+	Header http.Header
+	// Compression negotiates permessage-deflate without context takeover
+	Compression bool
+	// CompressThreshold msgs shorter than it are sent uncompressed, default: 0, all are compressed
+	CompressThreshold int
+	// Text msgs are sent in text frames instead of binary frames, they must be valid UTF-8
+	Text bool
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package interceptor built-in interceptors, see gcore.WithInterceptors
+package interceptor
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/logger"
+)
+
+// Recovery recovers panics in the handler, interceptors after it and Write.
+// A panic in OnReadMsg or Write is returned as an error, so the conn is closed.
+func Recovery(l logger.Logger) gcore.Interceptor {
+	return &recovery{l: l}
+}
+
+type recovery struct {
+	l logger.Logger
+}
+
+func (r *recovery) recover(c gcore.Conn, event string, err *error) {
+	if v := recover(); v != nil {
+		r.l.Errorf("conn:%d %s %s panic:[%v]\n%s", c.ID(), c.RemoteAddr(), event, v, debug.Stack())
+		if err != nil {
+			*err = fmt.Errorf("%s panic: %v", event, v)
+		}
+	}
+}
+
+func (r *recovery) OnOpened(c gcore.Conn, next func(c gcore.Conn)) {
+	defer r.recover(c, "OnOpened", nil)
+	next(c)
+}
+
+func (r *recovery) OnReadMsg(c gcore.Conn, data []byte, next func(c gcore.Conn, data []byte) error) (err error) {
+	defer r.recover(c, "OnReadMsg", &err)
+	return next(c, data)
+}
+
+func (r *recovery) OnClosed(c gcore.Conn, next func(c gcore.Conn)) {
+	defer r.recover(c, "OnClosed", nil)
+	next(c)
+}
+
+func (r *recovery) Write(c gcore.Conn, data []byte, next func(c gcore.Conn, data []byte) error) (err error) {
+	defer r.recover(c, "Write", &err)
+	return next(c, data)
+}
+
+// Logging logs conn events with l, msgs and writes at debug level
+func Logging(l logger.Logger) gcore.Interceptor {
+	return &logging{l: l}
+}
+
+type logging struct {
+	l logger.Logger
+}
+
+func (g *logging) OnOpened(c gcore.Conn, next func(c gcore.Conn)) {
+	g.l.Infof("conn:%d %s opened", c.ID(), c.RemoteAddr())
+	next(c)
+}
+
+func (g *logging) OnReadMsg(c gcore.Conn, data []byte, next func(c gcore.Conn, data []byte) error) error {
+	start := time.Now()
+	err := next(c, data)
+	if err != nil {
+		g.l.Infof("conn:%d %s read msg len:%d, cost:%v, error:[%v]", c.ID(), c.RemoteAddr(), len(data), time.Since(start), err)
+	} else {
+		g.l.Debugf("conn:%d %s read msg len:%d, cost:%v", c.ID(), c.RemoteAddr(), len(data), time.Since(start))
+	}
+	return err
+}
+
+func (g *logging) OnClosed(c gcore.Conn, next func(c gcore.Conn)) {
+	next(c)
+	g.l.Infof("conn:%d %s closed", c.ID(), c.RemoteAddr())
+}
+
+func (g *logging) Write(c gcore.Conn, data []byte, next func(c gcore.Conn, data []byte) error) error {
+	err := next(c, data)
+	if err != nil {
+		g.l.Infof("conn:%d %s write len:%d, error:[%v]", c.ID(), c.RemoteAddr(), len(data), err)
+	} else {
+		g.l.Debugf("conn:%d %s write len:%d", c.ID(), c.RemoteAddr(), len(data))
+	}
+	return err
+}
+
+// Latency calls observe with the duration of each OnReadMsg and its error
+func Latency(observe func(c gcore.Conn, d time.Duration, err error)) gcore.Interceptor {
+	return &latency{observe: observe}
+}
+
+type latency struct {
+	gcore.BaseInterceptor
+	observe func(c gcore.Conn, d time.Duration, err error)
+}
+
+func (t *latency) OnReadMsg(c gcore.Conn, data []byte, next func(c gcore.Conn, data []byte) error) error {
+	start := time.Now()
+	err := next(c, data)
+	t.observe(c, time.Since(start), err)
+	return err
+}
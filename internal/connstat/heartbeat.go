@@ -0,0 +1,153 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package connstat
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/izhw/gnet/internal/util/timingwheel"
+)
+
+const heartWheelSlots = 512
+
+// HeartKeeper closes idle conns and pings silent conns of a server, each conn is checked
+// on a timing wheel when it is due, instead of resetting a deadline on every read
+type HeartKeeper struct {
+	wheel   *timingwheel.Wheel
+	timeout time.Duration
+	ping    time.Duration
+}
+
+// NewHeartKeeper returns nil if both timeout and ping are disabled
+func NewHeartKeeper(timeout, ping time.Duration) *HeartKeeper {
+	d := timeout
+	if d <= 0 || (ping > 0 && ping < d) {
+		d = ping
+	}
+	if d <= 0 {
+		return nil
+	}
+	tick := d / 10
+	if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	} else if tick > time.Second {
+		tick = time.Second
+	}
+	return &HeartKeeper{
+		wheel:   timingwheel.New(tick, heartWheelSlots),
+		timeout: timeout,
+		ping:    ping,
+	}
+}
+
+func (k *HeartKeeper) Start() {
+	if k != nil {
+		k.wheel.Start()
+	}
+}
+
+func (k *HeartKeeper) Stop() {
+	if k != nil {
+		k.wheel.Stop()
+	}
+}
+
+// Watch starts checking the conn of stats, onIdle is called once it has received nothing for the timeout,
+// ping is called when it has been silent for the ping interval, and every interval after.
+// Both are called on the goroutine of the wheel and must not block. It returns nil if k is nil.
+func (k *HeartKeeper) Watch(stats *Stats, onIdle, ping func()) *HeartWatch {
+	if k == nil {
+		return nil
+	}
+	hw := &HeartWatch{
+		k:      k,
+		stats:  stats,
+		onIdle: onIdle,
+		ping:   ping,
+	}
+	d := k.timeout
+	if d <= 0 || (k.ping > 0 && k.ping < d) {
+		d = k.ping
+	}
+	hw.mu.Lock()
+	hw.timer = k.wheel.AfterFunc(d, hw.check)
+	hw.mu.Unlock()
+	return hw
+}
+
+// HeartWatch the heartbeat check of a conn
+type HeartWatch struct {
+	k        *HeartKeeper
+	stats    *Stats
+	onIdle   func()
+	ping     func()
+	mu       sync.Mutex // guards the fields below
+	timer    *timingwheel.Timer
+	lastPing time.Time
+	stopped  bool
+}
+
+// Stop stops checking, called when the conn is closed
+func (hw *HeartWatch) Stop() {
+	if hw == nil {
+		return
+	}
+	hw.mu.Lock()
+	hw.stopped = true
+	hw.timer.Stop()
+	hw.mu.Unlock()
+}
+
+func (hw *HeartWatch) check() {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	if hw.stopped {
+		return
+	}
+	now := time.Now()
+	idle := hw.stats.Idle(now)
+	timeout, ping := hw.k.timeout, hw.k.ping
+	if timeout > 0 && idle >= timeout {
+		hw.stopped = true
+		hw.onIdle()
+		return
+	}
+	next := time.Duration(math.MaxInt64)
+	if timeout > 0 {
+		next = timeout - idle
+	}
+	if ping > 0 {
+		due := ping - idle
+		if idle >= ping {
+			if hw.lastPing.IsZero() || now.Sub(hw.lastPing) >= ping {
+				hw.ping()
+				hw.lastPing = now
+			}
+			due = ping - now.Sub(hw.lastPing)
+		}
+		if due < next {
+			next = due
+		}
+	}
+	hw.timer.Reset(next)
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package connstat
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/metric"
+)
+
+// Stats counters of a conn updated with atomics, also added to the metrics shared by conns
+type Stats struct {
+	// 64-bit aligned for atomic operations
+	bytesIn     uint64
+	bytesOut    uint64
+	msgsIn      uint64
+	msgsOut     uint64
+	heartbeats  uint64
+	connectedAt int64 // unix nano
+	lastRead    int64 // unix nano
+	lastWrite   int64 // unix nano
+	readBufLen  int64
+	metrics     *metric.IO
+}
+
+func NewStats(m *metric.IO) *Stats {
+	return &Stats{
+		connectedAt: time.Now().UnixNano(),
+		metrics:     m,
+	}
+}
+
+// Connected resets the connected time, called when reconnected
+func (s *Stats) Connected() {
+	atomic.StoreInt64(&s.connectedAt, time.Now().UnixNano())
+}
+
+// Read n bytes are read, bufLen: length of the read buffer
+func (s *Stats) Read(n, bufLen int) {
+	atomic.StoreInt64(&s.readBufLen, int64(bufLen))
+	if n <= 0 {
+		return
+	}
+	atomic.AddUint64(&s.bytesIn, uint64(n))
+	atomic.StoreInt64(&s.lastRead, time.Now().UnixNano())
+	s.metrics.BytesIn.Add(float64(n))
+}
+
+// MsgRead a msg is decoded
+func (s *Stats) MsgRead() {
+	atomic.AddUint64(&s.msgsIn, 1)
+	s.metrics.MsgsIn.Add(1)
+}
+
+// Heartbeat a heartbeat is received by a server conn or sent by a client
+func (s *Stats) Heartbeat() {
+	atomic.AddUint64(&s.heartbeats, 1)
+	s.metrics.Heartbeats.Add(1)
+}
+
+// Written msgs and n bytes are written, either may be 0 if counted separately
+func (s *Stats) Written(msgs, n int) {
+	if msgs > 0 {
+		atomic.AddUint64(&s.msgsOut, uint64(msgs))
+		s.metrics.MsgsOut.Add(float64(msgs))
+	}
+	if n > 0 {
+		atomic.AddUint64(&s.bytesOut, uint64(n))
+		atomic.StoreInt64(&s.lastWrite, time.Now().UnixNano())
+		s.metrics.BytesOut.Add(float64(n))
+	}
+}
+
+// WriteFailed a write returns an error
+func (s *Stats) WriteFailed() {
+	s.metrics.WriteErrors.Add(1)
+}
+
+// Idle returns the duration nothing is read before now, since the conn is connected if nothing is read
+func (s *Stats) Idle(now time.Time) time.Duration {
+	last := atomic.LoadInt64(&s.lastRead)
+	if t := atomic.LoadInt64(&s.connectedAt); t > last {
+		last = t
+	}
+	return time.Duration(now.UnixNano() - last)
+}
+
+// Fill fills st with the counters, the send queue fields are left to the caller
+func (s *Stats) Fill(st *gcore.ConnStats) {
+	st.BytesIn = atomic.LoadUint64(&s.bytesIn)
+	st.BytesOut = atomic.LoadUint64(&s.bytesOut)
+	st.MsgsIn = atomic.LoadUint64(&s.msgsIn)
+	st.MsgsOut = atomic.LoadUint64(&s.msgsOut)
+	st.Heartbeats = atomic.LoadUint64(&s.heartbeats)
+	st.ConnectedAt = time.Unix(0, atomic.LoadInt64(&s.connectedAt))
+	st.LastRead = unixNano(atomic.LoadInt64(&s.lastRead))
+	st.LastWrite = unixNano(atomic.LoadInt64(&s.lastWrite))
+	st.ReadBufLen = int(atomic.LoadInt64(&s.readBufLen))
+}
+
+func unixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
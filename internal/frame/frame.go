@@ -0,0 +1,65 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package frame
+
+import (
+	"fmt"
+
+	"github.com/izhw/gnet/codec"
+	"github.com/izhw/gnet/gcore"
+)
+
+// Decode finds the first frame in b with hc,
+// returns the body and the length of the frame, frameLen is 0 if the frame is incomplete.
+// An incomplete frame of a FrameDecoder is ErrTooLarge once b reaches max.
+// body shares the memory of b.
+func Decode(hc codec.HeaderCodec, b []byte, max uint32) (body []byte, frameLen int, err error) {
+	if fd, ok := hc.(codec.FrameDecoder); ok {
+		offset, bodyLen, n, err := fd.DecodeFrame(b)
+		if err != nil {
+			return nil, 0, err
+		}
+		if n == 0 {
+			// the frame is longer than b, so it can't fit in max either
+			if uint64(len(b)) >= uint64(max) {
+				return nil, 0, fmt.Errorf("%w, incomplete msg len:%d reached max:%d", gcore.ErrTooLarge, len(b), max)
+			}
+			return nil, 0, nil
+		}
+		if uint64(n) > uint64(max) {
+			return nil, 0, fmt.Errorf("%w, msg len:%d greater than max:%d", gcore.ErrTooLarge, n, max)
+		}
+		return b[offset : offset+bodyLen], n, nil
+	}
+
+	bodyLen, headerLen := hc.Decode(b)
+	if bodyLen == 0 && headerLen == 0 {
+		return nil, 0, nil
+	}
+	msgLen := uint64(bodyLen) + uint64(headerLen)
+	if msgLen > uint64(max) {
+		return nil, 0, fmt.Errorf("%w, msg len:%d greater than max:%d", gcore.ErrTooLarge, msgLen, max)
+	}
+	if uint64(len(b)) < msgLen {
+		return nil, 0, nil
+	}
+	return b[headerLen:msgLen], int(msgLen), nil
+}
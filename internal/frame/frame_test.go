@@ -0,0 +1,44 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package frame
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/izhw/gnet/codec"
+	"github.com/izhw/gnet/gcore"
+)
+
+func TestDecodeIncompleteFrameMax(t *testing.T) {
+	hc := codec.NewLineCodec(0)
+	if _, n, err := Decode(hc, bytes.Repeat([]byte("a"), 15), 16); n != 0 || err != nil {
+		t.Fatalf("below max: n=%d err=%v", n, err)
+	}
+	if _, _, err := Decode(hc, bytes.Repeat([]byte("a"), 16), 16); !errors.Is(err, gcore.ErrTooLarge) {
+		t.Fatalf("reached max: %v, want %v", err, gcore.ErrTooLarge)
+	}
+	body, n, err := Decode(hc, []byte("abc\nd"), 16)
+	if err != nil || n != 4 || string(body) != "abc" {
+		t.Fatalf("complete frame: %q %d %v", body, n, err)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package metric the metrics reported by servers, clients and pools to Options.Metrics,
+// all metrics are no-ops if it is nil
+package metric
+
+import (
+	"github.com/izhw/gnet/gcore"
+)
+
+// IO metrics of the msgs read and written by conns
+type IO struct {
+	MsgsIn        gcore.Counter
+	MsgsOut       gcore.Counter
+	BytesIn       gcore.Counter
+	BytesOut      gcore.Counter
+	WriteErrors   gcore.Counter
+	Heartbeats    gcore.Counter // heartbeats received by servers, sent by clients
+	SendQueueFull gcore.Counter // writes while the send queue is full
+}
+
+// Server metrics of tcp/server and tcp/eventloop
+type Server struct {
+	IO
+	Accepted gcore.Counter
+	Rejected gcore.Counter // rejected by ConnLimit
+	Conns    gcore.Gauge
+}
+
+// Client metrics of Client and AsyncClient
+type Client struct {
+	IO
+	Connects      gcore.Counter
+	ConnectErrors gcore.Counter
+	Reconnects    gcore.Counter
+}
+
+// Pool metrics of Pool and AsyncPool
+type Pool struct {
+	Gets        gcore.Counter
+	GetTimeouts gcore.Counter
+	GetErrors   gcore.Counter // failed to create a conn
+	Heartbeats  gcore.Counter // heartbeats of idle conns checked by Get
+	Idle        gcore.Gauge   // conns waiting in the pool
+	InUse       gcore.Gauge   // conns got and not put back
+}
+
+func NewServer(opts *gcore.Options) *Server {
+	r := newReporter(opts, "gnet_server_")
+	return &Server{
+		IO:       newIO(r),
+		Accepted: r.counter("connections_accepted_total", "Number of accepted connections."),
+		Rejected: r.counter("connections_rejected_total", "Number of connections rejected by the connection limit."),
+		Conns:    r.gauge("connections", "Number of open connections."),
+	}
+}
+
+func NewClient(opts *gcore.Options) *Client {
+	r := newReporter(opts, "gnet_client_")
+	return &Client{
+		IO:            newIO(r),
+		Connects:      r.counter("connects_total", "Number of successful dials, including reconnects."),
+		ConnectErrors: r.counter("connect_errors_total", "Number of failed dials."),
+		Reconnects:    r.counter("reconnects_total", "Number of successful reconnects."),
+	}
+}
+
+func NewPool(opts *gcore.Options) *Pool {
+	r := newReporter(opts, "gnet_pool_")
+	return &Pool{
+		Gets:        r.counter("gets_total", "Number of successful gets."),
+		GetTimeouts: r.counter("get_timeouts_total", "Number of gets timed out waiting for a free connection."),
+		GetErrors:   r.counter("get_errors_total", "Number of gets failed to create a connection."),
+		Heartbeats:  r.counter("heartbeats_total", "Number of heartbeats checking idle connections."),
+		Idle:        r.gauge("idle_connections", "Number of idle connections in the pool."),
+		InUse:       r.gauge("inuse_connections", "Number of connections got from the pool and not put back."),
+	}
+}
+
+func newIO(r reporter) IO {
+	return IO{
+		MsgsIn:        r.counter("msgs_received_total", "Number of msgs received."),
+		MsgsOut:       r.counter("msgs_sent_total", "Number of msgs sent."),
+		BytesIn:       r.counter("bytes_received_total", "Number of bytes received."),
+		BytesOut:      r.counter("bytes_sent_total", "Number of bytes sent."),
+		WriteErrors:   r.counter("write_errors_total", "Number of failed writes."),
+		Heartbeats:    r.counter("heartbeats_total", "Number of heartbeats."),
+		SendQueueFull: r.counter("send_queue_full_total", "Number of writes while the send queue is full."),
+	}
+}
+
+// reporter creates metrics with the prefix and the tag label
+type reporter struct {
+	sink   gcore.MetricsSink
+	prefix string
+	labels gcore.Labels
+}
+
+func newReporter(opts *gcore.Options, prefix string) reporter {
+	return reporter{
+		sink:   opts.Metrics,
+		prefix: prefix,
+		labels: gcore.Labels{"tag": opts.Tag},
+	}
+}
+
+func (r reporter) counter(name, help string) gcore.Counter {
+	if r.sink == nil {
+		return nop{}
+	}
+	return r.sink.Counter(r.prefix+name, help, r.labels)
+}
+
+func (r reporter) gauge(name, help string) gcore.Gauge {
+	if r.sink == nil {
+		return nop{}
+	}
+	return r.sink.Gauge(r.prefix+name, help, r.labels)
+}
+
+type nop struct{}
+
+func (nop) Set(float64) {}
+
+func (nop) Add(float64) {}
@@ -0,0 +1,242 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package registry a sharded registry of live conns, indexed by id, tag and group
+package registry
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/izhw/gnet/gcore"
+)
+
+const shardNum = 64 // power of 2
+
+var lastID uint64
+
+// NextID returns a conn id unique in the process, never 0
+func NextID() uint64 {
+	return atomic.AddUint64(&lastID, 1)
+}
+
+type Registry struct {
+	shards [shardNum]shard
+	tags   index
+	groups index
+}
+
+type shard struct {
+	mu    sync.RWMutex
+	conns map[uint64]*entry
+}
+
+type entry struct {
+	c      gcore.Conn
+	groups map[string]struct{} // joined groups, guarded by mu of the shard
+}
+
+// index conns indexed by a string key, e.g. tag, group
+type index [shardNum]indexShard
+
+type indexShard struct {
+	mu    sync.RWMutex
+	conns map[string]map[uint64]gcore.Conn
+}
+
+func New() *Registry {
+	r := &Registry{}
+	for i := 0; i < shardNum; i++ {
+		r.shards[i].conns = make(map[uint64]*entry)
+		r.tags[i].conns = make(map[string]map[uint64]gcore.Conn)
+		r.groups[i].conns = make(map[string]map[uint64]gcore.Conn)
+	}
+	return r
+}
+
+func (r *Registry) shard(id uint64) *shard {
+	return &r.shards[id&(shardNum-1)]
+}
+
+// Add adds c with its current tag
+func (r *Registry) Add(c gcore.Conn, tag string) {
+	s := r.shard(c.ID())
+	s.mu.Lock()
+	s.conns[c.ID()] = &entry{c: c}
+	s.mu.Unlock()
+	r.tags.add(tag, c)
+}
+
+// Remove removes c added with tag, c leaves all groups
+func (r *Registry) Remove(c gcore.Conn, tag string) {
+	s := r.shard(c.ID())
+	s.mu.Lock()
+	if e := s.conns[c.ID()]; e != nil {
+		delete(s.conns, c.ID())
+		for group := range e.groups {
+			r.groups.remove(group, c)
+		}
+	}
+	s.mu.Unlock()
+	r.tags.remove(tag, c)
+}
+
+// Retag moves c from the index of old tag to the new one.
+// The caller serializes Retag and Remove of the same conn.
+func (r *Registry) Retag(c gcore.Conn, old, tag string) {
+	if old == tag {
+		return
+	}
+	r.tags.remove(old, c)
+	r.tags.add(tag, c)
+}
+
+// Join adds c to group, returns false if c is not in r
+func (r *Registry) Join(c gcore.Conn, group string) bool {
+	s := r.shard(c.ID())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.conns[c.ID()]
+	if e == nil {
+		return false
+	}
+	if _, ok := e.groups[group]; ok {
+		return true
+	}
+	if e.groups == nil {
+		e.groups = make(map[string]struct{})
+	}
+	e.groups[group] = struct{}{}
+	r.groups.add(group, c)
+	return true
+}
+
+// Leave removes c from group
+func (r *Registry) Leave(c gcore.Conn, group string) {
+	s := r.shard(c.ID())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.conns[c.ID()]
+	if e == nil {
+		return
+	}
+	if _, ok := e.groups[group]; !ok {
+		return
+	}
+	delete(e.groups, group)
+	r.groups.remove(group, c)
+}
+
+func (r *Registry) Get(id uint64) (gcore.Conn, bool) {
+	s := r.shard(id)
+	s.mu.RLock()
+	e, ok := s.conns[id]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return e.c, true
+}
+
+// GetByTag returns the conns tagged with tag
+func (r *Registry) GetByTag(tag string) []gcore.Conn {
+	return r.tags.get(tag)
+}
+
+// GetGroup returns the conns in group
+func (r *Registry) GetGroup(group string) []gcore.Conn {
+	return r.groups.get(group)
+}
+
+// Range calls f sequentially for each conn until f returns false.
+// f is called without holding locks, so it may close conns, conns added or removed
+// during Range may or may not be visited.
+func (r *Registry) Range(f func(c gcore.Conn) bool) {
+	var list []gcore.Conn
+	for i := 0; i < shardNum; i++ {
+		s := &r.shards[i]
+		list = list[:0]
+		s.mu.RLock()
+		for _, e := range s.conns {
+			list = append(list, e.c)
+		}
+		s.mu.RUnlock()
+		for _, c := range list {
+			if !f(c) {
+				return
+			}
+		}
+	}
+}
+
+func (x *index) shard(key string) *indexShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return &x[h.Sum32()&(shardNum-1)]
+}
+
+func (x *index) add(key string, c gcore.Conn) {
+	if key == "" {
+		return
+	}
+	s := x.shard(key)
+	s.mu.Lock()
+	m := s.conns[key]
+	if m == nil {
+		m = make(map[uint64]gcore.Conn)
+		s.conns[key] = m
+	}
+	m[c.ID()] = c
+	s.mu.Unlock()
+}
+
+func (x *index) remove(key string, c gcore.Conn) {
+	if key == "" {
+		return
+	}
+	s := x.shard(key)
+	s.mu.Lock()
+	if m := s.conns[key]; m != nil {
+		delete(m, c.ID())
+		if len(m) == 0 {
+			delete(s.conns, key)
+		}
+	}
+	s.mu.Unlock()
+}
+
+func (x *index) get(key string) []gcore.Conn {
+	if key == "" {
+		return nil
+	}
+	s := x.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m := s.conns[key]
+	if len(m) == 0 {
+		return nil
+	}
+	list := make([]gcore.Conn, 0, len(m))
+	for _, c := range m {
+		list = append(list, c)
+	}
+	return list
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package delay
+
+import (
+	"math/rand"
+	"time"
+)
+
+type jitterDelay struct {
+	Delay
+	r *rand.Rand
+}
+
+// NewJitterDelay returns a Delay growing exponentially like NewTempDelay,
+// each delay d is randomized within [d/2, d), avoiding reconnect storms
+func NewJitterDelay(min, max time.Duration) Delay {
+	return &jitterDelay{
+		Delay: NewTempDelay(min, max),
+		r:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (d *jitterDelay) GetDelay() time.Duration {
+	v := d.Delay.GetDelay()
+	half := v / 2
+	if half <= 0 {
+		return v
+	}
+	return half + time.Duration(d.r.Int63n(int64(half)))
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package timingwheel a hashed timing wheel running many coarse timers on one goroutine
+package timingwheel
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Wheel a timing wheel, timers fire on its goroutine with the precision of a tick,
+// so the callbacks should not block
+type Wheel struct {
+	mu       sync.Mutex
+	tick     time.Duration
+	slots    []*list.List
+	pos      int
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+	stopped  bool
+}
+
+// Timer a timer of a Wheel
+type Timer struct {
+	w      *Wheel
+	f      func()
+	rounds int // full turns of the wheel to wait
+	slot   int
+	elem   *list.Element // nil if fired or stopped
+}
+
+// New returns a wheel of n slots, each lasting tick
+func New(tick time.Duration, n int) *Wheel {
+	w := &Wheel{
+		tick:     tick,
+		slots:    make([]*list.List, n),
+		stopChan: make(chan struct{}),
+	}
+	for i := range w.slots {
+		w.slots[i] = list.New()
+	}
+	return w
+}
+
+func (w *Wheel) Start() {
+	w.wg.Add(1)
+	go w.run()
+}
+
+// Stop stops the wheel, pending timers never fire
+func (w *Wheel) Stop() {
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return
+	}
+	w.stopped = true
+	w.mu.Unlock()
+	close(w.stopChan)
+	w.wg.Wait()
+}
+
+// AfterFunc calls f on the goroutine of w after d, rounded up to a tick
+func (w *Wheel) AfterFunc(d time.Duration, f func()) *Timer {
+	t := &Timer{w: w, f: f}
+	w.mu.Lock()
+	w.add(t, d)
+	w.mu.Unlock()
+	return t
+}
+
+// add called with mu held
+func (w *Wheel) add(t *Timer, d time.Duration) {
+	ticks := int((d + w.tick - 1) / w.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	t.rounds = (ticks - 1) / len(w.slots)
+	t.slot = (w.pos + ticks) % len(w.slots)
+	t.elem = w.slots[t.slot].PushBack(t)
+}
+
+// Reset reschedules t to fire after d, even if it has fired or been stopped
+func (t *Timer) Reset(d time.Duration) {
+	w := t.w
+	w.mu.Lock()
+	if t.elem != nil {
+		w.slots[t.slot].Remove(t.elem)
+	}
+	w.add(t, d)
+	w.mu.Unlock()
+}
+
+// Stop prevents t from firing, returns false if it has fired or been stopped
+func (t *Timer) Stop() bool {
+	w := t.w
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if t.elem == nil {
+		return false
+	}
+	w.slots[t.slot].Remove(t.elem)
+	t.elem = nil
+	return true
+}
+
+func (w *Wheel) run() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+
+	var expired []*Timer
+	for {
+		select {
+		case <-w.stopChan:
+			return
+		case <-ticker.C:
+		}
+		w.mu.Lock()
+		w.pos = (w.pos + 1) % len(w.slots)
+		l := w.slots[w.pos]
+		for e := l.Front(); e != nil; {
+			next := e.Next()
+			t := e.Value.(*Timer)
+			if t.rounds > 0 {
+				t.rounds--
+			} else {
+				l.Remove(e)
+				t.elem = nil
+				expired = append(expired, t)
+			}
+			e = next
+		}
+		w.mu.Unlock()
+		for i, t := range expired {
+			t.f()
+			expired[i] = nil
+		}
+		expired = expired[:0]
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package worker a pool of goroutines calling OnReadMsg, msgs of a conn are handled
+// in order by the same worker, msgs of different conns in parallel
+package worker
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/logger"
+)
+
+type task struct {
+	c    gcore.Conn
+	data []byte
+	done func()
+}
+
+type Pool struct {
+	// 64-bit aligned for atomic operations
+	queued      int64
+	handled     uint64
+	dropped     uint64
+	handleNanos uint64
+	workers     []chan task
+	policy      gcore.WorkerQueuePolicy
+	handler     gcore.EventHandler
+	logger      logger.Logger
+	wg          sync.WaitGroup
+}
+
+func NewPool(opts *gcore.Options) *Pool {
+	p := &Pool{
+		workers: make([]chan task, opts.WorkerNum),
+		policy:  opts.WorkerQueuePolicy,
+		handler: opts.Handler,
+		logger:  opts.Logger,
+	}
+	for i := range p.workers {
+		p.workers[i] = make(chan task, opts.WorkerQueueLen)
+	}
+	return p
+}
+
+func (p *Pool) Start() {
+	for _, ch := range p.workers {
+		p.wg.Add(1)
+		go p.work(ch)
+	}
+}
+
+// Stop waits for the queued msgs to be handled, no Dispatch should be called after Stop
+func (p *Pool) Stop() {
+	for _, ch := range p.workers {
+		close(ch)
+	}
+	p.wg.Wait()
+}
+
+// Dispatch queues data of c to the worker of c, done is called after OnReadMsg returns
+// or data is dropped. Blocking of WorkerQueueBlock stops when closed is closed.
+// It returns an error if c should be closed.
+func (p *Pool) Dispatch(c gcore.Conn, data []byte, closed <-chan struct{}, done func()) error {
+	t := task{c: c, data: data, done: done}
+	ch := p.workers[c.ID()%uint64(len(p.workers))]
+	atomic.AddInt64(&p.queued, 1)
+	select {
+	case ch <- t:
+		return nil
+	default:
+	}
+	if p.policy == gcore.WorkerQueueBlock {
+		select {
+		case ch <- t:
+			return nil
+		case <-closed:
+			p.drop(t)
+			return gcore.ErrConnClosed
+		}
+	}
+	p.drop(t)
+	if p.policy == gcore.WorkerQueueClose {
+		return gcore.ErrWorkerQueueFull
+	}
+	p.logger.Debugf("Worker queue full, msg of conn:%d dropped", c.ID())
+	return nil
+}
+
+func (p *Pool) drop(t task) {
+	atomic.AddInt64(&p.queued, -1)
+	atomic.AddUint64(&p.dropped, 1)
+	if t.done != nil {
+		t.done()
+	}
+}
+
+func (p *Pool) work(ch chan task) {
+	defer p.wg.Done()
+	for t := range ch {
+		atomic.AddInt64(&p.queued, -1)
+		p.handle(t)
+	}
+}
+
+func (p *Pool) handle(t task) {
+	start := time.Now()
+	err := p.handler.OnReadMsg(t.c, t.data)
+	atomic.AddUint64(&p.handleNanos, uint64(time.Since(start)))
+	atomic.AddUint64(&p.handled, 1)
+	// before closing, Close may wait for the read loop which waits for done
+	if t.done != nil {
+		t.done()
+	}
+	if err != nil {
+		p.logger.Infof("Worker conn:%d OnReadMsg error:[%v]", t.c.ID(), err)
+		_ = t.c.Close()
+	}
+}
+
+func (p *Pool) Stats() gcore.WorkerStats {
+	if p == nil {
+		return gcore.WorkerStats{}
+	}
+	return gcore.WorkerStats{
+		Workers:    len(p.workers),
+		Queued:     int(atomic.LoadInt64(&p.queued)),
+		Handled:    atomic.LoadUint64(&p.handled),
+		Dropped:    atomic.LoadUint64(&p.dropped),
+		HandleTime: time.Duration(atomic.LoadUint64(&p.handleNanos)),
+	}
+}
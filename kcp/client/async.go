@@ -0,0 +1,241 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/connstat"
+	"github.com/izhw/gnet/internal/metric"
+	"github.com/izhw/gnet/internal/registry"
+)
+
+var _ gcore.Conn = &AsyncClient{}
+
+// AsyncClient is a KCP client, received msgs are passed to OnReadMsg in order by a recv loop.
+// HeartData is sent every HeartInterval if set, received HeartData is not passed to the handler.
+// It is closed when the link is dead, reconnecting is not supported.
+type AsyncClient struct {
+	id      uint64
+	opts    gcore.Options
+	link    *link
+	metrics *metric.Client
+	stats   *connstat.Stats
+	closed  int32
+	mu      sync.Mutex // guards tag
+	tag     string
+}
+
+func NewAsyncClient() *AsyncClient {
+	return &AsyncClient{
+		id: registry.NextID(),
+	}
+}
+
+func (c *AsyncClient) WithOptions(opts gcore.Options) {
+	c.opts = opts
+}
+
+func (c *AsyncClient) ID() uint64 {
+	return c.id
+}
+
+func (c *AsyncClient) Init(opts ...gcore.Option) error {
+	for _, opt := range opts {
+		opt(&c.opts)
+	}
+	c.metrics = metric.NewClient(&c.opts)
+	c.stats = connstat.NewStats(&c.metrics.IO)
+	l, err := dial(&c.opts, c.stats)
+	if err != nil {
+		c.metrics.ConnectErrors.Add(1)
+		return err
+	}
+	c.metrics.Connects.Add(1)
+	c.link = l
+	c.opts.Handler = gcore.WrapHandler(c.opts.Handler, c.opts.Interceptors)
+	c.opts.Handler.OnOpened(c)
+	l.start(c.stats, func() { c.Close() })
+	go c.handleRecvLoop()
+	if len(c.opts.HeartData) > 0 && c.opts.HeartInterval > 0 {
+		go c.handleHeartbeatLoop()
+	}
+	return nil
+}
+
+func (c *AsyncClient) Read(buf []byte) (n int, err error) {
+	return 0, gcore.ErrConnInvalidCall
+}
+
+func (c *AsyncClient) ReadFull(buf []byte) (n int, err error) {
+	return 0, gcore.ErrConnInvalidCall
+}
+
+func (c *AsyncClient) WriteRead(req []byte) (body []byte, err error) {
+	return nil, gcore.ErrConnInvalidCall
+}
+
+// Write sends data as a msg, the send queue is full when twice the send window of segments
+// are unacknowledged. SendQueueDropOldest behaves like SendQueueDropNewest,
+// SendQueueBlock waits for WriteTimeout at most.
+func (c *AsyncClient) Write(data []byte) error {
+	return c.enqueue(context.Background(), data, true)
+}
+
+func (c *AsyncClient) TryWrite(data []byte) error {
+	return c.enqueue(context.Background(), data, false)
+}
+
+func (c *AsyncClient) WriteContext(ctx context.Context, data []byte) error {
+	return c.enqueue(ctx, data, true)
+}
+
+// enqueue passes data through the interceptors and sends it,
+// wait: whether SendQueueBlock waits for room
+func (c *AsyncClient) enqueue(ctx context.Context, data []byte, wait bool) error {
+	return gcore.InterceptWrite(c.opts.Interceptors, c, data, func(_ gcore.Conn, data []byte) error {
+		return c.send(ctx, data, wait)
+	})
+}
+
+func (c *AsyncClient) send(ctx context.Context, data []byte, wait bool) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if c.Closed() {
+		return gcore.ErrConnClosed
+	}
+	policy := c.opts.SendQueuePolicy
+	err := c.link.send(ctx, data, wait && policy == gcore.SendQueueBlock)
+	if err != gcore.ErrSendQueueFull {
+		return err
+	}
+	if h, ok := c.opts.Handler.(gcore.SendQueueFullHandler); ok {
+		h.OnSendQueueFull(c, data)
+	}
+	if policy == gcore.SendQueueClose {
+		c.opts.Logger.Infof("KCP client %s send queue full, closing", c.opts.Addr)
+		c.Close()
+	}
+	return err
+}
+
+// Close closes the socket, unacknowledged msgs are dropped, OnClosed is called before it returns
+func (c *AsyncClient) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	err := c.link.close()
+	c.opts.Handler.OnClosed(c)
+	return err
+}
+
+func (c *AsyncClient) Closed() bool {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return true
+	}
+	return false
+}
+
+func (c *AsyncClient) RemoteAddr() net.Addr {
+	return c.link.raddr
+}
+
+func (c *AsyncClient) LocalAddr() net.Addr {
+	return c.link.conn.LocalAddr()
+}
+
+// PeerCertificates KCP is not encrypted
+func (c *AsyncClient) PeerCertificates() []*x509.Certificate {
+	return nil
+}
+
+// Stats SendQueueLen is the number of segments unacknowledged, SendQueueBytes is zero
+func (c *AsyncClient) Stats() (st gcore.ConnStats) {
+	c.stats.Fill(&st)
+	st.SendQueueLen = c.link.sess.WaitSnd()
+	return
+}
+
+func (c *AsyncClient) SetTag(tag string) {
+	c.mu.Lock()
+	c.tag = tag
+	c.mu.Unlock()
+}
+
+func (c *AsyncClient) GetTag() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tag
+}
+
+func (c *AsyncClient) handleRecvLoop() {
+	for {
+		msg, err := c.link.recv(time.Time{})
+		if err != nil {
+			return
+		}
+		if err = c.handleMsg(msg); err != nil {
+			return
+		}
+	}
+}
+
+// handleMsg handles a msg received, returns an error if c is closed
+func (c *AsyncClient) handleMsg(msg []byte) error {
+	if len(c.opts.HeartData) > 0 && bytes.Equal(msg, c.opts.HeartData) {
+		return nil
+	}
+	c.stats.MsgRead()
+	if err := c.opts.Handler.OnReadMsg(c, msg); err != nil {
+		c.opts.Logger.Infof("KCP client OnReadMsg error:[%v]", err)
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+func (c *AsyncClient) handleHeartbeatLoop() {
+	ticker := time.NewTicker(c.opts.HeartInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.link.closeChan:
+			return
+		case <-c.opts.Ctx.Done():
+			c.Close()
+			return
+		case <-ticker.C:
+			if err := c.link.send(context.Background(), c.opts.HeartData, false); err != nil {
+				c.opts.Logger.Debugf("KCP client %s heartbeat error:[%v]", c.opts.Addr, err)
+				continue
+			}
+			c.stats.Heartbeat()
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/connstat"
+	"github.com/izhw/gnet/internal/util/delay"
+	"github.com/izhw/gnet/kcp/internal"
+)
+
+// link a KCP session to the server on an ephemeral port, shared by Client and AsyncClient
+type link struct {
+	opts      *gcore.Options
+	conn      net.PacketConn
+	raddr     *net.UDPAddr
+	sess      *internal.Session
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+// dial opens a session to opts.Addr on an ephemeral port, KCP has no handshake
+func dial(opts *gcore.Options, stats *connstat.Stats) (*link, error) {
+	raddr, err := net.ResolveUDPAddr("udp", opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	network := "udp6"
+	if raddr.IP == nil || raddr.IP.To4() != nil {
+		network = "udp4"
+	}
+	conn, err := internal.ListenPacket(network, ":0", opts)
+	if err != nil {
+		return nil, err
+	}
+	l := &link{
+		opts:      opts,
+		conn:      conn,
+		raddr:     raddr,
+		closeChan: make(chan struct{}),
+	}
+	l.sess = internal.NewSession(internal.NewConv(), conn, raddr, &opts.KCP, stats)
+	return l, nil
+}
+
+// start starts the read and update loops, onBroken is called when the link is broken
+// by a read error or a dead link
+func (l *link) start(stats *connstat.Stats, onBroken func()) {
+	go l.readLoop(stats, onBroken)
+	go l.updateLoop(onBroken)
+}
+
+// recv returns the next msg received in order, see internal.Session.Recv
+func (l *link) recv(t time.Time) ([]byte, error) {
+	return l.sess.Recv(t, l.closeChan)
+}
+
+// send sends msg, it waits for room in the send queue if wait
+func (l *link) send(ctx context.Context, msg []byte, wait bool) error {
+	select {
+	case <-l.closeChan:
+		return gcore.ErrConnClosed
+	default:
+	}
+	if wait && l.opts.WriteTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.opts.WriteTimeout)
+		defer cancel()
+	}
+	return l.sess.Send(ctx, msg, wait, l.closeChan)
+}
+
+// close closes the socket, unacknowledged msgs are dropped
+func (l *link) close() (err error) {
+	l.closeOnce.Do(func() {
+		close(l.closeChan)
+		err = l.conn.Close()
+	})
+	return
+}
+
+func (l *link) closed() bool {
+	select {
+	case <-l.closeChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// fromServer whether addr is the address of the server
+func (l *link) fromServer(addr net.Addr) bool {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return addr.String() == l.raddr.String()
+	}
+	return ua.Port == l.raddr.Port && ua.IP.Equal(l.raddr.IP)
+}
+
+func (l *link) readLoop(stats *connstat.Stats, onBroken func()) {
+	buf := make([]byte, internal.MaxPacketLen)
+	td := delay.NewTempDelay(5*time.Millisecond, time.Second)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if l.closed() {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				d := td.GetDelay()
+				l.opts.Logger.Warnf("KCP client %s read temporary error:[%v], delay:%v", l.opts.Addr, ne, d)
+				time.Sleep(d)
+				continue
+			}
+			l.opts.Logger.Errorf("KCP client %s read error:[%v]", l.opts.Addr, err)
+			onBroken()
+			return
+		}
+		td.Reset()
+		if !l.fromServer(addr) {
+			continue
+		}
+		stats.Read(n, 0)
+		if err := l.sess.Input(buf[:n]); err != nil {
+			l.opts.Logger.Debugf("KCP client %s packet dropped, error:[%v]", l.opts.Addr, err)
+		}
+	}
+}
+
+// updateLoop flushes the session every KCP.Interval
+func (l *link) updateLoop(onBroken func()) {
+	ticker := time.NewTicker(internal.Interval(&l.opts.KCP))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.closeChan:
+			return
+		case <-ticker.C:
+		}
+		if l.sess.Update() {
+			l.opts.Logger.Errorf("KCP client %s dead link", l.opts.Addr)
+			onBroken()
+			return
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package client
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/connstat"
+	"github.com/izhw/gnet/internal/metric"
+	"github.com/izhw/gnet/internal/registry"
+)
+
+var _ gcore.Conn = &Client{}
+
+// Client is a synchronous KCP client, msgs received stay in the receive window until read by
+// Read, ReadFull or WriteRead, which wait for ReadTimeout at most. Read and ReadFull read the msgs
+// as a stream of bytes, WriteRead returns the next whole msg. It is closed when the link is dead.
+type Client struct {
+	id      uint64
+	opts    gcore.Options
+	link    *link
+	metrics *metric.Client
+	stats   *connstat.Stats
+	closed  int32
+	pending []byte     // unread bytes of the msg being read by Read
+	mu      sync.Mutex // guards tag
+	tag     string
+}
+
+func NewClient() *Client {
+	return &Client{
+		id: registry.NextID(),
+	}
+}
+
+func (c *Client) WithOptions(opts gcore.Options) {
+	c.opts = opts
+}
+
+func (c *Client) ID() uint64 {
+	return c.id
+}
+
+func (c *Client) Init(opts ...gcore.Option) error {
+	for _, opt := range opts {
+		opt(&c.opts)
+	}
+	c.metrics = metric.NewClient(&c.opts)
+	c.stats = connstat.NewStats(&c.metrics.IO)
+	l, err := dial(&c.opts, c.stats)
+	if err != nil {
+		c.metrics.ConnectErrors.Add(1)
+		return err
+	}
+	c.metrics.Connects.Add(1)
+	c.link = l
+	l.start(c.stats, func() { c.Close() })
+	return nil
+}
+
+// next returns the next msg received, it waits for ReadTimeout at most
+func (c *Client) next() ([]byte, error) {
+	msg, err := c.link.recv(c.getReadDeadLine())
+	if err == gcore.ErrConnClosed {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.stats.MsgRead()
+	return msg, nil
+}
+
+// Read reads the bytes of the msgs received, a msg may be read by several calls
+func (c *Client) Read(buf []byte) (n int, err error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	if len(c.pending) == 0 {
+		if c.pending, err = c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(buf, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// ReadFull reads exactly len(buf) bytes of the msgs received, each read waits for ReadTimeout at most
+func (c *Client) ReadFull(buf []byte) (n int, err error) {
+	return io.ReadFull(c, buf)
+}
+
+// WriteRead sends data and returns the next whole msg received, bytes of a msg partially read by Read are dropped
+func (c *Client) WriteRead(data []byte) (body []byte, err error) {
+	if err = c.send(context.Background(), data); err != nil {
+		return nil, err
+	}
+	c.pending = nil
+	return c.next()
+}
+
+// Write sends data as a msg, data is passed through the interceptors.
+// It waits for room in the send queue for WriteTimeout at most.
+func (c *Client) Write(data []byte) error {
+	return gcore.InterceptWrite(c.opts.Interceptors, c, data, func(_ gcore.Conn, data []byte) error {
+		return c.send(context.Background(), data)
+	})
+}
+
+// TryWrite same as Write
+func (c *Client) TryWrite(data []byte) error {
+	return c.Write(data)
+}
+
+// WriteContext is like Write, it also returns when ctx is done
+func (c *Client) WriteContext(ctx context.Context, data []byte) error {
+	return gcore.InterceptWrite(c.opts.Interceptors, c, data, func(_ gcore.Conn, data []byte) error {
+		return c.send(ctx, data)
+	})
+}
+
+func (c *Client) send(ctx context.Context, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if c.Closed() {
+		return gcore.ErrConnClosed
+	}
+	return c.link.send(ctx, data, true)
+}
+
+// Close closes the socket, unacknowledged msgs are dropped
+func (c *Client) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	return c.link.close()
+}
+
+func (c *Client) Closed() bool {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return true
+	}
+	return false
+}
+
+func (c *Client) RemoteAddr() net.Addr {
+	return c.link.raddr
+}
+
+func (c *Client) LocalAddr() net.Addr {
+	return c.link.conn.LocalAddr()
+}
+
+// PeerCertificates KCP is not encrypted
+func (c *Client) PeerCertificates() []*x509.Certificate {
+	return nil
+}
+
+// Stats SendQueueLen is the number of segments unacknowledged, SendQueueBytes is zero
+func (c *Client) Stats() (st gcore.ConnStats) {
+	c.stats.Fill(&st)
+	st.SendQueueLen = c.link.sess.WaitSnd()
+	return
+}
+
+func (c *Client) SetTag(tag string) {
+	c.mu.Lock()
+	c.tag = tag
+	c.mu.Unlock()
+}
+
+func (c *Client) GetTag() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tag
+}
+
+func (c *Client) getReadDeadLine() (t time.Time) {
+	if c.opts.ReadTimeout > 0 {
+		t = time.Now().Add(c.opts.ReadTimeout)
+	}
+	return
+}
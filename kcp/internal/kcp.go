@@ -0,0 +1,681 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// KCP protocol constants, the same as ikcp
+const (
+	rtoNoDelay   = 30 // min RTO of nodelay mode
+	rtoMin       = 100
+	rtoDefault   = 200
+	rtoMax       = 60000
+	cmdPush      = 81 // data
+	cmdAck       = 82
+	cmdWask      = 83 // window probe, ask
+	cmdWins      = 84 // window size, tell
+	askSend      = 1
+	askTell      = 2
+	wndSnd       = 32
+	wndRcv       = 128
+	mtuDefault   = 1400
+	intervalDef  = 100
+	Overhead     = 24 // header length of a segment
+	deadLinkDef  = 20
+	threshInit   = 2
+	threshMin    = 2
+	probeInit    = 7000
+	probeLimit   = 120000
+	fastackLimit = 5
+)
+
+var (
+	ErrConvMismatch   = errors.New("kcp: conv mismatch")
+	ErrInvalidSegment = errors.New("kcp: invalid segment")
+	ErrTooManyFrags   = errors.New("kcp: msg too large for the window")
+)
+
+type segment struct {
+	conv     uint32
+	cmd      uint8
+	frg      uint8
+	wnd      uint16
+	ts       uint32
+	sn       uint32
+	una      uint32
+	rto      uint32
+	xmit     uint32
+	resendts uint32
+	fastack  uint32
+	data     []byte
+}
+
+// encode appends the header of seg to b
+func (seg *segment) encode(b []byte) []byte {
+	var h [Overhead]byte
+	binary.LittleEndian.PutUint32(h[0:], seg.conv)
+	h[4] = seg.cmd
+	h[5] = seg.frg
+	binary.LittleEndian.PutUint16(h[6:], seg.wnd)
+	binary.LittleEndian.PutUint32(h[8:], seg.ts)
+	binary.LittleEndian.PutUint32(h[12:], seg.sn)
+	binary.LittleEndian.PutUint32(h[16:], seg.una)
+	binary.LittleEndian.PutUint32(h[20:], uint32(len(seg.data)))
+	return append(b, h[:]...)
+}
+
+type ackItem struct {
+	sn uint32
+	ts uint32
+}
+
+// Conv returns the conv of the first segment of packet, ok is false if it is not a valid segment
+func Conv(packet []byte) (conv uint32, ok bool) {
+	if len(packet) < Overhead {
+		return 0, false
+	}
+	cmd := packet[4]
+	if cmd < cmdPush || cmd > cmdWins {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(packet), true
+}
+
+func timediff(later, earlier uint32) int32 {
+	return int32(later - earlier)
+}
+
+// KCP the ARQ state machine of a session, a port of ikcp in message mode.
+// Segments are retransmitted selectively on RTO, or after Resend ACKs skipping them,
+// the number of segments in flight is bounded by the congestion window unless nocwnd.
+// It is not safe for concurrent use.
+type KCP struct {
+	conv, mtu, mss, state             uint32
+	sndUna, sndNxt, rcvNxt            uint32
+	ssthresh                          uint32
+	rxRttval, rxSrtt, rxRto, rxMinRto int32
+	sndWnd, rcvWnd, rmtWnd, cwnd      uint32
+	probe                             uint32
+	interval                          uint32
+	nodelay                           bool
+	tsProbe, probeWait                uint32
+	deadLink, incr                    uint32
+	fastresend                        int32
+	fastlimit                         int32
+	nocwnd                            bool
+	current                           uint32
+
+	sndQueue []segment
+	rcvQueue []segment
+	sndBuf   []segment
+	rcvBuf   []segment
+	acklist  []ackItem
+	buffer   []byte
+	output   func(packet []byte)
+}
+
+// NewKCP output is called with each packet to send, the packet is reused after it returns
+func NewKCP(conv uint32, output func(packet []byte)) *KCP {
+	k := &KCP{
+		conv:      conv,
+		sndWnd:    wndSnd,
+		rcvWnd:    wndRcv,
+		rmtWnd:    wndRcv,
+		mtu:       mtuDefault,
+		mss:       mtuDefault - Overhead,
+		rxRto:     rtoDefault,
+		rxMinRto:  rtoMin,
+		interval:  intervalDef,
+		ssthresh:  threshInit,
+		deadLink:  deadLinkDef,
+		fastlimit: fastackLimit,
+		output:    output,
+	}
+	k.cwnd, k.incr = 1, k.mss
+	k.buffer = make([]byte, 0, k.mtu)
+	return k
+}
+
+// SetMTU mtu: max size of a packet
+func (k *KCP) SetMTU(mtu int) bool {
+	if mtu < 50 {
+		return false
+	}
+	k.mtu = uint32(mtu)
+	k.mss = k.mtu - Overhead
+	k.incr = k.cwnd * k.mss
+	k.buffer = make([]byte, 0, mtu)
+	return true
+}
+
+// NoDelay sets the nodelay mode, interval in ms,
+// resend: fast resend after the number of ACKs skipping a segment, 0 disables,
+// nc: disables the congestion window
+func (k *KCP) NoDelay(nodelay bool, interval, resend int, nc bool) {
+	k.nodelay = nodelay
+	if nodelay {
+		k.rxMinRto = rtoNoDelay
+	} else {
+		k.rxMinRto = rtoMin
+	}
+	if interval > 0 {
+		if interval > 5000 {
+			interval = 5000
+		} else if interval < 10 {
+			interval = 10
+		}
+		k.interval = uint32(interval)
+	}
+	if resend >= 0 {
+		k.fastresend = int32(resend)
+	}
+	k.nocwnd = nc
+}
+
+// WndSize sets the send and receive windows in segments, 0 keeps the current one
+func (k *KCP) WndSize(snd, rcv int) {
+	if snd > 0 {
+		k.sndWnd = uint32(snd)
+	}
+	if rcv > 0 {
+		if rcv < wndRcv {
+			rcv = wndRcv
+		}
+		k.rcvWnd = uint32(rcv)
+	}
+}
+
+// SetDeadLink a session is dead after a segment is sent n times without ACK
+func (k *KCP) SetDeadLink(n int) {
+	if n > 0 {
+		k.deadLink = uint32(n)
+	}
+}
+
+// Dead whether a segment is sent deadLink times without ACK
+func (k *KCP) Dead() bool {
+	return k.state != 0
+}
+
+// WaitSnd number of segments queued or in flight
+func (k *KCP) WaitSnd() int {
+	return len(k.sndBuf) + len(k.sndQueue)
+}
+
+// SndWnd the send window in segments
+func (k *KCP) SndWnd() int {
+	return int(k.sndWnd)
+}
+
+// peekSize returns the size of the next complete msg, -1 if none
+func (k *KCP) peekSize() int {
+	if len(k.rcvQueue) == 0 {
+		return -1
+	}
+	seg := &k.rcvQueue[0]
+	if seg.frg == 0 {
+		return len(seg.data)
+	}
+	if len(k.rcvQueue) < int(seg.frg)+1 {
+		return -1
+	}
+	n := 0
+	for i := range k.rcvQueue {
+		n += len(k.rcvQueue[i].data)
+		if k.rcvQueue[i].frg == 0 {
+			break
+		}
+	}
+	return n
+}
+
+// Recv returns the next complete msg, nil if none
+func (k *KCP) Recv() []byte {
+	size := k.peekSize()
+	if size < 0 {
+		return nil
+	}
+	recover := len(k.rcvQueue) >= int(k.rcvWnd)
+	msg := make([]byte, 0, size)
+	count := 0
+	for i := range k.rcvQueue {
+		seg := &k.rcvQueue[i]
+		msg = append(msg, seg.data...)
+		count++
+		if seg.frg == 0 {
+			break
+		}
+	}
+	k.rcvQueue = removeFront(k.rcvQueue, count)
+	k.moveRcvBuf()
+	// tells the peer the window is open again
+	if recover && len(k.rcvQueue) < int(k.rcvWnd) {
+		k.probe |= askTell
+	}
+	return msg
+}
+
+// moveRcvBuf moves the in-order segments of rcvBuf to rcvQueue
+func (k *KCP) moveRcvBuf() {
+	count := 0
+	for i := range k.rcvBuf {
+		if k.rcvBuf[i].sn != k.rcvNxt || len(k.rcvQueue)+count >= int(k.rcvWnd) {
+			break
+		}
+		k.rcvNxt++
+		count++
+	}
+	if count > 0 {
+		k.rcvQueue = append(k.rcvQueue, k.rcvBuf[:count]...)
+		k.rcvBuf = removeFront(k.rcvBuf, count)
+	}
+}
+
+// Send splits msg into segments and queues them, msg is copied
+func (k *KCP) Send(msg []byte) error {
+	count := (len(msg) + int(k.mss) - 1) / int(k.mss)
+	if count == 0 {
+		count = 1
+	}
+	if count > 255 || count >= int(k.rcvWnd) {
+		return ErrTooManyFrags
+	}
+	for i := 0; i < count; i++ {
+		size := len(msg)
+		if size > int(k.mss) {
+			size = int(k.mss)
+		}
+		data := make([]byte, size)
+		copy(data, msg[:size])
+		k.sndQueue = append(k.sndQueue, segment{data: data, frg: uint8(count - i - 1)})
+		msg = msg[size:]
+	}
+	return nil
+}
+
+func (k *KCP) updateAck(rtt int32) {
+	if k.rxSrtt == 0 {
+		k.rxSrtt = rtt
+		k.rxRttval = rtt / 2
+	} else {
+		delta := rtt - k.rxSrtt
+		if delta < 0 {
+			delta = -delta
+		}
+		k.rxRttval = (3*k.rxRttval + delta) / 4
+		k.rxSrtt = (7*k.rxSrtt + rtt) / 8
+		if k.rxSrtt < 1 {
+			k.rxSrtt = 1
+		}
+	}
+	v := 4 * k.rxRttval
+	if v < int32(k.interval) {
+		v = int32(k.interval)
+	}
+	rto := k.rxSrtt + v
+	if rto < k.rxMinRto {
+		rto = k.rxMinRto
+	} else if rto > rtoMax {
+		rto = rtoMax
+	}
+	k.rxRto = rto
+}
+
+func (k *KCP) shrinkBuf() {
+	if len(k.sndBuf) > 0 {
+		k.sndUna = k.sndBuf[0].sn
+	} else {
+		k.sndUna = k.sndNxt
+	}
+}
+
+func (k *KCP) parseAck(sn uint32) {
+	if timediff(sn, k.sndUna) < 0 || timediff(sn, k.sndNxt) >= 0 {
+		return
+	}
+	for i := range k.sndBuf {
+		if k.sndBuf[i].sn == sn {
+			k.sndBuf = append(k.sndBuf[:i], k.sndBuf[i+1:]...)
+			return
+		}
+		if timediff(sn, k.sndBuf[i].sn) < 0 {
+			return
+		}
+	}
+}
+
+func (k *KCP) parseUna(una uint32) {
+	count := 0
+	for i := range k.sndBuf {
+		if timediff(una, k.sndBuf[i].sn) <= 0 {
+			break
+		}
+		count++
+	}
+	if count > 0 {
+		k.sndBuf = removeFront(k.sndBuf, count)
+	}
+}
+
+// parseFastack counts the ACKs skipping the segments before sn
+func (k *KCP) parseFastack(sn, ts uint32) {
+	if timediff(sn, k.sndUna) < 0 || timediff(sn, k.sndNxt) >= 0 {
+		return
+	}
+	for i := range k.sndBuf {
+		seg := &k.sndBuf[i]
+		if timediff(sn, seg.sn) < 0 {
+			break
+		}
+		if sn != seg.sn && timediff(ts, seg.ts) >= 0 {
+			seg.fastack++
+		}
+	}
+}
+
+// parseData inserts seg into rcvBuf in order, duplicates are dropped
+func (k *KCP) parseData(seg segment) {
+	sn := seg.sn
+	if timediff(sn, k.rcvNxt+k.rcvWnd) >= 0 || timediff(sn, k.rcvNxt) < 0 {
+		return
+	}
+	i := len(k.rcvBuf)
+	for ; i > 0; i-- {
+		prev := k.rcvBuf[i-1].sn
+		if prev == sn {
+			return
+		}
+		if timediff(sn, prev) > 0 {
+			break
+		}
+	}
+	k.rcvBuf = append(k.rcvBuf, segment{})
+	copy(k.rcvBuf[i+1:], k.rcvBuf[i:])
+	k.rcvBuf[i] = seg
+	k.moveRcvBuf()
+}
+
+// Input handles a packet received, current: time in ms
+func (k *KCP) Input(data []byte, current uint32) error {
+	k.current = current
+	prevUna := k.sndUna
+	var maxack, latest uint32
+	flag := false
+	if len(data) < Overhead {
+		return ErrInvalidSegment
+	}
+	for len(data) >= Overhead {
+		conv := binary.LittleEndian.Uint32(data)
+		if conv != k.conv {
+			return ErrConvMismatch
+		}
+		cmd := data[4]
+		frg := data[5]
+		wnd := binary.LittleEndian.Uint16(data[6:])
+		ts := binary.LittleEndian.Uint32(data[8:])
+		sn := binary.LittleEndian.Uint32(data[12:])
+		una := binary.LittleEndian.Uint32(data[16:])
+		length := binary.LittleEndian.Uint32(data[20:])
+		data = data[Overhead:]
+		if uint32(len(data)) < length || cmd < cmdPush || cmd > cmdWins {
+			return ErrInvalidSegment
+		}
+		k.rmtWnd = uint32(wnd)
+		k.parseUna(una)
+		k.shrinkBuf()
+		switch cmd {
+		case cmdAck:
+			if rtt := timediff(current, ts); rtt >= 0 {
+				k.updateAck(rtt)
+			}
+			k.parseAck(sn)
+			k.shrinkBuf()
+			if !flag {
+				flag = true
+				maxack, latest = sn, ts
+			} else if timediff(sn, maxack) > 0 && timediff(ts, latest) > 0 {
+				maxack, latest = sn, ts
+			}
+		case cmdPush:
+			if timediff(sn, k.rcvNxt+k.rcvWnd) < 0 {
+				k.acklist = append(k.acklist, ackItem{sn: sn, ts: ts})
+				if timediff(sn, k.rcvNxt) >= 0 {
+					payload := make([]byte, length)
+					copy(payload, data[:length])
+					k.parseData(segment{conv: conv, cmd: cmd, frg: frg, wnd: wnd, ts: ts, sn: sn, una: una, data: payload})
+				}
+			}
+		case cmdWask:
+			k.probe |= askTell
+		case cmdWins:
+		}
+		data = data[length:]
+	}
+	if flag {
+		k.parseFastack(maxack, latest)
+	}
+	// congestion window grows with new ACKs, slow start below ssthresh
+	if timediff(k.sndUna, prevUna) > 0 && k.cwnd < k.rmtWnd {
+		mss := k.mss
+		if k.cwnd < k.ssthresh {
+			k.cwnd++
+			k.incr += mss
+		} else {
+			if k.incr < mss {
+				k.incr = mss
+			}
+			k.incr += (mss*mss)/k.incr + mss/16
+			if (k.cwnd+1)*mss <= k.incr {
+				k.cwnd = (k.incr + mss - 1) / mss
+			}
+		}
+		if k.cwnd > k.rmtWnd {
+			k.cwnd = k.rmtWnd
+			k.incr = k.rmtWnd * mss
+		}
+	}
+	return nil
+}
+
+func (k *KCP) wndUnused() uint16 {
+	if len(k.rcvQueue) < int(k.rcvWnd) {
+		return uint16(int(k.rcvWnd) - len(k.rcvQueue))
+	}
+	return 0
+}
+
+// FlushAcks sends the pending ACKs immediately
+func (k *KCP) FlushAcks() {
+	k.flush(true)
+}
+
+// Flush sends pending ACKs, window probes, new segments allowed by the windows,
+// and retransmits segments on RTO or fast resend, current: time in ms
+func (k *KCP) Flush(current uint32) {
+	k.current = current
+	k.flush(false)
+}
+
+func (k *KCP) flush(ackOnly bool) {
+	current := k.current
+	seg := segment{conv: k.conv, cmd: cmdAck, wnd: k.wndUnused(), una: k.rcvNxt}
+	buf := k.buffer[:0]
+	makeSpace := func(space int) {
+		if len(buf)+space > int(k.mtu) {
+			k.output(buf)
+			buf = buf[:0]
+		}
+	}
+
+	for _, ack := range k.acklist {
+		makeSpace(Overhead)
+		seg.sn, seg.ts = ack.sn, ack.ts
+		buf = seg.encode(buf)
+	}
+	k.acklist = k.acklist[:0]
+	if ackOnly {
+		if len(buf) > 0 {
+			k.output(buf)
+		}
+		return
+	}
+
+	// probes the window of the peer when it is full
+	if k.rmtWnd == 0 {
+		if k.probeWait == 0 {
+			k.probeWait = probeInit
+			k.tsProbe = current + k.probeWait
+		} else if timediff(current, k.tsProbe) >= 0 {
+			if k.probeWait < probeInit {
+				k.probeWait = probeInit
+			}
+			k.probeWait += k.probeWait / 2
+			if k.probeWait > probeLimit {
+				k.probeWait = probeLimit
+			}
+			k.tsProbe = current + k.probeWait
+			k.probe |= askSend
+		}
+	} else {
+		k.tsProbe = 0
+		k.probeWait = 0
+	}
+	if k.probe&askSend != 0 {
+		seg.cmd = cmdWask
+		makeSpace(Overhead)
+		buf = seg.encode(buf)
+	}
+	if k.probe&askTell != 0 {
+		seg.cmd = cmdWins
+		makeSpace(Overhead)
+		buf = seg.encode(buf)
+	}
+	k.probe = 0
+
+	cwnd := k.sndWnd
+	if k.rmtWnd < cwnd {
+		cwnd = k.rmtWnd
+	}
+	if !k.nocwnd && k.cwnd < cwnd {
+		cwnd = k.cwnd
+	}
+	count := 0
+	for _, s := range k.sndQueue {
+		if timediff(k.sndNxt, k.sndUna+cwnd) >= 0 {
+			break
+		}
+		s.conv = k.conv
+		s.cmd = cmdPush
+		s.ts = current
+		s.sn = k.sndNxt
+		k.sndNxt++
+		s.rto = uint32(k.rxRto)
+		k.sndBuf = append(k.sndBuf, s)
+		count++
+	}
+	if count > 0 {
+		k.sndQueue = removeFront(k.sndQueue, count)
+	}
+
+	resent := uint32(k.fastresend)
+	if k.fastresend <= 0 {
+		resent = 0xffffffff
+	}
+	var rtomin uint32
+	if !k.nodelay {
+		rtomin = uint32(k.rxRto) >> 3
+	}
+	change, lost := false, false
+	for i := range k.sndBuf {
+		s := &k.sndBuf[i]
+		needsend := false
+		if s.xmit == 0 {
+			needsend = true
+			s.rto = uint32(k.rxRto)
+			s.resendts = current + s.rto + rtomin
+		} else if timediff(current, s.resendts) >= 0 {
+			// RTO
+			needsend = true
+			if k.nodelay {
+				s.rto += uint32(k.rxRto) / 2
+			} else {
+				s.rto += s.rto
+			}
+			s.resendts = current + s.rto
+			lost = true
+		} else if s.fastack >= resent && (s.xmit <= uint32(k.fastlimit) || k.fastlimit <= 0) {
+			needsend = true
+			s.fastack = 0
+			s.resendts = current + s.rto
+			change = true
+		}
+		if needsend {
+			s.xmit++
+			s.ts = current
+			s.wnd = seg.wnd
+			s.una = k.rcvNxt
+			makeSpace(Overhead + len(s.data))
+			buf = s.encode(buf)
+			buf = append(buf, s.data...)
+			if s.xmit >= k.deadLink {
+				k.state = 0xffffffff
+			}
+		}
+	}
+	if len(buf) > 0 {
+		k.output(buf)
+	}
+	k.buffer = buf[:0]
+
+	if change {
+		inflight := k.sndNxt - k.sndUna
+		k.ssthresh = inflight / 2
+		if k.ssthresh < threshMin {
+			k.ssthresh = threshMin
+		}
+		k.cwnd = k.ssthresh + resent
+		k.incr = k.cwnd * k.mss
+	}
+	if lost {
+		k.ssthresh = cwnd / 2
+		if k.ssthresh < threshMin {
+			k.ssthresh = threshMin
+		}
+		k.cwnd = 1
+		k.incr = k.mss
+	}
+	if k.cwnd < 1 {
+		k.cwnd = 1
+		k.incr = k.mss
+	}
+}
+
+// removeFront removes the first n segments, the backing array is reused
+func removeFront(q []segment, n int) []segment {
+	m := copy(q, q[n:])
+	for i := m; i < len(q); i++ {
+		q[i] = segment{}
+	}
+	return q[:m]
+}
@@ -0,0 +1,249 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/connstat"
+)
+
+// MaxPacketLen length of the read buffer of packets
+const MaxPacketLen = 65535
+
+var epoch = time.Now()
+
+// now time in ms for KCP
+func now() uint32 {
+	return uint32(time.Since(epoch) / time.Millisecond)
+}
+
+// NewConv returns a random conv identifying a session
+func NewConv() uint32 {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return uint32(time.Now().UnixNano())
+	}
+	return binary.LittleEndian.Uint32(b[:])
+}
+
+// Interval the flush interval of ko, sessions should be updated at the interval
+func Interval(ko *gcore.KCPOptions) time.Duration {
+	d := ko.Interval
+	if d <= 0 {
+		return intervalDef * time.Millisecond
+	}
+	if d < 10*time.Millisecond {
+		d = 10 * time.Millisecond
+	} else if d > 5*time.Second {
+		d = 5 * time.Second
+	}
+	return d
+}
+
+// Session a KCP session with the peer addr over conn, it is safe for concurrent use.
+// Packets are fed by Input in the read loop, msgs are taken by Recv in another goroutine,
+// so ACKs are processed while the receiver is blocked, e.g. by Send. Msgs not taken stay in
+// the receive window, the peer stops sending when it is full.
+// Send blocks while twice the send window of segments are queued or in flight.
+type Session struct {
+	mu        sync.Mutex // guards kcp
+	kcp       *KCP
+	conn      net.PacketConn
+	addr      net.Addr
+	stats     *connstat.Stats
+	readable  chan struct{}
+	writable  chan struct{}
+	sendLimit int
+	ackNow    bool // ACKs are sent on input instead of the next flush, in nodelay mode
+}
+
+func NewSession(conv uint32, conn net.PacketConn, addr net.Addr, ko *gcore.KCPOptions, stats *connstat.Stats) *Session {
+	s := &Session{
+		conn:     conn,
+		addr:     addr,
+		stats:    stats,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+		ackNow:   ko.NoDelay,
+	}
+	k := NewKCP(conv, s.output)
+	k.NoDelay(ko.NoDelay, int(Interval(ko)/time.Millisecond), ko.Resend, ko.NoCongestion)
+	k.WndSize(ko.SendWindow, ko.RecvWindow)
+	if ko.MTU > 0 {
+		k.SetMTU(ko.MTU)
+	}
+	k.SetDeadLink(ko.DeadLink)
+	s.kcp = k
+	s.sendLimit = 2 * k.SndWnd()
+	return s
+}
+
+// output called with s.mu held
+func (s *Session) output(packet []byte) {
+	n, err := s.conn.WriteTo(packet, s.addr)
+	if err != nil {
+		s.stats.WriteFailed()
+		return
+	}
+	s.stats.Written(0, n)
+}
+
+// Input handles a packet from the peer, queued segments are sent if ACKs open the window
+func (s *Session) Input(packet []byte) error {
+	s.mu.Lock()
+	una := s.kcp.sndUna
+	err := s.kcp.Input(packet, now())
+	if s.kcp.sndUna != una && len(s.kcp.sndQueue) > 0 {
+		s.kcp.Flush(now())
+	} else if s.ackNow {
+		s.kcp.FlushAcks()
+	}
+	readable := s.kcp.peekSize() >= 0
+	writable := s.kcp.WaitSnd() < s.sendLimit
+	s.mu.Unlock()
+	if readable {
+		notify(s.readable)
+	}
+	if writable {
+		notify(s.writable)
+	}
+	return err
+}
+
+// Recv returns the next msg received in order, it waits until the deadline t if none,
+// zero t means no limit. It returns gcore.ErrConnReadTimeout on the deadline,
+// gcore.ErrConnClosed when done is closed. It must not be called concurrently.
+func (s *Session) Recv(t time.Time, done <-chan struct{}) ([]byte, error) {
+	var timeout <-chan time.Time
+	if !t.IsZero() {
+		timer := time.NewTimer(time.Until(t))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		s.mu.Lock()
+		msg := s.kcp.Recv()
+		s.mu.Unlock()
+		if msg != nil {
+			return msg, nil
+		}
+		select {
+		case <-s.readable:
+		case <-done:
+			return nil, gcore.ErrConnClosed
+		case <-timeout:
+			return nil, gcore.ErrConnReadTimeout
+		}
+	}
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// Send queues msg and flushes it, segments are sent as the windows allow.
+// If the send queue is full, it returns gcore.ErrSendQueueFull unless wait,
+// then it waits for room, ctx or done.
+func (s *Session) Send(ctx context.Context, msg []byte, wait bool, done <-chan struct{}) error {
+	for {
+		s.mu.Lock()
+		if s.kcp.WaitSnd() < s.sendLimit {
+			err := s.kcp.Send(msg)
+			if err == nil {
+				s.kcp.Flush(now())
+			}
+			s.mu.Unlock()
+			if err == ErrTooManyFrags {
+				return gcore.ErrTooLarge
+			}
+			if err == nil {
+				s.stats.Written(1, 0)
+			}
+			return err
+		}
+		s.mu.Unlock()
+		if !wait {
+			return gcore.ErrSendQueueFull
+		}
+		select {
+		case <-s.writable:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+			return gcore.ErrConnClosed
+		}
+	}
+}
+
+// Update flushes the session, called every Interval. It returns whether the link is dead.
+func (s *Session) Update() (dead bool) {
+	s.mu.Lock()
+	s.kcp.Flush(now())
+	dead = s.kcp.Dead()
+	writable := s.kcp.WaitSnd() < s.sendLimit
+	s.mu.Unlock()
+	if writable {
+		notify(s.writable)
+	}
+	return dead
+}
+
+// WaitSnd number of segments queued or in flight
+func (s *Session) WaitSnd() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kcp.WaitSnd()
+}
+
+// ListenPacket listens on addr, network: udp, udp4 or udp6,
+// the conn is wrapped by KCP.WrapConn of opts if set
+func ListenPacket(network, addr string, opts *gcore.Options) (net.PacketConn, error) {
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	uc := conn.(*net.UDPConn)
+	so := &opts.Socket
+	if so.ReadBufferSize > 0 {
+		err = uc.SetReadBuffer(so.ReadBufferSize)
+	}
+	if err == nil && so.WriteBufferSize > 0 {
+		err = uc.SetWriteBuffer(so.WriteBufferSize)
+	}
+	if err != nil {
+		uc.Close()
+		return nil, err
+	}
+	if opts.KCP.WrapConn != nil {
+		return opts.KCP.WrapConn(uc), nil
+	}
+	return uc, nil
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package netsim simulates a lossy, high-latency network over a net.PacketConn,
+// for testing the KCP services over loopback
+package netsim
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Config of the simulated network, applied to the packets written, the zero value is a perfect network
+type Config struct {
+	// Loss probability of a packet being dropped, 0-1
+	Loss float64
+	// Delay latency added to each packet
+	Delay time.Duration
+	// Jitter a random latency in [0, Jitter) added to each packet, packets may be reordered
+	Jitter time.Duration
+	// Duplicate probability of a packet being sent twice, 0-1
+	Duplicate float64
+	// Seed of the random source, 0 means the current time
+	Seed int64
+}
+
+// Conn a net.PacketConn simulating the network of Config on writing
+type Conn struct {
+	net.PacketConn
+	cfg Config
+	mu  sync.Mutex // guards rnd
+	rnd *rand.Rand
+}
+
+var _ net.PacketConn = &Conn{}
+
+func New(conn net.PacketConn, cfg Config) *Conn {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Conn{
+		PacketConn: conn,
+		cfg:        cfg,
+		rnd:        rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Wrap returns a wrapper for gcore.KCPOptions.WrapConn, each conn gets its own random source
+func Wrap(cfg Config) func(net.PacketConn) net.PacketConn {
+	var mu sync.Mutex
+	n := int64(0)
+	return func(conn net.PacketConn) net.PacketConn {
+		c := cfg
+		if c.Seed != 0 {
+			mu.Lock()
+			c.Seed += n
+			n++
+			mu.Unlock()
+		}
+		return New(conn, c)
+	}
+}
+
+// WriteTo drops, delays or duplicates p as configured, it reports success for dropped packets.
+// Delayed packets are written later on another goroutine, errors of them are ignored.
+func (c *Conn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	drop := c.cfg.Loss > 0 && c.rnd.Float64() < c.cfg.Loss
+	copies := 1
+	if c.cfg.Duplicate > 0 && c.rnd.Float64() < c.cfg.Duplicate {
+		copies = 2
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = c.cfg.Delay
+		if c.cfg.Jitter > 0 {
+			delays[i] += time.Duration(c.rnd.Int63n(int64(c.cfg.Jitter)))
+		}
+	}
+	c.mu.Unlock()
+	if drop {
+		return len(p), nil
+	}
+	for _, d := range delays {
+		if d <= 0 {
+			if _, err := c.PacketConn.WriteTo(p, addr); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		b := make([]byte, len(p))
+		copy(b, p)
+		time.AfterFunc(d, func() {
+			_, _ = c.PacketConn.WriteTo(b, addr)
+		})
+	}
+	return len(p), nil
+}
@@ -0,0 +1,269 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/connstat"
+	"github.com/izhw/gnet/internal/registry"
+	"github.com/izhw/gnet/kcp/internal"
+)
+
+var _ gcore.Conn = &Conn{}
+
+// Conn a KCP session of a remote address of Server
+type Conn struct {
+	id         uint64
+	s          *Server
+	addr       net.Addr
+	key        string // addr.String(), key of the conn in the server
+	conv       uint32
+	sess       *internal.Session
+	stats      *connstat.Stats
+	heart      *connstat.HeartWatch
+	closeChan  chan struct{}
+	closed     int32
+	mu         sync.Mutex // guards tag and registered
+	tag        string
+	registered bool // c is in the registry of the server
+}
+
+func newConn(s *Server, addr net.Addr, key string, conv uint32) *Conn {
+	c := &Conn{
+		id:        registry.NextID(),
+		s:         s,
+		addr:      addr,
+		key:       key,
+		conv:      conv,
+		closeChan: make(chan struct{}),
+	}
+	c.stats = connstat.NewStats(&s.metrics.IO)
+	c.sess = internal.NewSession(conv, s.conn, addr, &s.opts.KCP, c.stats)
+	c.heart = s.heart.Watch(c.stats, c.onIdle, c.ping)
+	return c
+}
+
+func (c *Conn) ID() uint64 {
+	return c.id
+}
+
+func (c *Conn) Init(opts ...gcore.Option) error {
+	return nil
+}
+
+func (c *Conn) Read(buf []byte) (n int, err error) {
+	return 0, gcore.ErrConnInvalidCall
+}
+
+func (c *Conn) ReadFull(buf []byte) (n int, err error) {
+	return 0, gcore.ErrConnInvalidCall
+}
+
+func (c *Conn) WriteRead(req []byte) (body []byte, err error) {
+	return nil, gcore.ErrConnInvalidCall
+}
+
+// Write sends data as a msg, the send queue is full when twice the send window of segments
+// are unacknowledged. SendQueueDropOldest behaves like SendQueueDropNewest.
+func (c *Conn) Write(data []byte) error {
+	return c.enqueue(context.Background(), data, true)
+}
+
+func (c *Conn) TryWrite(data []byte) error {
+	return c.enqueue(context.Background(), data, false)
+}
+
+func (c *Conn) WriteContext(ctx context.Context, data []byte) error {
+	return c.enqueue(ctx, data, true)
+}
+
+// enqueue passes data through the interceptors and sends it,
+// wait: whether SendQueueBlock waits for room
+func (c *Conn) enqueue(ctx context.Context, data []byte, wait bool) error {
+	if is := c.s.opts.Interceptors; len(is) > 0 {
+		return gcore.InterceptWrite(is, c, data, func(_ gcore.Conn, data []byte) error {
+			return c.push(ctx, data, c.s.opts.SendQueuePolicy, wait)
+		})
+	}
+	return c.push(ctx, data, c.s.opts.SendQueuePolicy, wait)
+}
+
+// push sends msg with policy
+func (c *Conn) push(ctx context.Context, msg []byte, policy gcore.SendQueuePolicy, wait bool) error {
+	if len(msg) == 0 {
+		return nil
+	}
+	if c.Closed() {
+		return gcore.ErrConnClosed
+	}
+	err := c.sess.Send(ctx, msg, wait && policy == gcore.SendQueueBlock, c.closeChan)
+	if err != gcore.ErrSendQueueFull {
+		return err
+	}
+	c.s.metrics.SendQueueFull.Add(1)
+	if h, ok := c.s.opts.Handler.(gcore.SendQueueFullHandler); ok {
+		h.OnSendQueueFull(c, msg)
+	}
+	if policy == gcore.SendQueueClose {
+		c.s.opts.Logger.Infof("KCP conn:%d %s send queue full, closing", c.id, c.addr)
+		c.Close()
+	}
+	return err
+}
+
+// Close removes c from the server, unacknowledged msgs are dropped. The peer is not notified,
+// packets of the same session arriving after open a new conn, which delivers nothing.
+func (c *Conn) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	close(c.closeChan)
+	c.heart.Stop()
+	c.unregister()
+	c.s.onConnClose(c)
+	c.s.opts.Handler.OnClosed(c)
+	return nil
+}
+
+func (c *Conn) Closed() bool {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return true
+	}
+	return false
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// LocalAddr returns the address of the server socket
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.conn.LocalAddr()
+}
+
+// PeerCertificates KCP is not encrypted
+func (c *Conn) PeerCertificates() []*x509.Certificate {
+	return nil
+}
+
+// Stats SendQueueLen is the number of segments unacknowledged, SendQueueBytes is zero
+func (c *Conn) Stats() (st gcore.ConnStats) {
+	c.stats.Fill(&st)
+	st.SendQueueLen = c.sess.WaitSnd()
+	return
+}
+
+func (c *Conn) SetTag(tag string) {
+	c.mu.Lock()
+	if c.registered {
+		c.s.conns.Retag(c, c.tag, tag)
+	}
+	c.tag = tag
+	c.mu.Unlock()
+}
+
+func (c *Conn) GetTag() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tag
+}
+
+func (c *Conn) register() {
+	c.mu.Lock()
+	c.s.conns.Add(c, c.tag)
+	c.registered = true
+	c.mu.Unlock()
+}
+
+func (c *Conn) unregister() {
+	c.mu.Lock()
+	c.s.conns.Remove(c, c.tag)
+	c.registered = false
+	c.mu.Unlock()
+}
+
+// onIdle called by the heart keeper when c has received nothing for the idle timeout
+func (c *Conn) onIdle() {
+	go func() {
+		c.s.opts.Logger.Debugf("KCP conn:%d %s idle timeout, closing", c.id, c.addr)
+		if h, ok := c.s.opts.Handler.(gcore.IdleTimeoutHandler); ok {
+			h.OnIdleTimeout(c)
+		}
+		c.Close()
+	}()
+}
+
+// ping called by the heart keeper when c is silent for HeartPingInterval
+func (c *Conn) ping() {
+	_ = c.TryWrite(c.s.opts.HeartData)
+}
+
+// handleRecvLoop handles the msgs received by c in order until c is closed
+func (c *Conn) handleRecvLoop() {
+	defer c.s.lwg.Done()
+	for {
+		msg, err := c.sess.Recv(time.Time{}, c.closeChan)
+		if err != nil {
+			return
+		}
+		if err = c.handleMsg(msg); err != nil {
+			return
+		}
+	}
+}
+
+// handleMsg handles a msg received by c, returns an error if c is closed
+func (c *Conn) handleMsg(msg []byte) error {
+	s := c.s
+	if s.heartLen > 0 && uint32(len(msg)) == s.heartLen && s.isHeartBeat(msg) {
+		c.stats.Heartbeat()
+		if s.opts.HeartPingInterval <= 0 {
+			_ = c.TryWrite(msg)
+		}
+		return nil
+	}
+	if atomic.LoadInt32(&s.draining) == 1 {
+		return nil
+	}
+	c.stats.MsgRead()
+	if s.workers != nil {
+		s.hwg.Add(1)
+		if err := s.workers.Dispatch(c, msg, c.closeChan, s.hwg.Done); err != nil {
+			s.opts.Logger.Infof("KCP conn:%d dispatch error:[%v]", c.id, err)
+			c.Close()
+			return err
+		}
+		return nil
+	}
+	if err := s.opts.Handler.OnReadMsg(c, msg); err != nil {
+		s.opts.Logger.Infof("KCP conn:%d OnReadMsg error:[%v]", c.id, err)
+		c.Close()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,472 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/connstat"
+	"github.com/izhw/gnet/internal/metric"
+	"github.com/izhw/gnet/internal/registry"
+	"github.com/izhw/gnet/internal/util/delay"
+	"github.com/izhw/gnet/internal/util/limter"
+	"github.com/izhw/gnet/internal/worker"
+	"github.com/izhw/gnet/kcp/internal"
+)
+
+const DefaultAddr = "0.0.0.0:7777"
+
+// DefaultIdleTimeout idle timeout of conns if both HeartTimeout and ReadTimeout are 0,
+// a conn is opened by any packet, so conns must expire
+const DefaultIdleTimeout = 2 * time.Minute
+
+var _ gcore.Server = &Server{}
+
+// Server is a KCP server, reliable and ordered msgs over UDP. Each session of a remote address
+// is a Conn, which is opened by its first packet and expires after receiving nothing for
+// HeartTimeout, or ReadTimeout if HeartTimeout is 0, or DefaultIdleTimeout if both are 0,
+// clients should send heartbeats within it.
+// A Conn is also closed when a segment is not acknowledged after KCP.DeadLink retransmissions.
+// KCP preserves msg boundaries, HeaderCodec is not used. Packets of all conns are read by one
+// loop, msgs of a Conn are passed to OnReadMsg in order by its own goroutine, or workers if
+// WorkerNum is set.
+type Server struct {
+	opts     gcore.Options
+	conn     net.PacketConn
+	limiter  limter.Limiter
+	stopChan chan struct{}
+	quit     chan struct{}  // stops the read and update loops
+	wg       sync.WaitGroup // read and update loops
+	cwg      sync.WaitGroup // conns
+	lwg      sync.WaitGroup // recv loops of conns
+	hwg      sync.WaitGroup // msgs dispatched to workers
+	mu       sync.Mutex     // guards peers
+	peers    map[string]*Conn
+	conns    *registry.Registry
+	workers  *worker.Pool // nil if WorkerNum is 0
+	metrics  *metric.Server
+	heart    *connstat.HeartKeeper
+	heartLen uint32
+	connNum  uint32
+	stopped  int32
+	draining int32 // new conns and msgs are dropped, set by Shutdown
+}
+
+func NewServer() *Server {
+	return &Server{
+		stopped: 1,
+	}
+}
+
+func (s *Server) WithOptions(opts gcore.Options) {
+	s.opts = opts
+}
+
+func (s *Server) Init(opts ...gcore.Option) error {
+	for _, opt := range opts {
+		opt(&s.opts)
+	}
+	if s.opts.Addr == "" {
+		s.opts.Addr = DefaultAddr
+	}
+	if s.opts.HeartPingInterval > 0 && len(s.opts.HeartData) == 0 {
+		return errors.New("server ping: HeartData not set")
+	}
+	conn, err := internal.ListenPacket("udp", s.opts.Addr, &s.opts)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.opts.Handler = gcore.WrapHandler(s.opts.Handler, s.opts.Interceptors)
+	if s.opts.ConnLimit > 0 {
+		s.limiter = limter.NewLimiter(s.opts.ConnLimit)
+	}
+	s.stopChan = make(chan struct{})
+	s.quit = make(chan struct{})
+	s.peers = make(map[string]*Conn)
+	s.conns = registry.New()
+	s.metrics = metric.NewServer(&s.opts)
+	if s.opts.WorkerNum > 0 {
+		s.workers = worker.NewPool(&s.opts)
+	}
+	idle := s.opts.HeartTimeout
+	if idle <= 0 {
+		idle = s.opts.ReadTimeout
+	}
+	if idle <= 0 {
+		idle = DefaultIdleTimeout
+	}
+	s.heart = connstat.NewHeartKeeper(idle, s.opts.HeartPingInterval)
+	s.heartLen = uint32(len(s.opts.HeartData))
+	s.stopped = 0
+
+	return nil
+}
+
+// Addr the local address listened on
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Server) Serve() error {
+	if atomic.LoadInt32(&s.stopped) == 1 {
+		return errors.New("server uninitialized")
+	}
+	if s.workers != nil {
+		s.workers.Start()
+	}
+	s.heart.Start()
+	s.wg.Add(2)
+	go s.readLoop()
+	go s.updateLoop()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(c)
+
+	select {
+	case <-s.opts.Ctx.Done():
+		s.Stop()
+		return s.opts.Ctx.Err()
+	case <-s.stopChan:
+		s.wait()
+	case sig := <-c:
+		s.Stop()
+		return errors.New("signal:" + sig.String())
+	}
+	return nil
+}
+
+// wait waits for the loops to exit and all conns to be closed
+func (s *Server) wait() {
+	s.wg.Wait()
+	s.cwg.Wait()
+	s.lwg.Wait()
+}
+
+// Stop stops reading and flushing, closes all conns, unacknowledged msgs are dropped
+func (s *Server) Stop() {
+	if !atomic.CompareAndSwapInt32(&s.stopped, 0, 1) {
+		return
+	}
+	close(s.stopChan)
+	close(s.quit)
+	s.conn.Close()
+	s.wg.Wait()
+	s.closeConns()
+	s.release()
+}
+
+// Shutdown stops accepting new conns and msgs, calls OnShutdown of the handler for each conn
+// if implemented, waits for the msgs dispatched to workers to be handled and the msgs sent
+// to be acknowledged, then closes all conns. If ctx is done before, unacknowledged msgs are
+// dropped, and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.stopped, 0, 1) {
+		s.wait()
+		return nil
+	}
+	atomic.StoreInt32(&s.draining, 1)
+	close(s.stopChan)
+
+	h, _ := s.opts.Handler.(gcore.ShutdownHandler)
+	s.conns.Range(func(c gcore.Conn) bool {
+		if h != nil {
+			h.OnShutdown(c)
+		}
+		return true
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.hwg.Wait()
+		ticker := time.NewTicker(internal.Interval(&s.opts.KCP))
+		defer ticker.Stop()
+		for !s.flushed() {
+			select {
+			case <-ticker.C:
+			case <-s.quit:
+				return
+			}
+		}
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	close(s.quit)
+	s.conn.Close()
+	s.wg.Wait()
+	s.closeConns()
+	s.release()
+	<-done
+	return err
+}
+
+// flushed whether the msgs sent to all conns are acknowledged
+func (s *Server) flushed() bool {
+	for _, c := range s.snapshot(nil) {
+		if c.sess.WaitSnd() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// snapshot appends the conns to cs
+func (s *Server) snapshot(cs []*Conn) []*Conn {
+	s.mu.Lock()
+	for _, c := range s.peers {
+		cs = append(cs, c)
+	}
+	s.mu.Unlock()
+	return cs
+}
+
+// closeConns closes all conns, called after the loops exit
+func (s *Server) closeConns() {
+	for _, c := range s.snapshot(nil) {
+		c.Close()
+	}
+	s.cwg.Wait()
+	s.lwg.Wait()
+}
+
+// release stops the workers and the heart keeper, called after all conns are closed
+func (s *Server) release() {
+	if s.workers != nil {
+		s.workers.Stop()
+	}
+	s.heart.Stop()
+}
+
+func (s *Server) WorkerStats() gcore.WorkerStats {
+	return s.workers.Stats()
+}
+
+func (s *Server) ConnNum() uint32 {
+	return atomic.LoadUint32(&s.connNum)
+}
+
+func (s *Server) GetConn(id uint64) (gcore.Conn, bool) {
+	return s.conns.Get(id)
+}
+
+func (s *Server) GetConnsByTag(tag string) []gcore.Conn {
+	return s.conns.GetByTag(tag)
+}
+
+func (s *Server) RangeConns(f func(c gcore.Conn) bool) {
+	s.conns.Range(f)
+}
+
+func (s *Server) CloseConn(id uint64, reason string) error {
+	c, ok := s.conns.Get(id)
+	if !ok {
+		return gcore.ErrConnNotFound
+	}
+	s.opts.Logger.Infof("KCP server close conn:%d %s, reason:%s", id, c.RemoteAddr(), reason)
+	return c.Close()
+}
+
+func (s *Server) JoinGroup(group string, c gcore.Conn) error {
+	if !s.conns.Join(c, group) {
+		return gcore.ErrConnNotFound
+	}
+	return nil
+}
+
+func (s *Server) LeaveGroup(group string, c gcore.Conn) {
+	s.conns.Leave(c, group)
+}
+
+func (s *Server) Broadcast(data []byte, policy gcore.SlowReceiverPolicy) (n int, err error) {
+	s.conns.Range(func(c gcore.Conn) bool {
+		if s.send(c.(*Conn), data, policy) {
+			n++
+		}
+		return true
+	})
+	return n, nil
+}
+
+func (s *Server) GroupBroadcast(group string, data []byte, policy gcore.SlowReceiverPolicy) (n int, err error) {
+	for _, c := range s.conns.GetGroup(group) {
+		if s.send(c.(*Conn), data, policy) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// send sends msg to c with policy
+func (s *Server) send(c *Conn, msg []byte, policy gcore.SlowReceiverPolicy) bool {
+	p := gcore.SendQueueDropNewest
+	switch policy {
+	case gcore.SlowReceiverBlock:
+		p = gcore.SendQueueBlock
+	case gcore.SlowReceiverDisconnect:
+		p = gcore.SendQueueClose
+	}
+	return c.push(context.Background(), msg, p, true) == nil
+}
+
+func (s *Server) onConnClose(c *Conn) {
+	s.mu.Lock()
+	if s.peers[c.key] == c {
+		delete(s.peers, c.key)
+	}
+	s.mu.Unlock()
+	if s.limiter != nil {
+		s.limiter.Revert()
+	}
+	atomic.AddUint32(&s.connNum, ^uint32(0))
+	s.metrics.Conns.Add(-1)
+	s.cwg.Done()
+}
+
+// isHeartBeat called when len(data) == len(s.opts.HeartData)
+func (s *Server) isHeartBeat(data []byte) bool {
+	for i := 0; i < len(s.opts.HeartData); i++ {
+		if s.opts.HeartData[i] != data[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// peer returns the conn of the session conv from addr, a new one is opened for an unknown addr,
+// and replaces the conn of addr with another conv, e.g. a restarted client.
+// It returns nil if rejected by ConnLimit or the server is shutting down.
+func (s *Server) peer(addr net.Addr, conv uint32) *Conn {
+	key := addr.String()
+	s.mu.Lock()
+	c, ok := s.peers[key]
+	if ok && c.conv == conv {
+		s.mu.Unlock()
+		return c
+	}
+	s.mu.Unlock()
+	if ok {
+		s.opts.Logger.Debugf("KCP conn:%d %s replaced by a new session", c.id, key)
+		c.Close()
+	}
+	if atomic.LoadInt32(&s.draining) == 1 {
+		return nil
+	}
+
+	s.mu.Lock()
+	if s.limiter != nil && !s.limiter.Allow() {
+		s.mu.Unlock()
+		s.metrics.Rejected.Add(1)
+		s.opts.Logger.Warnf("KCP server accepted max num:%d, packet of new conn %s dropped", s.opts.ConnLimit, key)
+		return nil
+	}
+	atomic.AddUint32(&s.connNum, 1)
+	s.metrics.Accepted.Add(1)
+	s.metrics.Conns.Add(1)
+	s.cwg.Add(1)
+	c = newConn(s, addr, key, conv)
+	s.peers[key] = c
+	s.mu.Unlock()
+	c.register()
+	s.opts.Handler.OnOpened(c)
+	s.lwg.Add(1)
+	go c.handleRecvLoop()
+	return c
+}
+
+func (s *Server) readLoop() {
+	defer func() {
+		s.wg.Done()
+		s.Stop()
+	}()
+
+	buf := make([]byte, internal.MaxPacketLen)
+	td := delay.NewTempDelay(5*time.Millisecond, time.Second)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.quit:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				d := td.GetDelay()
+				s.opts.Logger.Warnf("KCP server read temporary error:[%v], delay:%v", ne, d)
+				time.Sleep(d)
+				continue
+			}
+			s.opts.Logger.Errorf("KCP server read error:[%v]", err)
+			return
+		}
+		td.Reset()
+		conv, ok := internal.Conv(buf[:n])
+		if !ok {
+			continue
+		}
+		c := s.peer(addr, conv)
+		if c == nil || c.Closed() {
+			continue
+		}
+		c.stats.Read(n, 0)
+		if err := c.sess.Input(buf[:n]); err != nil && !c.Closed() {
+			s.opts.Logger.Debugf("KCP conn:%d %s packet dropped, error:[%v]", c.id, c.addr, err)
+		}
+	}
+}
+
+// updateLoop flushes the sessions every KCP.Interval, closes the dead ones
+func (s *Server) updateLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(internal.Interval(&s.opts.KCP))
+	defer ticker.Stop()
+	var cs []*Conn
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+		}
+		cs = s.snapshot(cs[:0])
+		for i, c := range cs {
+			if c.sess.Update() {
+				s.opts.Logger.Infof("KCP conn:%d %s dead link, closing", c.id, c.addr)
+				c.Close()
+			}
+			cs[i] = nil
+		}
+	}
+}
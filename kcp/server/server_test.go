@@ -0,0 +1,133 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package server_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/kcp/client"
+	"github.com/izhw/gnet/kcp/netsim"
+	"github.com/izhw/gnet/kcp/server"
+)
+
+type echoHandler struct {
+	*gcore.NetEventHandler
+}
+
+func (h *echoHandler) OnReadMsg(c gcore.Conn, data []byte) error {
+	return c.Write(data)
+}
+
+// recvHandler collects the msgs echoed to the client, done is closed when want are received
+type recvHandler struct {
+	*gcore.NetEventHandler
+	mu   sync.Mutex
+	msgs [][]byte
+	want int
+	done chan struct{}
+}
+
+func (h *recvHandler) OnReadMsg(c gcore.Conn, data []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.msgs = append(h.msgs, append([]byte(nil), data...))
+	if len(h.msgs) == h.want {
+		close(h.done)
+	}
+	return nil
+}
+
+// testMsg returns msg i, 8 bytes to 6000 bytes, many longer than the MTU
+func testMsg(i int) []byte {
+	b := make([]byte, 8+(i*131)%6000)
+	binary.BigEndian.PutUint64(b, uint64(i))
+	for j := 8; j < len(b); j++ {
+		b[j] = byte(i + j)
+	}
+	return b
+}
+
+func TestEchoLossyNetwork(t *testing.T) {
+	const n = 300
+	ko := gcore.KCPOptions{
+		NoDelay:      true,
+		Interval:     10 * time.Millisecond,
+		Resend:       2,
+		NoCongestion: true,
+		SendWindow:   128,
+		WrapConn: netsim.Wrap(netsim.Config{
+			Loss:      0.1,
+			Delay:     20 * time.Millisecond,
+			Jitter:    10 * time.Millisecond,
+			Duplicate: 0.05,
+			Seed:      1,
+		}),
+	}
+
+	opts := gcore.DefaultOptions()
+	opts.Addr = "127.0.0.1:0"
+	opts.KCP = ko
+	opts.Handler = &echoHandler{&gcore.NetEventHandler{}}
+	s := server.NewServer()
+	s.WithOptions(opts)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Stop()
+
+	h := &recvHandler{NetEventHandler: &gcore.NetEventHandler{}, want: n, done: make(chan struct{})}
+	copts := gcore.DefaultOptions()
+	copts.Addr = s.Addr().String()
+	copts.KCP = ko
+	copts.Handler = h
+	c := client.NewAsyncClient()
+	c.WithOptions(copts)
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < n; i++ {
+		if err := c.Write(testMsg(i)); err != nil {
+			t.Fatalf("write msg %d: %v", i, err)
+		}
+	}
+
+	select {
+	case <-h.done:
+	case <-time.After(30 * time.Second):
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		t.Fatalf("timeout, %d of %d msgs echoed", len(h.msgs), n)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, m := range h.msgs {
+		if !bytes.Equal(m, testMsg(i)) {
+			t.Fatalf("msg %d: got %d bytes, want %d", i, len(m), len(testMsg(i)))
+		}
+	}
+}
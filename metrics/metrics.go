@@ -0,0 +1,232 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package metrics a gcore.MetricsSink keeping metrics in memory,
+// and serving them in the Prometheus text exposition format over net/http:
+//
+//	reg := metrics.NewRegistry()
+//	svc := gnet.NewService(gcore.WithMetrics(reg), ...)
+//	http.Handle("/metrics", reg)
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/izhw/gnet/gcore"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var _ gcore.MetricsSink = &Registry{}
+
+type metricType string
+
+const (
+	typeCounter metricType = "counter"
+	typeGauge   metricType = "gauge"
+)
+
+// Registry an in-memory gcore.MetricsSink, safe for concurrent use
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+type family struct {
+	name   string
+	help   string
+	typ    metricType
+	series map[string]*value // keyed by formatted labels
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		families: make(map[string]*family),
+	}
+}
+
+// Counter returns the counter of name and labels, creating it if not exists.
+// It panics if name is registered as a gauge.
+func (r *Registry) Counter(name, help string, labels gcore.Labels) gcore.Counter {
+	return r.get(name, help, typeCounter, labels)
+}
+
+// Gauge returns the gauge of name and labels, creating it if not exists.
+// It panics if name is registered as a counter.
+func (r *Registry) Gauge(name, help string, labels gcore.Labels) gcore.Gauge {
+	return r.get(name, help, typeGauge, labels)
+}
+
+func (r *Registry) get(name, help string, typ metricType, labels gcore.Labels) *value {
+	key := formatLabels(labels)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ, series: make(map[string]*value)}
+		r.families[name] = f
+	} else if f.typ != typ {
+		panic(fmt.Sprintf("metrics: %s registered as %s", name, f.typ))
+	}
+	v, ok := f.series[key]
+	if !ok {
+		v = &value{}
+		f.series[key] = v
+	}
+	return v
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	_, _ = r.WriteTo(w)
+}
+
+// WriteTo writes all metrics to w in the Prometheus text format, sorted by name and labels
+func (r *Registry) WriteTo(w io.Writer) (n int64, err error) {
+	type sample struct {
+		labels string
+		v      *value
+	}
+	type snapshot struct {
+		f       *family
+		samples []sample
+	}
+	r.mu.Lock()
+	snaps := make([]snapshot, 0, len(r.families))
+	for _, f := range r.families {
+		s := snapshot{f: f, samples: make([]sample, 0, len(f.series))}
+		for labels, v := range f.series {
+			s.samples = append(s.samples, sample{labels, v})
+		}
+		snaps = append(snaps, s)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].f.name < snaps[j].f.name })
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	for _, s := range snaps {
+		sort.Slice(s.samples, func(i, j int) bool { return s.samples[i].labels < s.samples[j].labels })
+		if s.f.help != "" {
+			fmt.Fprintf(cw, "# HELP %s %s\n", s.f.name, escapeHelp(s.f.help))
+		}
+		fmt.Fprintf(cw, "# TYPE %s %s\n", s.f.name, s.f.typ)
+		for _, sm := range s.samples {
+			fmt.Fprintf(cw, "%s%s %s\n", s.f.name, sm.labels, formatFloat(sm.v.get()))
+		}
+	}
+	if err = cw.w.Flush(); err == nil {
+		err = cw.err
+	}
+	return cw.n, err
+}
+
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	if err != nil && cw.err == nil {
+		cw.err = err
+	}
+	return n, err
+}
+
+// value a float64 updated atomically, implements gcore.Counter and gcore.Gauge
+type value struct {
+	bits uint64
+}
+
+func (v *value) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+func (v *value) Set(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *value) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		n := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, n) {
+			return
+		}
+	}
+}
+
+// formatLabels returns labels as {a="1",b="2"} sorted by name, "" if empty
+func formatLabels(labels gcore.Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(labels[name]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
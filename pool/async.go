@@ -26,7 +26,9 @@ import (
 	"sync/atomic"
 
 	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/metric"
 	"github.com/izhw/gnet/internal/util/limter"
+	kcpclient "github.com/izhw/gnet/kcp/client"
 	"github.com/izhw/gnet/tcp/client"
 )
 
@@ -38,6 +40,7 @@ type AsyncPool struct {
 	connChan  chan gcore.Conn
 	closeChan chan struct{}
 	limiter   limter.Limiter
+	metrics   *metric.Pool
 	cancel    context.CancelFunc
 	closed    int32
 }
@@ -60,6 +63,7 @@ func (p *AsyncPool) Init(opts ...gcore.Option) error {
 	if p.opts.PoolMaxSize == 0 {
 		p.opts.PoolMaxSize = 16
 	}
+	p.metrics = metric.NewPool(&p.opts)
 	p.connChan = make(chan gcore.Conn, p.opts.PoolMaxSize)
 	p.closeChan = make(chan struct{})
 	p.limiter = limter.NewTimeoutLimiter(p.opts.PoolMaxSize, p.opts.PoolGetTimeout)
@@ -79,12 +83,23 @@ func (p *AsyncPool) Init(opts ...gcore.Option) error {
 		}
 		return c, nil
 	}
+	if p.opts.ServiceType.KCPAsyncPoolType() {
+		p.factory = func() (gcore.Conn, error) {
+			c := kcpclient.NewAsyncClient()
+			c.WithOptions(p.opts)
+			if err := c.Init(); err != nil {
+				return nil, err
+			}
+			return c, nil
+		}
+	}
 	for i := 0; i < int(p.opts.PoolInitSize); i++ {
 		conn, err := p.createConn()
 		if err != nil {
 			p.Close()
 			return fmt.Errorf("pool:%w", err)
 		}
+		p.metrics.Idle.Add(1)
 		p.connChan <- conn
 	}
 	return nil
@@ -101,12 +116,19 @@ func (p *AsyncPool) createConn() (gcore.Conn, error) {
 
 func (p *AsyncPool) Get() (conn gcore.Conn, err error) {
 	if !p.limiter.Allow() {
+		p.metrics.GetTimeouts.Add(1)
 		return nil, gcore.ErrPoolTimeout
 	}
 	defer func() {
 		if err != nil {
 			p.limiter.Revert()
+			if err != gcore.ErrPoolClosed {
+				p.metrics.GetErrors.Add(1)
+			}
+			return
 		}
+		p.metrics.Gets.Add(1)
+		p.metrics.InUse.Add(1)
 	}()
 
 	for {
@@ -121,6 +143,7 @@ func (p *AsyncPool) Get() (conn gcore.Conn, err error) {
 			if !ok {
 				return nil, gcore.ErrPoolClosed
 			}
+			p.metrics.Idle.Add(-1)
 			if conn.Closed() {
 				continue
 			}
@@ -136,6 +159,7 @@ func (p *AsyncPool) Put(conn gcore.Conn) {
 		return
 	}
 	p.limiter.Revert()
+	p.metrics.InUse.Add(-1)
 
 	select {
 	case <-p.closeChan:
@@ -145,6 +169,7 @@ func (p *AsyncPool) Put(conn gcore.Conn) {
 	if conn.Closed() {
 		return
 	}
+	p.metrics.Idle.Add(1)
 	p.connChan <- conn
 }
 
@@ -26,7 +26,9 @@ import (
 	"time"
 
 	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/metric"
 	"github.com/izhw/gnet/internal/util/limter"
+	kcpclient "github.com/izhw/gnet/kcp/client"
 	"github.com/izhw/gnet/tcp/client"
 )
 
@@ -43,6 +45,7 @@ type Pool struct {
 	connChan  chan *poolConn
 	closeChan chan struct{}
 	limiter   limter.Limiter
+	metrics   *metric.Pool
 	closed    int32
 }
 
@@ -64,6 +67,7 @@ func (p *Pool) Init(opts ...gcore.Option) error {
 	if p.opts.PoolMaxSize == 0 {
 		p.opts.PoolMaxSize = 16
 	}
+	p.metrics = metric.NewPool(&p.opts)
 	p.factory = func() (gcore.Conn, error) {
 		c := client.NewClient()
 		c.WithOptions(p.opts)
@@ -72,6 +76,16 @@ func (p *Pool) Init(opts ...gcore.Option) error {
 		}
 		return c, nil
 	}
+	if p.opts.ServiceType.KCPPoolType() {
+		p.factory = func() (gcore.Conn, error) {
+			c := kcpclient.NewClient()
+			c.WithOptions(p.opts)
+			if err := c.Init(); err != nil {
+				return nil, err
+			}
+			return c, nil
+		}
+	}
 	p.connChan = make(chan *poolConn, p.opts.PoolMaxSize)
 	p.closeChan = make(chan struct{})
 	p.limiter = limter.NewTimeoutLimiter(p.opts.PoolMaxSize, p.opts.PoolGetTimeout)
@@ -88,6 +102,7 @@ func (p *Pool) Init(opts ...gcore.Option) error {
 			p.Close()
 			return fmt.Errorf("pool:%w", err)
 		}
+		p.metrics.Idle.Add(1)
 		p.connChan <- &poolConn{
 			conn: conn,
 			t:    time.Now().UnixNano(),
@@ -107,12 +122,19 @@ func (p *Pool) createConn() (gcore.Conn, error) {
 
 func (p *Pool) Get() (conn gcore.Conn, err error) {
 	if !p.limiter.Allow() {
+		p.metrics.GetTimeouts.Add(1)
 		return nil, gcore.ErrPoolTimeout
 	}
 	defer func() {
 		if err != nil {
 			p.limiter.Revert()
+			if err != gcore.ErrPoolClosed {
+				p.metrics.GetErrors.Add(1)
+			}
+			return
 		}
+		p.metrics.Gets.Add(1)
+		p.metrics.InUse.Add(1)
 	}()
 
 	for {
@@ -127,6 +149,7 @@ func (p *Pool) Get() (conn gcore.Conn, err error) {
 			if !ok {
 				return nil, gcore.ErrPoolClosed
 			}
+			p.metrics.Idle.Add(-1)
 			if pc.conn.Closed() {
 				continue
 			}
@@ -138,6 +161,7 @@ func (p *Pool) Get() (conn gcore.Conn, err error) {
 			}
 			if len(p.opts.HeartData) > 0 {
 				if time.Now().UnixNano()-pc.t > p.opts.HeartInterval.Nanoseconds() {
+					p.metrics.Heartbeats.Add(1)
 					if _, err := pc.conn.WriteRead(p.opts.HeartData); err != nil {
 						pc.conn.Close()
 						continue
@@ -156,6 +180,7 @@ func (p *Pool) Put(conn gcore.Conn) {
 		return
 	}
 	p.limiter.Revert()
+	p.metrics.InUse.Add(-1)
 
 	select {
 	case <-p.closeChan:
@@ -165,6 +190,7 @@ func (p *Pool) Put(conn gcore.Conn) {
 	if conn.Closed() {
 		return
 	}
+	p.metrics.Idle.Add(1)
 	p.connChan <- &poolConn{
 		conn: conn,
 		t:    time.Now().UnixNano(),
@@ -22,9 +22,15 @@ package gnet
 
 import (
 	"github.com/izhw/gnet/gcore"
+	kcpclient "github.com/izhw/gnet/kcp/client"
+	kcpserver "github.com/izhw/gnet/kcp/server"
 	"github.com/izhw/gnet/pool"
 	"github.com/izhw/gnet/tcp/client"
+	"github.com/izhw/gnet/tcp/eventloop"
 	"github.com/izhw/gnet/tcp/server"
+	"github.com/izhw/gnet/tcp/websocket"
+	udpclient "github.com/izhw/gnet/udp/client"
+	udpserver "github.com/izhw/gnet/udp/server"
 )
 
 type service struct {
@@ -51,6 +57,26 @@ func (s *service) init() {
 		svr.WithOptions(s.opts)
 		s.server = svr
 	}
+	if s.server == nil && s.opts.ServiceType.TCPEventLoopServerType() {
+		svr := eventloop.NewServer()
+		svr.WithOptions(s.opts)
+		s.server = svr
+	}
+	if s.server == nil && s.opts.ServiceType.UDPServerType() {
+		svr := udpserver.NewServer()
+		svr.WithOptions(s.opts)
+		s.server = svr
+	}
+	if s.server == nil && s.opts.ServiceType.KCPServerType() {
+		svr := kcpserver.NewServer()
+		svr.WithOptions(s.opts)
+		s.server = svr
+	}
+	if s.server == nil && s.opts.ServiceType.WebSocketServerType() {
+		svr := websocket.NewServer()
+		svr.WithOptions(s.opts)
+		s.server = svr
+	}
 	if s.opts.ServiceType.TCPClientType() {
 		c := client.NewClient()
 		c.WithOptions(s.opts)
@@ -61,16 +87,46 @@ func (s *service) init() {
 		c.WithOptions(s.opts)
 		s.client = c
 	}
+	if s.client == nil && s.opts.ServiceType.UDPClientType() {
+		c := udpclient.NewClient()
+		c.WithOptions(s.opts)
+		s.client = c
+	}
+	if s.client == nil && s.opts.ServiceType.KCPClientType() {
+		c := kcpclient.NewClient()
+		c.WithOptions(s.opts)
+		s.client = c
+	}
+	if s.client == nil && s.opts.ServiceType.KCPAsyncClientType() {
+		c := kcpclient.NewAsyncClient()
+		c.WithOptions(s.opts)
+		s.client = c
+	}
+	if s.client == nil && s.opts.ServiceType.WebSocketClientType() {
+		c := websocket.NewClient()
+		c.WithOptions(s.opts)
+		s.client = c
+	}
 	if s.opts.ServiceType.TCPPoolType() {
 		p := pool.NewPool()
 		p.WithOptions(s.opts)
 		s.pool = p
 	}
+	if s.pool == nil && s.opts.ServiceType.KCPPoolType() {
+		p := pool.NewPool()
+		p.WithOptions(s.opts)
+		s.pool = p
+	}
 	if s.pool == nil && s.opts.ServiceType.TCPAsyncPoolType() {
 		p := pool.NewAsyncPool()
 		p.WithOptions(s.opts)
 		s.pool = p
 	}
+	if s.pool == nil && s.opts.ServiceType.KCPAsyncPoolType() {
+		p := pool.NewAsyncPool()
+		p.WithOptions(s.opts)
+		s.pool = p
+	}
 }
 
 // Server returns the server
@@ -21,6 +21,9 @@
 package client
 
 import (
+	"bytes"
+	"context"
+	"crypto/x509"
 	"io"
 	"net"
 	"sync"
@@ -28,52 +31,208 @@ import (
 	"time"
 
 	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/connstat"
+	"github.com/izhw/gnet/internal/metric"
+	"github.com/izhw/gnet/internal/registry"
+	"github.com/izhw/gnet/internal/util/delay"
 	"github.com/izhw/gnet/tcp/internal"
 )
 
 var _ gcore.Conn = &AsyncClient{}
 
 type AsyncClient struct {
+	id        uint64
 	opts      gcore.Options
 	conn      net.Conn
 	buffer    *internal.ReaderBuffer
-	sendChan  chan []byte
+	queue     *internal.SendQueue
+	writer    *internal.BatchWriter // writer of the current conn
+	calls     *callTable            // in-flight calls, only for Multiplex
+	metrics   *metric.Client
+	stats     *connstat.Stats
 	closeChan chan struct{}
+	downChan  chan struct{} // closed when the current conn is broken
+	connMu    sync.RWMutex  // guards conn swapping while reconnecting
+	mu        sync.Mutex    // serializes stopping and starting loops
 	wwg       sync.WaitGroup
 	rwg       sync.WaitGroup
+	running   bool // loops of the current conn are started, guarded by mu
+	connected int32
 	closed    int32
 	tag       string
 }
 
 func NewAsyncClient() *AsyncClient {
-	return &AsyncClient{}
+	return &AsyncClient{
+		id: registry.NextID(),
+	}
 }
 
 func (c *AsyncClient) WithOptions(opts gcore.Options) {
 	c.opts = opts
 }
 
+func (c *AsyncClient) ID() uint64 {
+	return c.id
+}
+
 func (c *AsyncClient) Init(opts ...gcore.Option) error {
 	for _, opt := range opts {
 		opt(&c.opts)
 	}
-	conn, err := net.Dial("tcp", c.opts.Addr)
+	c.metrics = metric.NewClient(&c.opts)
+	c.stats = connstat.NewStats(&c.metrics.IO)
+	conn, err := dial(&c.opts)
 	if err != nil {
+		c.metrics.ConnectErrors.Add(1)
 		return err
 	}
-	c.conn = conn
-	c.buffer = internal.NewReaderBuffer(c.conn, int(c.opts.InitReadBufLen), int(c.opts.MaxReadBufLen))
-	c.sendChan = make(chan []byte, 100)
+	c.metrics.Connects.Add(1)
+	c.opts.Handler = gcore.WrapHandler(c.opts.Handler, c.opts.Interceptors)
 	c.closeChan = make(chan struct{})
+	c.queue = internal.NewSendQueue(c.opts.SendQueueLen, c.opts.SendQueueBytes, c.closeChan)
+	if c.opts.Multiplex {
+		c.calls = newCallTable()
+	}
+	c.start(conn, false)
+	if c.opts.Reconnect {
+		go c.handleReconnectLoop()
+	}
+	return nil
+}
+
+// start starts the read and write loops on conn
+func (c *AsyncClient) start(conn net.Conn, reconnected bool) {
+	c.connMu.Lock()
+	c.conn = conn
+	c.connMu.Unlock()
+	c.buffer = internal.NewReaderBuffer(conn, int(c.opts.InitReadBufLen), int(c.opts.MaxReadBufLen))
+	c.writer = internal.NewBatchWriter(conn, c.opts.WriteBatchBytes, c.stats)
+	c.downChan = make(chan struct{})
+	c.running = true
+	atomic.StoreInt32(&c.connected, 1)
 	c.wwg.Add(1)
 	if len(c.opts.HeartData) > 0 {
-		go c.handleWriteLoopWithHeartbeat()
+		go c.handleWriteLoopWithHeartbeat(c.downChan)
 	} else {
-		go c.handleWriteLoop()
+		go c.handleWriteLoop(c.downChan)
 	}
 	c.rwg.Add(1)
-	go c.handleReadLoop()
-	return nil
+	go c.handleReadLoop(reconnected)
+}
+
+// stop waits for the loops of the current conn to exit and closes the conn,
+// flush: whether to send the remaining data in the send queue before closing
+func (c *AsyncClient) stop(flush bool) (err error) {
+	c.disconnect()
+	c.wwg.Wait()
+	for flush {
+		failed, err := c.writer.WriteQueued(c.queue, c.getWriteDeadLine)
+		if err == nil {
+			break
+		}
+		for _, f := range failed {
+			c.opts.Handler.OnWriteError(c, f.Body, err)
+		}
+	}
+	err = c.conn.Close()
+	c.rwg.Wait()
+	c.buffer.Release()
+	c.running = false
+	return
+}
+
+// disconnect marks the current conn as broken, in-flight calls fail
+func (c *AsyncClient) disconnect() {
+	if atomic.CompareAndSwapInt32(&c.connected, 1, 0) {
+		close(c.downChan)
+		if c.calls != nil {
+			if c.Closed() {
+				c.calls.failAll(gcore.ErrConnClosed)
+			} else {
+				c.calls.failAll(gcore.ErrConnReconnecting)
+			}
+		}
+	}
+}
+
+// loopExit called when the read or write loop exits
+func (c *AsyncClient) loopExit() {
+	if c.opts.Reconnect {
+		c.disconnect()
+		return
+	}
+	c.Close()
+}
+
+func (c *AsyncClient) handleReconnectLoop() {
+	for {
+		select {
+		case <-c.closeChan:
+			return
+		case <-c.opts.Ctx.Done():
+			c.Close()
+			return
+		case <-c.downChan:
+		}
+		c.mu.Lock()
+		if c.running {
+			_ = c.stop(false)
+		}
+		c.mu.Unlock()
+		if !c.reconnect() {
+			c.Close()
+			return
+		}
+	}
+}
+
+// reconnect redials Addr with backoff until success,
+// returns false if the client is closed or retries are exhausted
+func (c *AsyncClient) reconnect() bool {
+	h, _ := c.opts.Handler.(gcore.ReconnectHandler)
+	d := delay.NewJitterDelay(c.opts.ReconnectMinDelay, c.opts.ReconnectMaxDelay)
+	timer := time.NewTimer(d.GetDelay())
+	defer timer.Stop()
+
+	for attempt := 1; ; attempt++ {
+		if c.opts.ReconnectMaxRetries > 0 && attempt > int(c.opts.ReconnectMaxRetries) {
+			c.opts.Logger.Errorf("TCP client reconnect %s failed after %d attempts", c.opts.Addr, attempt-1)
+			return false
+		}
+		select {
+		case <-c.opts.Ctx.Done():
+			return false
+		case <-c.closeChan:
+			return false
+		case <-timer.C:
+		}
+		if h != nil {
+			h.OnReconnecting(c, attempt)
+		}
+		conn, err := dial(&c.opts)
+		if err != nil {
+			c.metrics.ConnectErrors.Add(1)
+			next := d.GetDelay()
+			c.opts.Logger.Warnf("TCP client reconnect %s error:[%v], attempt:%d, delay:%v", c.opts.Addr, err, attempt, next)
+			timer.Reset(next)
+			continue
+		}
+		c.mu.Lock()
+		select {
+		case <-c.closeChan:
+			c.mu.Unlock()
+			conn.Close()
+			return false
+		default:
+		}
+		c.metrics.Connects.Add(1)
+		c.metrics.Reconnects.Add(1)
+		c.stats.Connected()
+		c.start(conn, true)
+		c.mu.Unlock()
+		return true
+	}
 }
 
 func (c *AsyncClient) Read(buf []byte) (n int, err error) {
@@ -84,38 +243,135 @@ func (c *AsyncClient) ReadFull(buf []byte) (n int, err error) {
 	return 0, gcore.ErrConnInvalidCall
 }
 
+// WriteRead only for Multiplex, calls Call with ReadTimeout
 func (c *AsyncClient) WriteRead(req []byte) (body []byte, err error) {
-	return nil, gcore.ErrConnInvalidCall
+	if !c.opts.Multiplex {
+		return nil, gcore.ErrConnInvalidCall
+	}
+	ctx := context.Background()
+	if c.opts.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.ReadTimeout)
+		defer cancel()
+	}
+	return c.Call(ctx, req)
 }
 
-// Write data should be without header if Encoder != nil
-func (c *AsyncClient) Write(data []byte) error {
-	if len(data) > 0 {
-		select {
-		case <-c.closeChan:
+// Call sends req and waits for the response with the same request ID, only for Multiplex.
+// req is passed through the interceptors. Calls from many goroutines can be in flight concurrently,
+// it returns ctx.Err() if ctx is done before the response arrives.
+func (c *AsyncClient) Call(ctx context.Context, req []byte) (resp []byte, err error) {
+	if !c.opts.Multiplex {
+		return nil, gcore.ErrConnInvalidCall
+	}
+	if err := c.checkWritable(); err != nil {
+		return nil, err
+	}
+	id, ch := c.calls.add()
+	err = gcore.InterceptWrite(c.opts.Interceptors, c, req, func(_ gcore.Conn, req []byte) error {
+		f, err := internal.EncodeFrame(c.opts.HeaderCodec, gcore.EncodeCall(id, req))
+		if err != nil {
+			return err
+		}
+		return c.push(ctx, f, true)
+	})
+	if err != nil {
+		c.calls.remove(id)
+		return nil, err
+	}
+	select {
+	case <-ctx.Done():
+		c.calls.remove(id)
+		return nil, ctx.Err()
+	case r := <-ch:
+		return r.data, r.err
+	}
+}
+
+// checkWritable rejects writing while reconnecting if ReconnectWriteReject is set
+func (c *AsyncClient) checkWritable() error {
+	if c.opts.Reconnect && c.opts.ReconnectWritePolicy == gcore.ReconnectWriteReject &&
+		atomic.LoadInt32(&c.connected) == 0 {
+		if c.Closed() {
 			return gcore.ErrConnClosed
-		default:
-			c.sendChan <- data
 		}
+		return gcore.ErrConnReconnecting
 	}
 	return nil
 }
 
+// Write data should be without header if Encoder != nil
+// For Multiplex, data is sent as a one-way message with request ID 0
+func (c *AsyncClient) Write(data []byte) error {
+	return c.enqueue(context.Background(), data, true)
+}
+
+func (c *AsyncClient) TryWrite(data []byte) error {
+	return c.enqueue(context.Background(), data, false)
+}
+
+func (c *AsyncClient) WriteContext(ctx context.Context, data []byte) error {
+	return c.enqueue(ctx, data, true)
+}
+
+// enqueue passes data through the interceptors and queues it,
+// wait: whether SendQueueBlock waits for room
+func (c *AsyncClient) enqueue(ctx context.Context, data []byte, wait bool) error {
+	if is := c.opts.Interceptors; len(is) > 0 {
+		return gcore.InterceptWrite(is, c, data, func(_ gcore.Conn, data []byte) error {
+			return c.send(ctx, data, wait)
+		})
+	}
+	return c.send(ctx, data, wait)
+}
+
+// send encodes data and queues it
+func (c *AsyncClient) send(ctx context.Context, data []byte, wait bool) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := c.checkWritable(); err != nil {
+		return err
+	}
+	if c.opts.Multiplex {
+		data = gcore.EncodeCall(0, data)
+	}
+	f, err := internal.EncodeFrame(c.opts.HeaderCodec, data)
+	if err != nil {
+		return err
+	}
+	return c.push(ctx, f, wait)
+}
+
+// push queues the encoded frame f with SendQueuePolicy
+func (c *AsyncClient) push(ctx context.Context, f internal.Frame, wait bool) error {
+	full, err := c.queue.Push(ctx, f, c.opts.SendQueuePolicy, wait)
+	if full {
+		c.metrics.SendQueueFull.Add(1)
+		if h, ok := c.opts.Handler.(gcore.SendQueueFullHandler); ok {
+			h.OnSendQueueFull(c, f.Body)
+		}
+	}
+	if err == gcore.ErrSendQueueFull && c.opts.SendQueuePolicy == gcore.SendQueueClose {
+		c.opts.Logger.Infof("TCP client send queue full, closing")
+		go c.Close()
+	}
+	return err
+}
+
 func (c *AsyncClient) Close() (err error) {
 	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
 		return
 	}
 	close(c.closeChan)
-	c.wwg.Wait()
-	for len(c.sendChan) > 0 {
-		data := <-c.sendChan
-		if err := c.write(data); err != nil {
-			c.opts.Handler.OnWriteError(c, data, err)
-		}
+	c.mu.Lock()
+	if c.running {
+		err = c.stop(true)
+	}
+	c.mu.Unlock()
+	if c.calls != nil {
+		c.calls.failAll(gcore.ErrConnClosed)
 	}
-	err = c.conn.Close()
-	c.rwg.Wait()
-	c.buffer.Release()
 	c.opts.Handler.OnClosed(c)
 	return
 }
@@ -128,9 +384,29 @@ func (c *AsyncClient) Closed() bool {
 }
 
 func (c *AsyncClient) RemoteAddr() net.Addr {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
 	return c.conn.RemoteAddr()
 }
 
+func (c *AsyncClient) LocalAddr() net.Addr {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	return c.conn.LocalAddr()
+}
+
+func (c *AsyncClient) PeerCertificates() []*x509.Certificate {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	return internal.PeerCertificates(c.conn)
+}
+
+func (c *AsyncClient) Stats() (st gcore.ConnStats) {
+	c.stats.Fill(&st)
+	st.SendQueueLen, st.SendQueueBytes = c.queue.Size()
+	return
+}
+
 func (c *AsyncClient) SetTag(tag string) {
 	c.tag = tag
 }
@@ -139,14 +415,18 @@ func (c *AsyncClient) GetTag() string {
 	return c.tag
 }
 
-func (c *AsyncClient) handleReadLoop() {
+func (c *AsyncClient) handleReadLoop(reconnected bool) {
 	defer func() {
 		c.rwg.Done()
-		c.Close()
+		c.loopExit()
 	}()
 
 	h := c.opts.Handler
-	h.OnOpened(c)
+	if !reconnected {
+		h.OnOpened(c)
+	} else if rh, ok := h.(gcore.ReconnectHandler); ok {
+		rh.OnReconnected(c)
+	}
 
 	for {
 		select {
@@ -154,7 +434,9 @@ func (c *AsyncClient) handleReadLoop() {
 			return
 		default:
 		}
-		if _, err := c.buffer.ReadFromReader(); err != nil {
+		n, err := c.buffer.ReadFromReader()
+		c.stats.Read(n, c.buffer.Cap())
+		if err != nil {
 			select {
 			case <-c.closeChan:
 				return
@@ -166,20 +448,31 @@ func (c *AsyncClient) handleReadLoop() {
 			return
 		}
 		for c.buffer.Len() > 0 {
-			bodyLen, headerLen := c.opts.HeaderCodec.Decode(c.buffer.Data())
-			if headerLen == 0 {
-				break
-			}
-			msgLen := bodyLen + headerLen
-			if msgLen > c.opts.MaxReadBufLen {
-				c.opts.Logger.Warnf("msg len:%d greater than max:%d", msgLen, c.opts.MaxReadBufLen)
+			buf, ok, err := c.buffer.ReadFrame(c.opts.HeaderCodec, c.opts.MaxReadBufLen)
+			if err != nil {
+				c.opts.Logger.Warnf("TCP client decode error:[%v]", err)
 				return
 			}
-			if uint32(c.buffer.Len()) < msgLen {
+			if !ok {
 				break
 			}
-			buf := make([]byte, bodyLen)
-			c.buffer.Read(int(headerLen), int(bodyLen), buf)
+			// heartbeats, echoed or pings of the server, are not msgs and have no request ID
+			heartbeat := c.isHeartBeat(buf)
+			if !heartbeat {
+				c.stats.MsgRead()
+			}
+			if c.calls != nil && !heartbeat {
+				// frames shorter than CallIDLen are passed through
+				if id, payload, err := gcore.DecodeCall(buf); err == nil {
+					if id != 0 {
+						if !c.calls.done(id, payload) {
+							c.opts.Logger.Debugf("TCP client response of call:%d dropped, no caller", id)
+						}
+						continue
+					}
+					buf = payload
+				}
+			}
 			if err := h.OnReadMsg(c, buf); err != nil {
 				c.opts.Logger.Infof("TCP client OnReadMsg error:[%v]", err)
 				return
@@ -188,52 +481,64 @@ func (c *AsyncClient) handleReadLoop() {
 	}
 }
 
-func (c *AsyncClient) handleWriteLoop() {
+// isHeartBeat whether data is HeartData
+func (c *AsyncClient) isHeartBeat(data []byte) bool {
+	return len(c.opts.HeartData) > 0 && bytes.Equal(data, c.opts.HeartData)
+}
+
+func (c *AsyncClient) handleWriteLoop(down chan struct{}) {
 	defer func() {
 		c.wwg.Done()
-		c.Close()
+		c.loopExit()
 	}()
 
+	// frames left by the previous conn when reconnected
+	if !c.writeQueued() {
+		return
+	}
 	for {
 		select {
 		case <-c.opts.Ctx.Done():
 			return
 		case <-c.closeChan:
 			return
-		case data, ok := <-c.sendChan:
-			if !ok {
-				return
-			}
-			err := c.write(data)
-			if err != nil {
-				c.opts.Handler.OnWriteError(c, data, err)
+		case <-down:
+			return
+		case <-c.queue.Ready():
+			if !c.writeQueued() {
 				return
 			}
 		}
 	}
 }
 
-func (c *AsyncClient) handleWriteLoopWithHeartbeat() {
+func (c *AsyncClient) handleWriteLoopWithHeartbeat(down chan struct{}) {
 	timer := time.NewTimer(c.opts.HeartInterval)
 	defer func() {
 		timer.Stop()
 		c.wwg.Done()
-		c.Close()
+		c.loopExit()
 	}()
 
+	heart := c.opts.HeaderCodec.Encode(c.opts.HeartData)
+	if heart == nil {
+		c.opts.Logger.Errorf("TCP client encode heartbeat error:[%v]", gcore.ErrTooLarge)
+		return
+	}
+	// frames left by the previous conn when reconnected
+	if !c.writeQueued() {
+		return
+	}
 	for {
 		select {
 		case <-c.opts.Ctx.Done():
 			return
 		case <-c.closeChan:
 			return
-		case data, ok := <-c.sendChan:
-			if !ok {
-				return
-			}
-			err := c.write(data)
-			if err != nil {
-				c.opts.Handler.OnWriteError(c, data, err)
+		case <-down:
+			return
+		case <-c.queue.Ready():
+			if !c.writeQueued() {
 				return
 			}
 			continue
@@ -252,17 +557,15 @@ func (c *AsyncClient) handleWriteLoopWithHeartbeat() {
 			return
 		case <-c.closeChan:
 			return
-		case data, ok := <-c.sendChan:
-			if !ok {
-				return
-			}
-			err := c.write(data)
-			if err != nil {
-				c.opts.Handler.OnWriteError(c, data, err)
+		case <-down:
+			return
+		case <-c.queue.Ready():
+			if !c.writeQueued() {
 				return
 			}
 		case <-timer.C:
-			if err := c.write(c.opts.HeartData); err != nil {
+			c.stats.Heartbeat()
+			if err := c.write(heart); err != nil {
 				if err != io.EOF {
 					c.opts.Logger.Infof("TCP client write heartbeat error:[%v]", err)
 				}
@@ -279,9 +582,24 @@ func (c *AsyncClient) getWriteDeadLine() (t time.Time) {
 	return
 }
 
+// writeQueued writes the frames in the send queue until empty, returns false on error
+func (c *AsyncClient) writeQueued() bool {
+	failed, err := c.writer.WriteQueued(c.queue, c.getWriteDeadLine)
+	if err != nil {
+		for _, f := range failed {
+			c.opts.Handler.OnWriteError(c, f.Body, err)
+		}
+		return false
+	}
+	return true
+}
+
 func (c *AsyncClient) write(data []byte) (err error) {
-	data = c.opts.HeaderCodec.Encode(data)
 	_ = c.conn.SetWriteDeadline(c.getWriteDeadLine())
-	_, err = c.conn.Write(data)
+	n, err := c.conn.Write(data)
+	c.stats.Written(0, n)
+	if err != nil {
+		c.stats.WriteFailed()
+	}
 	return
 }
@@ -0,0 +1,95 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package client
+
+import (
+	"sync"
+)
+
+type callResult struct {
+	data []byte
+	err  error
+}
+
+// callTable in-flight calls of a multiplexed AsyncClient, keyed by request ID
+type callTable struct {
+	mu    sync.Mutex
+	seq   uint32
+	calls map[uint32]chan callResult
+}
+
+func newCallTable() *callTable {
+	return &callTable{
+		calls: make(map[uint32]chan callResult),
+	}
+}
+
+// add registers a new call, returns its request ID and the channel to receive the response
+func (t *callTable) add() (uint32, chan callResult) {
+	ch := make(chan callResult, 1)
+	t.mu.Lock()
+	for {
+		t.seq++
+		// 0 is reserved for one-way messages
+		if t.seq == 0 {
+			continue
+		}
+		if _, ok := t.calls[t.seq]; !ok {
+			break
+		}
+	}
+	id := t.seq
+	t.calls[id] = ch
+	t.mu.Unlock()
+	return id, ch
+}
+
+func (t *callTable) remove(id uint32) {
+	t.mu.Lock()
+	delete(t.calls, id)
+	t.mu.Unlock()
+}
+
+// done delivers the response of call id, returns false if the call does not exist,
+// e.g. it has been canceled
+func (t *callTable) done(id uint32, data []byte) bool {
+	t.mu.Lock()
+	ch, ok := t.calls[id]
+	if ok {
+		delete(t.calls, id)
+	}
+	t.mu.Unlock()
+	if ok {
+		ch <- callResult{data: data}
+	}
+	return ok
+}
+
+// failAll fails all in-flight calls with err
+func (t *callTable) failAll(err error) {
+	t.mu.Lock()
+	calls := t.calls
+	t.calls = make(map[uint32]chan callResult)
+	t.mu.Unlock()
+	for _, ch := range calls {
+		ch <- callResult{err: err}
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package client
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/tcp/internal"
+)
+
+// dial connects to opts.Addr with opts.Socket applied,
+// performs the TLS handshake if opts.TLSConfig is set
+func dial(opts *gcore.Options) (net.Conn, error) {
+	conn, err := internal.Dial(opts.Addr, &opts.Socket)
+	if err != nil {
+		return nil, err
+	}
+	if opts.TLSConfig == nil {
+		return conn, nil
+	}
+	cfg := opts.TLSConfig
+	// the same as tls.Dial, ServerName must be set for unix socket addresses
+	if cfg.ServerName == "" && !internal.IsUnixAddr(opts.Addr) {
+		host, _, err := net.SplitHostPort(opts.Addr)
+		if err != nil {
+			host = opts.Addr
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+	tc := tls.Client(conn, cfg)
+	if err = tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
@@ -21,6 +21,8 @@
 package client
 
 import (
+	"context"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"net"
@@ -28,35 +30,51 @@ import (
 	"time"
 
 	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/connstat"
+	"github.com/izhw/gnet/internal/metric"
+	"github.com/izhw/gnet/internal/registry"
 	"github.com/izhw/gnet/tcp/internal"
 )
 
 var _ gcore.Conn = &Client{}
 
 type Client struct {
-	opts   gcore.Options
-	conn   net.Conn
-	buffer *internal.ReaderBuffer
-	closed int32
-	tag    string
+	id      uint64
+	opts    gcore.Options
+	conn    net.Conn
+	buffer  *internal.ReaderBuffer
+	metrics *metric.Client
+	stats   *connstat.Stats
+	closed  int32
+	tag     string
 }
 
 func NewClient() *Client {
-	return &Client{}
+	return &Client{
+		id: registry.NextID(),
+	}
 }
 
 func (c *Client) WithOptions(opts gcore.Options) {
 	c.opts = opts
 }
 
+func (c *Client) ID() uint64 {
+	return c.id
+}
+
 func (c *Client) Init(opts ...gcore.Option) error {
 	for _, opt := range opts {
 		opt(&c.opts)
 	}
-	conn, err := net.Dial("tcp", c.opts.Addr)
+	c.metrics = metric.NewClient(&c.opts)
+	conn, err := dial(&c.opts)
 	if err != nil {
+		c.metrics.ConnectErrors.Add(1)
 		return err
 	}
+	c.metrics.Connects.Add(1)
+	c.stats = connstat.NewStats(&c.metrics.IO)
 	c.conn = conn
 	c.buffer = internal.NewReaderBuffer(c.conn, int(c.opts.InitReadBufLen), int(c.opts.MaxReadBufLen))
 	return nil
@@ -65,54 +83,93 @@ func (c *Client) Init(opts ...gcore.Option) error {
 // Read
 func (c *Client) Read(buf []byte) (n int, err error) {
 	_ = c.conn.SetReadDeadline(c.getReadDeadLine())
-	return c.conn.Read(buf)
+	n, err = c.conn.Read(buf)
+	c.stats.Read(n, c.buffer.Cap())
+	return
 }
 
 // ReadFull
 // On return, n == len(buf) if and only if err == nil.
 func (c *Client) ReadFull(buf []byte) (n int, err error) {
 	_ = c.conn.SetReadDeadline(c.getReadDeadLine())
-	return io.ReadFull(c.conn, buf)
+	n, err = io.ReadFull(c.conn, buf)
+	c.stats.Read(n, c.buffer.Cap())
+	return
 }
 
-// WriteRead using HeaderCodec
+// WriteRead using HeaderCodec, data is passed through the interceptors
 // returning msg body, without header
 func (c *Client) WriteRead(data []byte) (body []byte, err error) {
-	data = c.opts.HeaderCodec.Encode(data)
-	_ = c.conn.SetWriteDeadline(c.getWriteDeadLine())
-	if _, err := c.conn.Write(data); err != nil {
+	err = gcore.InterceptWrite(c.opts.Interceptors, c, data, func(_ gcore.Conn, data []byte) error {
+		return c.write(context.Background(), data)
+	})
+	if err != nil {
 		return nil, fmt.Errorf("write:%w", err)
 	}
 
 	_ = c.conn.SetReadDeadline(c.getReadDeadLine())
 	for {
-		if _, err := c.buffer.ReadFromReader(); err != nil {
+		n, err := c.buffer.ReadFromReader()
+		c.stats.Read(n, c.buffer.Cap())
+		if err != nil {
 			return nil, fmt.Errorf("read:%w", err)
 		}
-		bodyLen, headerLen := c.opts.HeaderCodec.Decode(c.buffer.Data())
-		if headerLen == 0 {
-			continue
+		buf, ok, err := c.buffer.ReadFrame(c.opts.HeaderCodec, c.opts.MaxReadBufLen)
+		if err != nil {
+			return nil, err
 		}
-		msgLen := bodyLen + headerLen
-		if msgLen > c.opts.MaxReadBufLen {
-			return nil, gcore.ErrTooLarge
-		}
-		if uint32(c.buffer.Len()) < msgLen {
+		if !ok {
 			continue
 		}
-		buf := make([]byte, bodyLen)
-		c.buffer.Read(int(headerLen), int(bodyLen), buf)
+		c.stats.MsgRead()
 		return buf, nil
 	}
 }
 
-// Write using HeaderCodec
+// Write using HeaderCodec, data is passed through the interceptors
 func (c *Client) Write(data []byte) error {
+	return gcore.InterceptWrite(c.opts.Interceptors, c, data, func(_ gcore.Conn, data []byte) error {
+		return c.write(context.Background(), data)
+	})
+}
+
+// TryWrite same as Write, Client has no send queue
+func (c *Client) TryWrite(data []byte) error {
+	return c.Write(data)
+}
+
+// WriteContext is like Write, the write deadline is the earlier of WriteTimeout and the deadline of ctx
+func (c *Client) WriteContext(ctx context.Context, data []byte) error {
+	return gcore.InterceptWrite(c.opts.Interceptors, c, data, func(_ gcore.Conn, data []byte) error {
+		return c.write(ctx, data)
+	})
+}
+
+func (c *Client) write(ctx context.Context, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	data = c.opts.HeaderCodec.Encode(data)
-	_ = c.conn.SetWriteDeadline(c.getWriteDeadLine())
-	if _, err := c.conn.Write(data); err != nil {
+	if data == nil {
+		return gcore.ErrTooLarge
+	}
+	t := c.getWriteDeadLine()
+	if d, ok := ctx.Deadline(); ok && (t.IsZero() || d.Before(t)) {
+		t = d
+	}
+	_ = c.conn.SetWriteDeadline(t)
+	return c.writeFrame(data)
+}
+
+// writeFrame writes an encoded frame
+func (c *Client) writeFrame(frame []byte) error {
+	n, err := c.conn.Write(frame)
+	if err != nil {
+		c.stats.Written(0, n)
+		c.stats.WriteFailed()
 		return err
 	}
+	c.stats.Written(1, n)
 	return nil
 }
 
@@ -134,6 +191,20 @@ func (c *Client) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
+func (c *Client) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Client) PeerCertificates() []*x509.Certificate {
+	return internal.PeerCertificates(c.conn)
+}
+
+// Stats the send queue fields are zero, as Client has no send queue
+func (c *Client) Stats() (st gcore.ConnStats) {
+	c.stats.Fill(&st)
+	return
+}
+
 func (c *Client) SetTag(tag string) {
 	c.tag = tag
 }
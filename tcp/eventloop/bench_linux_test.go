@@ -0,0 +1,90 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package eventloop_test
+
+import (
+	"testing"
+
+	"github.com/izhw/gnet"
+	"github.com/izhw/gnet/gcore"
+)
+
+type echoHandler struct {
+	*gcore.NetEventHandler
+}
+
+func (h *echoHandler) OnReadMsg(c gcore.Conn, data []byte) error {
+	return c.Write(data)
+}
+
+// BenchmarkEcho compares the echo throughput of the event-loop server with the goroutine-per-conn one,
+// memory of idle conns is measured by examples/tcp/bench
+//
+//	go test -run NONE -bench Echo -cpu 1,8 ./tcp/eventloop
+func BenchmarkEcho(b *testing.B) {
+	modes := []struct {
+		name string
+		typ  gcore.ServiceType
+		addr string
+	}{
+		{"goroutine", gcore.SvcTypeTCPServer, "127.0.0.1:17790"},
+		{"eventloop", gcore.SvcTypeTCPEventLoopServer, "127.0.0.1:17791"},
+	}
+	for _, m := range modes {
+		b.Run(m.name, func(b *testing.B) {
+			benchEcho(b, m.typ, m.addr)
+		})
+	}
+}
+
+func benchEcho(b *testing.B, typ gcore.ServiceType, addr string) {
+	s := gnet.NewService(
+		gcore.WithServiceType(typ),
+		gcore.WithAddr(addr),
+		gcore.WithEventHandler(&echoHandler{}),
+	).Server()
+	if err := s.Init(); err != nil {
+		b.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Stop()
+
+	data := make([]byte, 64)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		c := gnet.NewService(
+			gcore.WithServiceType(gcore.SvcTypeTCPClient),
+			gcore.WithAddr(addr),
+		).Client()
+		if err := c.Init(); err != nil {
+			b.Error(err)
+			return
+		}
+		defer c.Close()
+		for pb.Next() {
+			if _, err := c.WriteRead(data); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
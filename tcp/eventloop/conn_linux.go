@@ -0,0 +1,325 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package eventloop
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/connstat"
+	"github.com/izhw/gnet/internal/frame"
+	"github.com/izhw/gnet/internal/registry"
+	"github.com/izhw/gnet/tcp/internal"
+)
+
+var _ gcore.Conn = &Conn{}
+
+type Conn struct {
+	id         uint64
+	l          *loop
+	fd         int
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	in         []byte // unprocessed inbound data, nil unless a frame is incomplete
+	lastRead   int64  // unix nano, only accessed by the loop
+	queue      *internal.SendQueue
+	stats      *connstat.Stats
+	heart      *connstat.HeartWatch // only accessed by the loop
+	out        [][]byte             // unwritten part of the batch being written, only accessed by the loop
+	outSince   int64                // unix nano, time out became non-empty or last write progress, only accessed by the loop
+	queued     int32                // a flush is posted to the loop
+	reading    int32                // the loop is handling data read, it flushes c after
+	events     uint32               // registered epoll events, only accessed by the loop
+	draining   int32                // reading is stopped by Server.Shutdown
+	tasks      int32                // number of msgs dispatched to workers and not handled
+	closed     int32
+	tagMu      sync.Mutex // guards tag and registered
+	tag        string
+	registered bool // c is in the registry of the server
+}
+
+func newConn(l *loop, fd int, remoteAddr, localAddr net.Addr) *Conn {
+	return &Conn{
+		id:         registry.NextID(),
+		l:          l,
+		fd:         fd,
+		remoteAddr: remoteAddr,
+		localAddr:  localAddr,
+		lastRead:   time.Now().UnixNano(),
+		queue:      internal.NewSendQueue(l.s.opts.SendQueueLen, l.s.opts.SendQueueBytes, nil),
+		stats:      connstat.NewStats(&l.s.metrics.IO),
+	}
+}
+
+func (c *Conn) ID() uint64 {
+	return c.id
+}
+
+func (c *Conn) Init(opts ...gcore.Option) error {
+	return nil
+}
+
+func (c *Conn) Read(buf []byte) (n int, err error) {
+	return 0, gcore.ErrConnInvalidCall
+}
+
+func (c *Conn) ReadFull(buf []byte) (n int, err error) {
+	return 0, gcore.ErrConnInvalidCall
+}
+
+func (c *Conn) WriteRead(req []byte) (body []byte, err error) {
+	return nil, gcore.ErrConnInvalidCall
+}
+
+// Write encodes data with HeaderCodec and queues it, the loop of c writes it out.
+// It never blocks, as it may be called in the loop, SendQueueBlock behaves like
+// SendQueueDropNewest. Safe for concurrent use.
+func (c *Conn) Write(data []byte) error {
+	return c.enqueue(data)
+}
+
+func (c *Conn) TryWrite(data []byte) error {
+	return c.enqueue(data)
+}
+
+// WriteContext same as Write, ctx is not used as it never blocks
+func (c *Conn) WriteContext(ctx context.Context, data []byte) error {
+	return c.enqueue(data)
+}
+
+// enqueue passes data through the interceptors and queues it
+func (c *Conn) enqueue(data []byte) error {
+	if is := c.l.s.opts.Interceptors; len(is) > 0 {
+		return gcore.InterceptWrite(is, c, data, func(_ gcore.Conn, data []byte) error {
+			return c.send(data)
+		})
+	}
+	return c.send(data)
+}
+
+// send encodes data and queues it
+func (c *Conn) send(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	f, err := internal.EncodeFrame(c.l.s.opts.HeaderCodec, data)
+	if err != nil {
+		return err
+	}
+	return c.push(f, c.l.s.opts.SendQueuePolicy)
+}
+
+// push queues the encoded frame f with policy, and posts a flush if not posted
+func (c *Conn) push(f internal.Frame, policy gcore.SendQueuePolicy) error {
+	if c.Closed() {
+		return gcore.ErrConnClosed
+	}
+	full, err := c.queue.Push(context.Background(), f, policy, false)
+	if full {
+		c.l.s.metrics.SendQueueFull.Add(1)
+		if h, ok := c.l.s.opts.Handler.(gcore.SendQueueFullHandler); ok {
+			h.OnSendQueueFull(c, f.Body)
+		}
+	}
+	if err != nil {
+		if policy == gcore.SendQueueClose {
+			c.l.s.opts.Logger.Infof("EventLoop conn:%d %s send queue full, closing", c.id, c.remoteAddr)
+			c.abort()
+		}
+		return err
+	}
+	// e.g. replies written by OnReadMsg in the loop, no need to wake it up
+	if atomic.LoadInt32(&c.reading) == 1 {
+		return nil
+	}
+	if atomic.CompareAndSwapInt32(&c.queued, 0, 1) {
+		c.l.post(func() {
+			c.l.flush(c)
+		})
+	}
+	return nil
+}
+
+// abort closes c asynchronously in its loop, queued data is dropped
+func (c *Conn) abort() {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return
+	}
+	c.l.post(func() {
+		c.l.closeConn(c)
+	})
+}
+
+// onIdle called by the heart keeper when c has received nothing for HeartTimeout
+func (c *Conn) onIdle() {
+	c.l.post(func() {
+		if c.Closed() {
+			return
+		}
+		c.l.s.opts.Logger.Infof("EventLoop conn:%d %s idle timeout, closing", c.id, c.remoteAddr)
+		if h, ok := c.l.s.opts.Handler.(gcore.IdleTimeoutHandler); ok {
+			h.OnIdleTimeout(c)
+		}
+		atomic.StoreInt32(&c.closed, 1)
+		c.l.flush(c)
+		c.l.closeConn(c)
+	})
+}
+
+// ping called by the heart keeper when c is silent for HeartPingInterval
+func (c *Conn) ping() {
+	_ = c.TryWrite(c.l.s.opts.HeartData)
+}
+
+// Close closes c asynchronously in its loop, queued data is flushed as far as possible
+func (c *Conn) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	c.l.post(func() {
+		c.l.flush(c)
+		c.l.closeConn(c)
+	})
+	return nil
+}
+
+func (c *Conn) Closed() bool {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return true
+	}
+	return false
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// PeerCertificates TLS is not supported by the event-loop server
+func (c *Conn) PeerCertificates() []*x509.Certificate {
+	return nil
+}
+
+// Stats ReadBufLen is the length of the buffer holding an incomplete frame,
+// as the read buffer is shared by the conns of a loop
+func (c *Conn) Stats() (st gcore.ConnStats) {
+	c.stats.Fill(&st)
+	st.SendQueueLen, st.SendQueueBytes = c.queue.Size()
+	return
+}
+
+func (c *Conn) SetTag(tag string) {
+	c.tagMu.Lock()
+	if c.registered {
+		c.l.s.conns.Retag(c, c.tag, tag)
+	}
+	c.tag = tag
+	c.tagMu.Unlock()
+}
+
+func (c *Conn) GetTag() string {
+	c.tagMu.Lock()
+	defer c.tagMu.Unlock()
+	return c.tag
+}
+
+func (c *Conn) register() {
+	c.tagMu.Lock()
+	c.l.s.conns.Add(c, c.tag)
+	c.registered = true
+	c.tagMu.Unlock()
+}
+
+func (c *Conn) unregister() {
+	c.tagMu.Lock()
+	c.l.s.conns.Remove(c, c.tag)
+	c.registered = false
+	c.tagMu.Unlock()
+}
+
+func (c *Conn) isDraining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
+
+// taskDone called by workers after a msg is handled,
+// c is closed by flush when it is draining and all msgs are handled
+func (c *Conn) taskDone() {
+	if atomic.AddInt32(&c.tasks, -1) == 0 && c.isDraining() {
+		c.l.post(func() {
+			c.l.flush(c)
+		})
+	}
+}
+
+// handleData decodes frames from data and calls OnReadMsg,
+// returns the bytes of an incomplete frame
+func (c *Conn) handleData(data []byte) ([]byte, error) {
+	s := c.l.s
+	for len(data) > 0 && !c.Closed() && !c.isDraining() {
+		body, n, err := frame.Decode(s.opts.HeaderCodec, data, s.opts.MaxReadBufLen)
+		if err != nil {
+			s.opts.Logger.Errorf("EventLoop conn decode error:[%v]", err)
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		// data is reused by the loop, the handler may retain buf
+		buf := make([]byte, len(body))
+		copy(buf, body)
+		data = data[n:]
+		if s.heartLen > 0 && uint32(len(buf)) == s.heartLen {
+			if s.isHeartBeat(buf) {
+				c.stats.Heartbeat()
+				if s.opts.HeartPingInterval <= 0 {
+					_ = c.Write(buf)
+				}
+				continue
+			}
+		}
+		c.stats.MsgRead()
+		if s.workers != nil {
+			atomic.AddInt32(&c.tasks, 1)
+			if err := s.workers.Dispatch(c, buf, nil, c.taskDone); err != nil {
+				s.opts.Logger.Infof("EventLoop conn dispatch error:[%v]", err)
+				return nil, err
+			}
+			continue
+		}
+		if err := s.opts.Handler.OnReadMsg(c, buf); err != nil {
+			s.opts.Logger.Infof("EventLoop conn OnReadMsg error:[%v]", err)
+			return nil, err
+		}
+		// replies of many msgs in one read may fill the send queue before the posted flush runs
+		if c.queue.HalfFull() {
+			c.l.flush(c)
+		}
+	}
+	return data, nil
+}
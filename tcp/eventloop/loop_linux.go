@@ -0,0 +1,402 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package eventloop
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/tcp/internal"
+)
+
+const (
+	readEvents  = syscall.EPOLLIN | syscall.EPOLLRDHUP
+	writeEvents = readEvents | syscall.EPOLLOUT
+	// sweepInterval interval of checking read and write timeouts
+	sweepInterval = time.Second
+)
+
+// loop an epoll instance driven by one goroutine,
+// all conns registered on it are read, written and closed in that goroutine.
+// The epoll fd is waited for by the Go netpoller as a nested epoll, so the loop
+// doesn't hold a P while waiting like a blocking epoll_wait does.
+type loop struct {
+	s        *Server
+	epfd     int
+	ep       *os.File // owns epfd
+	raw      syscall.RawConn
+	evfd     int
+	buf      []byte           // read buffer shared by all conns of the loop
+	frames   []internal.Frame // write batch buffer
+	iovs     []syscall.Iovec  // writev buffer
+	conns    map[int]*Conn
+	mu       sync.Mutex
+	tasks    []func() // guarded by mu
+	exited   bool     // the loop goroutine has exited, guarded by mu
+	notified int32
+	stopped  bool
+}
+
+func newLoop(s *Server, bufLen int) (*loop, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	evfd, err := newEventFd()
+	if err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+	if err = epollCtl(epfd, syscall.EPOLL_CTL_ADD, evfd, syscall.EPOLLIN); err != nil {
+		syscall.Close(evfd)
+		syscall.Close(epfd)
+		return nil, err
+	}
+	// NewFile registers a non-blocking fd in the netpoller
+	if err = syscall.SetNonblock(epfd, true); err != nil {
+		syscall.Close(evfd)
+		syscall.Close(epfd)
+		return nil, err
+	}
+	ep := os.NewFile(uintptr(epfd), "epoll")
+	raw, err := ep.SyscallConn()
+	if err != nil {
+		syscall.Close(evfd)
+		ep.Close()
+		return nil, err
+	}
+	return &loop{
+		s:     s,
+		epfd:  epfd,
+		ep:    ep,
+		raw:   raw,
+		evfd:  evfd,
+		buf:   make([]byte, bufLen),
+		conns: make(map[int]*Conn),
+	}, nil
+}
+
+// post runs task in the loop goroutine, safe for concurrent use
+func (l *loop) post(task func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// e.g. a flush posted by Write or a worker after the server is stopped
+	if l.exited {
+		return
+	}
+	l.tasks = append(l.tasks, task)
+	if atomic.CompareAndSwapInt32(&l.notified, 0, 1) {
+		if err := writeEventFd(l.evfd); err != nil {
+			l.s.opts.Logger.Errorf("EventLoop wakeup error:[%v]", err)
+		}
+	}
+}
+
+func (l *loop) runTasks() {
+	l.mu.Lock()
+	tasks := l.tasks
+	l.tasks = nil
+	l.mu.Unlock()
+	for _, task := range tasks {
+		task()
+	}
+}
+
+// register adds a new accepted fd to the loop
+func (l *loop) register(c *Conn) {
+	if l.stopped {
+		syscall.Close(c.fd)
+		l.s.onConnClose()
+		return
+	}
+	if err := epollCtl(l.epfd, syscall.EPOLL_CTL_ADD, c.fd, readEvents); err != nil {
+		l.s.opts.Logger.Errorf("EventLoop register conn:%s error:[%v]", c.remoteAddr, err)
+		syscall.Close(c.fd)
+		l.s.onConnClose()
+		return
+	}
+	c.events = readEvents
+	l.conns[c.fd] = c
+	c.heart = l.s.heart.Watch(c.stats, c.onIdle, c.ping)
+	c.register()
+	l.s.opts.Handler.OnOpened(c)
+}
+
+func (l *loop) run() {
+	defer func() {
+		l.mu.Lock()
+		l.exited = true
+		l.tasks = nil
+		syscall.Close(l.evfd)
+		l.mu.Unlock()
+		l.ep.Close()
+		l.s.wg.Done()
+	}()
+
+	events := make([]syscall.EpollEvent, 1024)
+	lastSweep := time.Now()
+	_ = l.ep.SetReadDeadline(lastSweep.Add(sweepInterval))
+	for {
+		n, err := l.wait(events)
+		if err != nil && err != syscall.EINTR {
+			l.s.opts.Logger.Errorf("EventLoop epoll wait error:[%v]", err)
+			l.closeAll()
+			return
+		}
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == l.evfd {
+				readEventFd(l.evfd)
+				atomic.StoreInt32(&l.notified, 0)
+				continue
+			}
+			c, ok := l.conns[fd]
+			if !ok {
+				continue
+			}
+			ev := events[i].Events
+			if c.isDraining() && ev&(syscall.EPOLLHUP|syscall.EPOLLERR) != 0 {
+				l.closeConn(c)
+				continue
+			}
+			if !c.isDraining() && ev&(syscall.EPOLLIN|syscall.EPOLLRDHUP|syscall.EPOLLHUP|syscall.EPOLLERR) != 0 {
+				if err := l.read(c); err != nil {
+					if err != io.EOF {
+						l.s.opts.Logger.Debugf("EventLoop conn read error:[%v]", err)
+					}
+					atomic.StoreInt32(&c.closed, 1)
+					l.closeConn(c)
+					continue
+				}
+			}
+			if ev&syscall.EPOLLOUT != 0 {
+				l.flush(c)
+			}
+		}
+		l.runTasks()
+		if l.stopped {
+			l.closeAll()
+			return
+		}
+		if now := time.Now(); now.Sub(lastSweep) >= sweepInterval {
+			lastSweep = now
+			l.sweep(now.UnixNano())
+			_ = l.ep.SetReadDeadline(now.Add(sweepInterval))
+		}
+	}
+}
+
+// wait polls events without blocking, then waits in the netpoller until epfd is readable,
+// it returns no events when the read deadline, the next sweep, is reached
+func (l *loop) wait(events []syscall.EpollEvent) (n int, err error) {
+	var werr error
+	err = l.raw.Read(func(fd uintptr) bool {
+		n, werr = syscall.EpollWait(int(fd), events, 0)
+		return n != 0 || werr != nil
+	})
+	if err != nil {
+		if os.IsTimeout(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return n, werr
+}
+
+func (l *loop) read(c *Conn) error {
+	n, err := syscall.Read(c.fd, l.buf)
+	if err != nil {
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			return nil
+		}
+		return err
+	}
+	if n == 0 {
+		return io.EOF
+	}
+	c.lastRead = time.Now().UnixNano()
+	data := l.buf[:n]
+	if len(c.in) > 0 {
+		c.in = append(c.in, data...)
+		data = c.in
+	}
+	c.stats.Read(n, cap(c.in))
+	// frames pushed while reading is set are flushed below instead of being posted,
+	// a push seeing it set happens before it is cleared
+	atomic.StoreInt32(&c.reading, 1)
+	rest, err := c.handleData(data)
+	atomic.StoreInt32(&c.reading, 0)
+	if err != nil {
+		return err
+	}
+	if len(rest) == 0 {
+		c.in = nil
+	} else if len(c.in) > 0 {
+		// rest is the tail of c.in
+		c.in = c.in[:copy(c.in, rest)]
+	} else {
+		c.in = append([]byte(nil), rest...)
+	}
+	if c.queue.Len() > 0 {
+		l.flush(c)
+	}
+	return nil
+}
+
+// flush writes queued data of c until EAGAIN, EPOLLOUT is registered if data remains
+func (l *loop) flush(c *Conn) {
+	// the fd may have been closed and reused by a new conn
+	if l.conns[c.fd] != c {
+		return
+	}
+	atomic.StoreInt32(&c.queued, 0)
+	wasPending := len(c.out) > 0
+	progress := false
+	var err error
+	for {
+		if len(c.out) == 0 {
+			l.frames = c.queue.PopBatch(l.frames[:0], l.s.opts.WriteBatchBytes)
+			if len(l.frames) == 0 {
+				break
+			}
+			for i, f := range l.frames {
+				c.out = f.AppendTo(c.out)
+				l.frames[i] = internal.Frame{}
+			}
+			c.stats.Written(len(l.frames), 0)
+		}
+		var n int
+		n, l.iovs, err = writev(c.fd, c.out, l.iovs)
+		// also drops empty buffers
+		c.out = consume(c.out, n)
+		if n > 0 {
+			progress = true
+			c.stats.Written(0, n)
+		}
+		if err != nil {
+			if err == syscall.EINTR {
+				err = nil
+				continue
+			}
+			if err == syscall.EAGAIN {
+				err = nil
+			}
+			break
+		}
+	}
+	if len(c.out) == 0 {
+		c.out = nil
+	}
+	pending := len(c.out) > 0
+	if pending && (progress || !wasPending) {
+		c.outSince = time.Now().UnixNano()
+	}
+
+	if err != nil {
+		c.stats.WriteFailed()
+		l.s.opts.Handler.OnWriteError(c, nil, err)
+		atomic.StoreInt32(&c.closed, 1)
+		l.closeConn(c)
+		return
+	}
+	var events uint32
+	switch {
+	case c.isDraining() && !pending && atomic.LoadInt32(&c.tasks) == 0:
+		l.closeConn(c)
+		return
+	case c.isDraining() && pending:
+		events = syscall.EPOLLOUT
+	case c.isDraining():
+		// waits for the workers, see Conn.taskDone
+		events = 0
+	case pending:
+		events = writeEvents
+	default:
+		events = readEvents
+	}
+	if events != c.events {
+		if err := epollCtl(l.epfd, syscall.EPOLL_CTL_MOD, c.fd, events); err != nil {
+			l.s.opts.Logger.Warnf("EventLoop conn:%s epoll modify error:[%v]", c.remoteAddr, err)
+		}
+		c.events = events
+	}
+}
+
+// closeConn removes c from the loop and closes the fd
+func (l *loop) closeConn(c *Conn) {
+	if l.conns[c.fd] != c {
+		return
+	}
+	atomic.StoreInt32(&c.closed, 1)
+	delete(l.conns, c.fd)
+	_ = syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, c.fd, nil)
+	_ = syscall.Close(c.fd)
+	c.in = nil
+	c.out = nil
+	c.heart.Stop()
+	c.unregister()
+	l.s.opts.Handler.OnClosed(c)
+	l.s.onConnClose()
+}
+
+// shutdown stops reading of all conns, each conn is closed once its queued data is flushed
+func (l *loop) shutdown() {
+	h, _ := l.s.opts.Handler.(gcore.ShutdownHandler)
+	for _, c := range l.conns {
+		if h != nil {
+			h.OnShutdown(c)
+		}
+		atomic.StoreInt32(&c.draining, 1)
+		l.flush(c)
+	}
+}
+
+func (l *loop) closeAll() {
+	for _, c := range l.conns {
+		atomic.StoreInt32(&c.closed, 1)
+		l.flush(c)
+		l.closeConn(c)
+	}
+}
+
+// sweep closes conns whose read or write has timed out
+func (l *loop) sweep(now int64) {
+	readTimeout := l.s.opts.ReadTimeout.Nanoseconds()
+	writeTimeout := l.s.opts.WriteTimeout.Nanoseconds()
+	for _, c := range l.conns {
+		if readTimeout > 0 && !c.isDraining() && now-c.lastRead > readTimeout {
+			l.s.opts.Logger.Debugf("EventLoop conn:%s read timeout", c.remoteAddr)
+			atomic.StoreInt32(&c.closed, 1)
+			l.closeConn(c)
+			continue
+		}
+		if writeTimeout > 0 && len(c.out) > 0 && now-c.outSince > writeTimeout {
+			l.s.opts.Logger.Debugf("EventLoop conn:%s write timeout", c.remoteAddr)
+			atomic.StoreInt32(&c.closed, 1)
+			l.closeConn(c)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// +build !linux
+
+package eventloop
+
+import (
+	"context"
+	"errors"
+
+	"github.com/izhw/gnet/gcore"
+)
+
+var errUnsupported = errors.New("eventloop: only supported on linux")
+
+var _ gcore.Server = &Server{}
+
+// Server is an epoll-based TCP server, only supported on linux
+type Server struct {
+	opts gcore.Options
+}
+
+func NewServer() *Server {
+	return &Server{}
+}
+
+func (s *Server) WithOptions(opts gcore.Options) {
+	s.opts = opts
+}
+
+func (s *Server) Init(opts ...gcore.Option) error {
+	return errUnsupported
+}
+
+func (s *Server) Serve() error {
+	return errUnsupported
+}
+
+func (s *Server) Stop() {
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func (s *Server) ConnNum() uint32 {
+	return 0
+}
+
+func (s *Server) GetConn(id uint64) (gcore.Conn, bool) {
+	return nil, false
+}
+
+func (s *Server) GetConnsByTag(tag string) []gcore.Conn {
+	return nil
+}
+
+func (s *Server) RangeConns(f func(c gcore.Conn) bool) {
+}
+
+func (s *Server) CloseConn(id uint64, reason string) error {
+	return gcore.ErrConnNotFound
+}
+
+func (s *Server) WorkerStats() gcore.WorkerStats {
+	return gcore.WorkerStats{}
+}
+
+func (s *Server) JoinGroup(group string, c gcore.Conn) error {
+	return gcore.ErrConnNotFound
+}
+
+func (s *Server) LeaveGroup(group string, c gcore.Conn) {
+}
+
+func (s *Server) Broadcast(data []byte, policy gcore.SlowReceiverPolicy) (n int, err error) {
+	return 0, errUnsupported
+}
+
+func (s *Server) GroupBroadcast(group string, data []byte, policy gcore.SlowReceiverPolicy) (n int, err error) {
+	return 0, errUnsupported
+}
@@ -0,0 +1,428 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package eventloop
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/connstat"
+	"github.com/izhw/gnet/internal/metric"
+	"github.com/izhw/gnet/internal/registry"
+	"github.com/izhw/gnet/internal/util/delay"
+	"github.com/izhw/gnet/internal/util/limter"
+	"github.com/izhw/gnet/internal/worker"
+	"github.com/izhw/gnet/tcp/internal"
+)
+
+const DefaultAddr = "0.0.0.0:7777"
+
+// minReadBufLen min length of the read buffer shared by the conns of a loop
+const minReadBufLen = 64 * 1024
+
+var _ gcore.Server = &Server{}
+
+// Server is an epoll-based TCP server, connections are spread over
+// a fixed number of event loops instead of two goroutines per connection.
+// TLS is not supported.
+type Server struct {
+	opts     gcore.Options
+	lfds     []int // listening sockets, blocking, more than one with SO_REUSEPORT
+	limiter  limter.Limiter
+	loops    []*loop
+	next     uint32
+	stopChan chan struct{}
+	wg       sync.WaitGroup // event loops
+	awg      sync.WaitGroup // accept goroutines
+	cwg      sync.WaitGroup // conns
+	conns    *registry.Registry
+	workers  *worker.Pool // nil if WorkerNum is 0
+	metrics  *metric.Server
+	heart    *connstat.HeartKeeper // nil if HeartTimeout and HeartPingInterval are 0
+	heartLen uint32
+	connNum  uint32
+	stopped  int32
+}
+
+func NewServer() *Server {
+	return &Server{
+		stopped: 1,
+	}
+}
+
+func (s *Server) WithOptions(opts gcore.Options) {
+	s.opts = opts
+}
+
+func (s *Server) Init(opts ...gcore.Option) error {
+	for _, opt := range opts {
+		opt(&s.opts)
+	}
+	if s.opts.Addr == "" {
+		s.opts.Addr = DefaultAddr
+	}
+	if s.opts.TLSConfig != nil {
+		return errors.New("eventloop: TLS is not supported")
+	}
+	if internal.IsUnixAddr(s.opts.Addr) {
+		return errors.New("eventloop: unix sockets are not supported")
+	}
+	if s.opts.HeartPingInterval > 0 && len(s.opts.HeartData) == 0 {
+		return errors.New("server ping: HeartData not set")
+	}
+	num := s.opts.EventLoopNum
+	if num <= 0 {
+		num = runtime.NumCPU()
+	}
+	bufLen := int(s.opts.InitReadBufLen)
+	if bufLen < minReadBufLen {
+		bufLen = minReadBufLen
+	}
+	s.loops = make([]*loop, 0, num)
+	for i := 0; i < num; i++ {
+		l, err := newLoop(s, bufLen)
+		if err != nil {
+			s.closeLoops()
+			return err
+		}
+		s.loops = append(s.loops, l)
+	}
+	if err := s.listen(); err != nil {
+		s.closeLoops()
+		return err
+	}
+	s.opts.Handler = gcore.WrapHandler(s.opts.Handler, s.opts.Interceptors)
+	if s.opts.ConnLimit > 0 {
+		s.limiter = limter.NewLimiter(s.opts.ConnLimit)
+	}
+	s.stopChan = make(chan struct{})
+	s.conns = registry.New()
+	s.metrics = metric.NewServer(&s.opts)
+	if s.opts.WorkerNum > 0 {
+		s.workers = worker.NewPool(&s.opts)
+	}
+	s.heart = connstat.NewHeartKeeper(s.opts.HeartTimeout, s.opts.HeartPingInterval)
+	s.heartLen = uint32(len(s.opts.HeartData))
+	s.stopped = 0
+
+	return nil
+}
+
+// listen opens ListenerNum listening sockets on Addr, with SO_REUSEPORT if more than one
+func (s *Server) listen() error {
+	num := s.opts.ListenerNum
+	if num < 1 {
+		num = 1
+	}
+	reusePort := num > 1
+	addr := s.opts.Addr
+	s.lfds = make([]int, 0, num)
+	for i := 0; i < num; i++ {
+		fd, err := listen(addr, &s.opts.Socket, reusePort)
+		if err != nil {
+			s.closeListeners()
+			return err
+		}
+		s.lfds = append(s.lfds, fd)
+		if i == 0 {
+			sa, err := syscall.Getsockname(fd)
+			if err != nil {
+				s.closeListeners()
+				return os.NewSyscallError("getsockname", err)
+			}
+			addr = internal.WithPort(addr, sockaddrToTCPAddr(sa).(*net.TCPAddr).Port)
+		}
+	}
+	return nil
+}
+
+// stopListeners wakes up the blocking accepts, waits for the accept goroutines to exit,
+// then closes the listening sockets
+func (s *Server) stopListeners() {
+	for _, fd := range s.lfds {
+		_ = syscall.Shutdown(fd, syscall.SHUT_RDWR)
+	}
+	s.awg.Wait()
+	s.closeListeners()
+}
+
+func (s *Server) closeListeners() {
+	for _, fd := range s.lfds {
+		_ = syscall.Close(fd)
+	}
+}
+
+// closeLoops releases loops which are not running
+func (s *Server) closeLoops() {
+	for _, l := range s.loops {
+		syscall.Close(l.evfd)
+		l.ep.Close()
+	}
+	s.loops = nil
+}
+
+func (s *Server) Serve() error {
+	if atomic.LoadInt32(&s.stopped) == 1 {
+		return errors.New("server uninitialized")
+	}
+	if s.workers != nil {
+		s.workers.Start()
+	}
+	s.heart.Start()
+	for _, l := range s.loops {
+		s.wg.Add(1)
+		go l.run()
+	}
+	for _, fd := range s.lfds {
+		s.awg.Add(1)
+		go s.work(fd)
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(c)
+
+	select {
+	case <-s.opts.Ctx.Done():
+		s.Stop()
+		return s.opts.Ctx.Err()
+	case <-s.stopChan:
+		s.wg.Wait()
+	case sig := <-c:
+		s.Stop()
+		return errors.New("signal:" + sig.String())
+	}
+	return nil
+}
+
+// Stop stops accepting, closes all conns and waits for the loops to exit
+func (s *Server) Stop() {
+	if !atomic.CompareAndSwapInt32(&s.stopped, 0, 1) {
+		return
+	}
+	close(s.stopChan)
+	s.stopListeners()
+	s.stopLoops()
+}
+
+// Shutdown stops accepting, calls OnShutdown of the handler for each conn if implemented,
+// then each conn stops reading, and is closed after its queued data is flushed.
+// Conns which are still open when ctx is done are closed, and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.stopped, 0, 1) {
+		s.wg.Wait()
+		return nil
+	}
+	close(s.stopChan)
+	s.stopListeners()
+	for _, l := range s.loops {
+		l.post(l.shutdown)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.cwg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	s.stopLoops()
+	return err
+}
+
+// stopLoops closes all conns, waits for the loops to exit, then stops the workers and the heart keeper
+func (s *Server) stopLoops() {
+	for _, l := range s.loops {
+		l := l
+		l.post(func() {
+			l.stopped = true
+		})
+	}
+	s.wg.Wait()
+	if s.workers != nil {
+		s.workers.Stop()
+	}
+	s.heart.Stop()
+}
+
+func (s *Server) WorkerStats() gcore.WorkerStats {
+	return s.workers.Stats()
+}
+
+func (s *Server) ConnNum() uint32 {
+	return atomic.LoadUint32(&s.connNum)
+}
+
+func (s *Server) GetConn(id uint64) (gcore.Conn, bool) {
+	return s.conns.Get(id)
+}
+
+func (s *Server) GetConnsByTag(tag string) []gcore.Conn {
+	return s.conns.GetByTag(tag)
+}
+
+func (s *Server) RangeConns(f func(c gcore.Conn) bool) {
+	s.conns.Range(f)
+}
+
+// CloseConn closes the conn with id asynchronously in its loop, reason is logged
+func (s *Server) CloseConn(id uint64, reason string) error {
+	c, ok := s.conns.Get(id)
+	if !ok {
+		return gcore.ErrConnNotFound
+	}
+	s.opts.Logger.Infof("EventLoop server close conn:%d %s, reason:%s", id, c.RemoteAddr(), reason)
+	return c.Close()
+}
+
+func (s *Server) JoinGroup(group string, c gcore.Conn) error {
+	if !s.conns.Join(c, group) {
+		return gcore.ErrConnNotFound
+	}
+	return nil
+}
+
+func (s *Server) LeaveGroup(group string, c gcore.Conn) {
+	s.conns.Leave(c, group)
+}
+
+// Broadcast sends data to all conns, SlowReceiverBlock behaves like SlowReceiverSkip,
+// as the loops can't be blocked
+func (s *Server) Broadcast(data []byte, policy gcore.SlowReceiverPolicy) (n int, err error) {
+	f, err := internal.EncodeFrame(s.opts.HeaderCodec, data)
+	if err != nil {
+		return 0, err
+	}
+	s.conns.Range(func(c gcore.Conn) bool {
+		if s.send(c.(*Conn), f, policy) {
+			n++
+		}
+		return true
+	})
+	return n, nil
+}
+
+// GroupBroadcast sends data to the conns in group, like Broadcast
+func (s *Server) GroupBroadcast(group string, data []byte, policy gcore.SlowReceiverPolicy) (n int, err error) {
+	f, err := internal.EncodeFrame(s.opts.HeaderCodec, data)
+	if err != nil {
+		return 0, err
+	}
+	for _, c := range s.conns.GetGroup(group) {
+		if s.send(c.(*Conn), f, policy) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// send queues the shared frame f to c with policy
+func (s *Server) send(c *Conn, f internal.Frame, policy gcore.SlowReceiverPolicy) bool {
+	p := gcore.SendQueueDropNewest
+	if policy == gcore.SlowReceiverDisconnect {
+		p = gcore.SendQueueClose
+	}
+	return c.push(f, p) == nil
+}
+
+func (s *Server) onConnClose() {
+	if s.limiter != nil {
+		s.limiter.Revert()
+	}
+	atomic.AddUint32(&s.connNum, ^uint32(0))
+	s.metrics.Conns.Add(-1)
+	s.cwg.Done()
+}
+
+// isHeartBeat called when len(data) == len(s.opts.HeartData)
+func (s *Server) isHeartBeat(data []byte) bool {
+	for i := 0; i < len(s.opts.HeartData); i++ {
+		if s.opts.HeartData[i] != data[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// work accepts non-blocking fds from lfd, and dispatches them to the loops in turn,
+// there is one for each listening socket
+func (s *Server) work(lfd int) {
+	defer func() {
+		s.awg.Done()
+		s.Stop()
+	}()
+
+	td := delay.NewTempDelay(5*time.Millisecond, time.Second)
+	for {
+		fd, sa, err := syscall.Accept4(lfd, syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC)
+		if err != nil {
+			select {
+			case <-s.stopChan:
+				return
+			default:
+			}
+			switch err {
+			case syscall.EINTR, syscall.ECONNABORTED:
+				continue
+			case syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM:
+				d := td.GetDelay()
+				s.opts.Logger.Warnf("EventLoop server accept temporary error:[%v], delay:%v", err, d)
+				time.Sleep(d)
+				continue
+			}
+			s.opts.Logger.Errorf("EventLoop server accept error:[%v]", err)
+			return
+		}
+		td.Reset()
+		if s.limiter != nil && !s.limiter.Allow() {
+			syscall.Close(fd)
+			s.metrics.Rejected.Add(1)
+			s.opts.Logger.Warnf("EventLoop server accepted max num:%d, new conn rejected", s.opts.ConnLimit)
+			continue
+		}
+		if err := internal.SetSockopts(fd, &s.opts.Socket); err != nil {
+			s.opts.Logger.Warnf("EventLoop server conn set socket options error:[%v]", err)
+		}
+		atomic.AddUint32(&s.connNum, 1)
+		s.metrics.Accepted.Add(1)
+		s.metrics.Conns.Add(1)
+		s.cwg.Add(1)
+		l := s.loops[atomic.AddUint32(&s.next, 1)%uint32(len(s.loops))]
+		lsa, _ := syscall.Getsockname(fd)
+		c := newConn(l, fd, sockaddrToTCPAddr(sa), sockaddrToTCPAddr(lsa))
+		l.post(func() {
+			l.register(c)
+		})
+	}
+}
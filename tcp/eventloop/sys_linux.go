@@ -0,0 +1,175 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package eventloop
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/tcp/internal"
+)
+
+// maxIovecs IOV_MAX of linux
+const maxIovecs = 1024
+
+func newEventFd() (int, error) {
+	fd, _, errno := syscall.Syscall(syscall.SYS_EVENTFD2, 0, syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+func writeEventFd(fd int) error {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], 1)
+	_, err := syscall.Write(fd, b[:])
+	return err
+}
+
+func readEventFd(fd int) {
+	var b [8]byte
+	_, _ = syscall.Read(fd, b[:])
+}
+
+// writev writes bufs by one syscall, at most maxIovecs of them, iovs is the buffer of iovecs
+func writev(fd int, bufs [][]byte, iovs []syscall.Iovec) (int, []syscall.Iovec, error) {
+	iovs = iovs[:0]
+	for _, b := range bufs {
+		if len(b) == 0 {
+			continue
+		}
+		iov := syscall.Iovec{Base: &b[0]}
+		iov.SetLen(len(b))
+		iovs = append(iovs, iov)
+		if len(iovs) == maxIovecs {
+			break
+		}
+	}
+	if len(iovs) == 0 {
+		return 0, iovs, nil
+	}
+	n, _, errno := syscall.Syscall(syscall.SYS_WRITEV, uintptr(fd), uintptr(unsafe.Pointer(&iovs[0])), uintptr(len(iovs)))
+	for i := range iovs {
+		iovs[i] = syscall.Iovec{}
+	}
+	if errno != 0 {
+		return 0, iovs, errno
+	}
+	return int(n), iovs, nil
+}
+
+// consume removes the first n bytes of bufs
+func consume(bufs [][]byte, n int) [][]byte {
+	for len(bufs) > 0 {
+		if len(bufs[0]) > n {
+			bufs[0] = bufs[0][n:]
+			return bufs
+		}
+		n -= len(bufs[0])
+		bufs[0] = nil
+		bufs = bufs[1:]
+	}
+	return bufs
+}
+
+func epollCtl(epfd, op, fd int, events uint32) error {
+	ev := syscall.EpollEvent{
+		Events: events,
+		Fd:     int32(fd),
+	}
+	return syscall.EpollCtl(epfd, op, fd, &ev)
+}
+
+// listen creates a blocking listening socket on addr, reusePort: sets SO_REUSEPORT
+func listen(addr string, so *gcore.SocketOptions, reusePort bool) (fd int, err error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return -1, err
+	}
+	var sa syscall.Sockaddr
+	family := syscall.AF_INET
+	if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: tcpAddr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else if tcpAddr.IP == nil {
+		// dual-stack wildcard address like net.Listen
+		family = syscall.AF_INET6
+		sa = &syscall.SockaddrInet6{Port: tcpAddr.Port}
+	} else {
+		family = syscall.AF_INET6
+		sa6 := &syscall.SockaddrInet6{Port: tcpAddr.Port}
+		copy(sa6.Addr[:], tcpAddr.IP.To16())
+		if tcpAddr.Zone != "" {
+			if ifi, err := net.InterfaceByName(tcpAddr.Zone); err == nil {
+				sa6.ZoneId = uint32(ifi.Index)
+			}
+		}
+		sa = sa6
+	}
+	fd, err = syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_TCP)
+	if err != nil {
+		return -1, os.NewSyscallError("socket", err)
+	}
+	if family == syscall.AF_INET6 && tcpAddr.IP == nil {
+		_ = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0)
+	}
+	if err = internal.SetListenSockopts(fd, so, reusePort); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	if err = syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return -1, os.NewSyscallError("bind", err)
+	}
+	backlog := so.Backlog
+	if backlog <= 0 {
+		backlog = syscall.SOMAXCONN
+	}
+	if err = syscall.Listen(fd, backlog); err != nil {
+		syscall.Close(fd)
+		return -1, os.NewSyscallError("listen", err)
+	}
+	return fd, nil
+}
+
+func sockaddrToTCPAddr(sa syscall.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, sa.Addr[:])
+		return &net.TCPAddr{IP: ip, Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		var zone string
+		if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+			zone = ifi.Name
+		}
+		return &net.TCPAddr{IP: ip, Port: sa.Port, Zone: zone}
+	}
+	return nil
+}
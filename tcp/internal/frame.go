@@ -0,0 +1,69 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package internal
+
+import (
+	"github.com/izhw/gnet/codec"
+	"github.com/izhw/gnet/gcore"
+)
+
+// Frame a msg queued for sending, it is Header + Body if Data is nil.
+// Frames may be shared by conns.
+type Frame struct {
+	Body   []byte // msg
+	Header []byte // header encoded by codec.HeaderEncoder
+	Data   []byte // encoded msg, if hc is not a codec.HeaderEncoder
+}
+
+// EncodeFrame encodes body with hc, body is not copied if hc is a codec.HeaderEncoder
+func EncodeFrame(hc codec.HeaderCodec, body []byte) (Frame, error) {
+	if he, ok := hc.(codec.HeaderEncoder); ok {
+		header, ok := he.AppendHeader(nil, len(body))
+		if !ok {
+			return Frame{}, gcore.ErrTooLarge
+		}
+		return Frame{Body: body, Header: header}, nil
+	}
+	data := hc.Encode(body)
+	if data == nil {
+		return Frame{}, gcore.ErrTooLarge
+	}
+	return Frame{Body: body, Data: data}, nil
+}
+
+// Len returns the length of the encoded frame
+func (f Frame) Len() int {
+	if f.Data != nil {
+		return len(f.Data)
+	}
+	return len(f.Header) + len(f.Body)
+}
+
+// AppendTo appends the encoded parts of f to bufs
+func (f Frame) AppendTo(bufs [][]byte) [][]byte {
+	if f.Data != nil {
+		return append(bufs, f.Data)
+	}
+	if len(f.Header) > 0 {
+		bufs = append(bufs, f.Header)
+	}
+	return append(bufs, f.Body)
+}
@@ -0,0 +1,327 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/izhw/gnet/gcore"
+)
+
+const (
+	proxyV1Prefix    = "PROXY "
+	proxyV1MaxLen    = 107 // including CRLF
+	proxyV2HeaderLen = 16
+)
+
+var (
+	proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// ProxyConn reads the PROXY protocol header at the beginning of a conn by ReadHeader,
+// the bytes read after the header are read first
+type ProxyConn struct {
+	net.Conn
+	rest   []byte
+	header atomic.Value // *gcore.ProxyHeader
+}
+
+func NewProxyConn(conn net.Conn) *ProxyConn {
+	return &ProxyConn{Conn: conn}
+}
+
+// ReadHeader reads the header, called before reading. A conn without one is an error
+// unless optional is set.
+func (c *ProxyConn) ReadHeader(optional bool) error {
+	h, rest, err := ReadProxyHeader(c.Conn)
+	if err != nil {
+		return err
+	}
+	if h == nil && !optional {
+		return gcore.ErrMissingProxyHeader
+	}
+	c.rest = rest
+	if h != nil {
+		c.header.Store(h)
+	}
+	return nil
+}
+
+// Header returns the header read, nil if none
+func (c *ProxyConn) Header() *gcore.ProxyHeader {
+	h, _ := c.header.Load().(*gcore.ProxyHeader)
+	return h
+}
+
+func (c *ProxyConn) Read(b []byte) (int, error) {
+	if len(c.rest) > 0 {
+		n := copy(b, c.rest)
+		c.rest = c.rest[n:]
+		if len(c.rest) == 0 {
+			c.rest = nil
+		}
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr returns the source address of the header if any
+func (c *ProxyConn) RemoteAddr() net.Addr {
+	if h := c.Header(); h != nil && h.Source != nil {
+		return h.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address of the header if any
+func (c *ProxyConn) LocalAddr() net.Addr {
+	if h := c.Header(); h != nil && h.Destination != nil {
+		return h.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// ReadProxyHeader reads a PROXY protocol v1 or v2 header at the beginning of r,
+// rest are the bytes read after it. h is nil if r does not start with a header,
+// which is known as soon as the bytes read differ from the signatures, so r is not read further.
+func ReadProxyHeader(r io.Reader) (h *gcore.ProxyHeader, rest []byte, err error) {
+	buf := make([]byte, 0, 256)
+	for {
+		if len(buf) == cap(buf) {
+			nb := make([]byte, len(buf), 2*cap(buf))
+			copy(nb, buf)
+			buf = nb
+		}
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		switch {
+		case hasPrefix(buf, []byte(proxyV1Prefix)):
+			if i := bytes.Index(buf, []byte("\r\n")); i >= 0 {
+				h, err := parseProxyV1(buf[:i])
+				return h, buf[i+2:], err
+			}
+			if len(buf) >= proxyV1MaxLen {
+				return nil, nil, gcore.ErrInvalidProxyHeader
+			}
+		case hasPrefix(buf, proxyV2Sig):
+			if len(buf) >= proxyV2HeaderLen {
+				l := proxyV2HeaderLen + int(binary.BigEndian.Uint16(buf[14:]))
+				if len(buf) >= l {
+					h, err := parseProxyV2(buf[:l])
+					return h, buf[l:], err
+				}
+			}
+		default:
+			return nil, buf, nil
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, nil, err
+		}
+	}
+}
+
+// hasPrefix whether b is a prefix of sig or starts with it
+func hasPrefix(b, sig []byte) bool {
+	if len(b) < len(sig) {
+		return bytes.HasPrefix(sig, b)
+	}
+	return bytes.HasPrefix(b, sig)
+}
+
+// parseProxyV1 parses the line of a v1 header without CRLF,
+// e.g. "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443"
+func parseProxyV1(line []byte) (*gcore.ProxyHeader, error) {
+	fields := strings.Split(string(line), " ")
+	h := &gcore.ProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		h.Local = true
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, gcore.ErrInvalidProxyHeader
+	}
+	src, err := parseProxyV1Addr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseProxyV1Addr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+func parseProxyV1Addr(ip, port string, v4 bool) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || (addr.To4() != nil) != v4 {
+		return nil, gcore.ErrInvalidProxyHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, gcore.ErrInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+// parseProxyV2 parses a v2 header b of the length in it
+func parseProxyV2(b []byte) (*gcore.ProxyHeader, error) {
+	if b[12]>>4 != 2 {
+		return nil, gcore.ErrInvalidProxyHeader
+	}
+	h := &gcore.ProxyHeader{Version: 2}
+	switch b[12] & 0xf {
+	case 0:
+		h.Local = true
+	case 1:
+	default:
+		return nil, gcore.ErrInvalidProxyHeader
+	}
+	family, transport := b[13]>>4, b[13]&0xf
+	if transport > 2 {
+		return nil, gcore.ErrInvalidProxyHeader
+	}
+	body := b[proxyV2HeaderLen:]
+	var addrLen int
+	switch family {
+	case 0:
+	case 1:
+		addrLen = 12
+	case 2:
+		addrLen = 36
+	case 3:
+		addrLen = 216
+	default:
+		return nil, gcore.ErrInvalidProxyHeader
+	}
+	if len(body) < addrLen {
+		return nil, gcore.ErrInvalidProxyHeader
+	}
+	if !h.Local && family != 0 {
+		h.Source, h.Destination = proxyV2Addrs(family, transport, body[:addrLen])
+	} else if !h.Local {
+		// PROXY with an unspecified family, the addresses of the conn are used
+		h.Local = true
+	}
+
+	for tlvs := body[addrLen:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, gcore.ErrInvalidProxyHeader
+		}
+		l := int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < 3+l {
+			return nil, gcore.ErrInvalidProxyHeader
+		}
+		tlv := gcore.ProxyTLV{Type: tlvs[0], Value: tlvs[3 : 3+l]}
+		if tlv.Type == gcore.ProxyTLVCRC32C && !checkProxyCRC(b, tlv.Value) {
+			return nil, gcore.ErrInvalidProxyHeader
+		}
+		h.TLVs = append(h.TLVs, tlv)
+		tlvs = tlvs[3+l:]
+	}
+	return h, nil
+}
+
+func proxyV2Addrs(family, transport byte, b []byte) (src, dst net.Addr) {
+	switch family {
+	case 1, 2:
+		n := net.IPv4len
+		if family == 2 {
+			n = net.IPv6len
+		}
+		srcIP := append(net.IP(nil), b[:n]...)
+		dstIP := append(net.IP(nil), b[n:2*n]...)
+		srcPort := int(binary.BigEndian.Uint16(b[2*n:]))
+		dstPort := int(binary.BigEndian.Uint16(b[2*n+2:]))
+		if transport == 2 {
+			return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}
+		}
+		return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}
+	default:
+		network := "unix"
+		if transport == 2 {
+			network = "unixgram"
+		}
+		return &net.UnixAddr{Name: unixPath(b[:108]), Net: network}, &net.UnixAddr{Name: unixPath(b[108:]), Net: network}
+	}
+}
+
+// unixPath the NUL-terminated path of a unix address
+func unixPath(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// checkProxyCRC checks the CRC32C of the header b, sum is the value of the TLV in b
+func checkProxyCRC(b, sum []byte) bool {
+	if len(sum) != 4 {
+		return false
+	}
+	want := binary.BigEndian.Uint32(sum)
+	// sum is a subslice of b, it is zeroed for computing
+	var saved [4]byte
+	copy(saved[:], sum)
+	for i := range sum {
+		sum[i] = 0
+	}
+	got := crc32.Checksum(b, castagnoli)
+	copy(sum, saved[:])
+	return got == want
+}
+
+// ParseCIDRs parses the trusted sources of ProxyProtocolOptions, CIDRs or IPs
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP:%s", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
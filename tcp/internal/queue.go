@@ -0,0 +1,179 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package internal
+
+import (
+	"context"
+	"sync"
+
+	"github.com/izhw/gnet/gcore"
+)
+
+// SendQueue a FIFO queue of frames bounded in msgs and bytes, 0 means unlimited.
+// A frame is always accepted by an empty queue, even if it is larger than maxBytes.
+type SendQueue struct {
+	mu       sync.Mutex
+	frames   []Frame
+	bytes    int
+	maxLen   int
+	maxBytes int
+	ready    chan struct{}   // signaled when frames are pushed
+	space    chan struct{}   // closed when room is made, nil if no one waits
+	done     <-chan struct{} // closed when the conn is closed, may be nil
+}
+
+func NewSendQueue(maxLen, maxBytes int, done <-chan struct{}) *SendQueue {
+	return &SendQueue{
+		maxLen:   maxLen,
+		maxBytes: maxBytes,
+		ready:    make(chan struct{}, 1),
+		done:     done,
+	}
+}
+
+// Ready returns a chan signaled when frames are pushed, the consumer should Pop until empty
+func (q *SendQueue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+func (q *SendQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.frames)
+}
+
+// Size returns the number of frames and their bytes
+func (q *SendQueue) Size() (n, bytes int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.frames), q.bytes
+}
+
+// HalfFull reports whether q is filled to half of its limits
+func (q *SendQueue) HalfFull() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return (q.maxLen > 0 && len(q.frames)*2 >= q.maxLen) || (q.maxBytes > 0 && q.bytes*2 >= q.maxBytes)
+}
+
+// Push queues f according to policy, full reports whether q was full.
+// SendQueueBlock waits for room only if wait is true, until ctx or done is done,
+// otherwise it fails like SendQueueDropNewest. SendQueueClose is left to the caller.
+func (q *SendQueue) Push(ctx context.Context, f Frame, policy gcore.SendQueuePolicy, wait bool) (full bool, err error) {
+	q.mu.Lock()
+	for {
+		select {
+		case <-q.done:
+			q.mu.Unlock()
+			return full, gcore.ErrConnClosed
+		default:
+		}
+		if q.fits(f.Len()) {
+			q.frames = append(q.frames, f)
+			q.bytes += f.Len()
+			q.mu.Unlock()
+			select {
+			case q.ready <- struct{}{}:
+			default:
+			}
+			return full, nil
+		}
+		full = true
+		if policy == gcore.SendQueueDropOldest {
+			for !q.fits(f.Len()) {
+				q.pop()
+			}
+			continue
+		}
+		if policy != gcore.SendQueueBlock || !wait {
+			q.mu.Unlock()
+			return full, gcore.ErrSendQueueFull
+		}
+		if q.space == nil {
+			q.space = make(chan struct{})
+		}
+		space := q.space
+		q.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return full, ctx.Err()
+		case <-q.done:
+			return full, gcore.ErrConnClosed
+		case <-space:
+		}
+		q.mu.Lock()
+	}
+}
+
+// Pop removes and returns the first frame, ok is false if q is empty
+func (q *SendQueue) Pop() (f Frame, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.frames) == 0 {
+		return f, false
+	}
+	return q.pop(), true
+}
+
+// PopBatch appends frames to dst and removes them from q, until the total length
+// would exceed maxBytes, at least one frame is popped if q is not empty
+func (q *SendQueue) PopBatch(dst []Frame, maxBytes int) []Frame {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for len(q.frames) > 0 {
+		l := q.frames[0].Len()
+		if n > 0 && n+l > maxBytes {
+			break
+		}
+		dst = append(dst, q.pop())
+		n += l
+	}
+	return dst
+}
+
+func (q *SendQueue) pop() (f Frame) {
+	f = q.frames[0]
+	q.frames[0] = Frame{}
+	q.frames = q.frames[1:]
+	if len(q.frames) == 0 {
+		q.frames = nil
+	}
+	q.bytes -= f.Len()
+	if q.space != nil {
+		close(q.space)
+		q.space = nil
+	}
+	return f
+}
+
+func (q *SendQueue) fits(n int) bool {
+	if len(q.frames) == 0 {
+		return true
+	}
+	if q.maxLen > 0 && len(q.frames) >= q.maxLen {
+		return false
+	}
+	if q.maxBytes > 0 && q.bytes+n > q.maxBytes {
+		return false
+	}
+	return true
+}
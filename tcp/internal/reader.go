@@ -23,6 +23,9 @@ package internal
 import (
 	"errors"
 	"io"
+
+	"github.com/izhw/gnet/codec"
+	"github.com/izhw/gnet/internal/frame"
 )
 
 var ErrTooLarge = errors.New("ReaderBuffer: too large")
@@ -48,6 +51,11 @@ func (b *ReaderBuffer) Release() {
 	b.buf = nil
 }
 
+// Cap returns the length of the underlying buffer
+func (b *ReaderBuffer) Cap() int {
+	return len(b.buf)
+}
+
 func (b *ReaderBuffer) Len() int {
 	return b.end - b.begin
 }
@@ -64,6 +72,19 @@ func (b *ReaderBuffer) Read(offset, n int, out []byte) {
 	b.begin += n
 }
 
+// ReadFrame reads the body of the next complete frame decoded by hc,
+// ok is false if the frame is incomplete. body is a copy.
+func (b *ReaderBuffer) ReadFrame(hc codec.HeaderCodec, max uint32) (body []byte, ok bool, err error) {
+	data, n, err := frame.Decode(hc, b.Data(), max)
+	if err != nil || n == 0 {
+		return nil, false, err
+	}
+	body = make([]byte, len(data))
+	copy(body, data)
+	b.begin += n
+	return body, true, nil
+}
+
 func (b *ReaderBuffer) ReadFromReader() (int, error) {
 	if !b.grow() {
 		return 0, ErrTooLarge
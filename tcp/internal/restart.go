@@ -0,0 +1,116 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ListenFdsEnv environment variable of the number of listening sockets handed over
+// by the parent process, they are inherited as fds from firstListenFd
+const ListenFdsEnv = "GNET_LISTEN_FDS"
+
+// firstListenFd fds 0, 1, 2 are stdin, stdout and stderr
+const firstListenFd = 3
+
+// InheritedListeners returns the listeners handed over by the parent process, nil if none.
+// ListenFdsEnv is unset, so they are adopted once.
+func InheritedListeners() ([]net.Listener, error) {
+	v := os.Getenv(ListenFdsEnv)
+	if v == "" {
+		return nil, nil
+	}
+	os.Unsetenv(ListenFdsEnv)
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid %s:%q", ListenFdsEnv, v)
+	}
+	ls := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(firstListenFd+i), "listener"+strconv.Itoa(i))
+		// l has its own dup of the fd
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, fmt.Errorf("inherited listener %d:%w", i, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// StartChild starts a new process of the executable with the args and env of the current one,
+// listeners are handed over to it, and adopted by InheritedListeners. Returns the pid.
+// The files of unix listeners are not removed when they are closed after.
+func StartChild(listeners []net.Listener) (int, error) {
+	files := make([]*os.File, 0, 3+len(listeners))
+	files = append(files, os.Stdin, os.Stdout, os.Stderr)
+	defer func() {
+		for _, f := range files[3:] {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return 0, fmt.Errorf("listener %s can't be handed over", l.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return 0, err
+		}
+		files = append(files, f)
+	}
+	path, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	env := make([]string, 0, len(os.Environ())+1)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, ListenFdsEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, ListenFdsEnv+"="+strconv.Itoa(len(listeners)))
+	p, err := os.StartProcess(path, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: files,
+	})
+	if err != nil {
+		return 0, err
+	}
+	pid := p.Pid
+	_ = p.Release()
+	// the socket files are used by the new process
+	for _, l := range listeners {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return pid, nil
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package internal
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+)
+
+const (
+	defaultKeepAliveIdle     = time.Minute
+	defaultKeepAliveInterval = 10 * time.Second
+	defaultKeepAliveCount    = 6
+)
+
+// Listen listens on the TCP address with the listener options of so,
+// reusePort: sets SO_REUSEPORT, ignored if ReusePortSupported is false.
+// so and reusePort are ignored for unix socket addresses, see UnixScheme
+func Listen(addr string, so *gcore.SocketOptions, reusePort bool) (net.Listener, error) {
+	if network, path := SplitAddr(addr); network == "unix" {
+		return listenUnix(path)
+	}
+	lc := net.ListenConfig{
+		Control: listenControl(so, reusePort),
+	}
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err = setBacklog(l.(*net.TCPListener), so.Backlog); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// WithPort returns addr with its port replaced by port, used to open more listeners
+// with SO_REUSEPORT on the port the first one is bound to, in case addr has port 0
+func WithPort(addr string, port int) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// Dial connects to the TCP address and applies so,
+// keepalive of the dialer is disabled as it is set by so.
+// so is ignored for unix socket addresses, see UnixScheme
+func Dial(addr string, so *gcore.SocketOptions) (net.Conn, error) {
+	network, address := SplitAddr(addr)
+	d := net.Dialer{KeepAlive: -1}
+	conn, err := d.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		return conn, nil
+	}
+	tc := conn.(*net.TCPConn)
+	if err = ApplySocketOptions(tc, so); err != nil {
+		tc.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+func seconds(d, def time.Duration) int {
+	if d <= 0 {
+		d = def
+	}
+	if d < time.Second {
+		return 1
+	}
+	return int(d / time.Second)
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package internal
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/izhw/gnet/gcore"
+)
+
+// not defined in syscall
+const (
+	tcpUserTimeout = 0x12 // TCP_USER_TIMEOUT
+	soReusePort    = 0xf  // SO_REUSEPORT
+)
+
+// ReusePortSupported whether listeners can be opened with SO_REUSEPORT
+const ReusePortSupported = true
+
+// ApplySocketOptions applies so to conn
+func ApplySocketOptions(conn *net.TCPConn, so *gcore.SocketOptions) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err = raw.Control(func(fd uintptr) {
+		serr = SetSockopts(int(fd), so)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// SetSockopts applies so to the connected socket fd, all options are tried, the first error is returned
+func SetSockopts(fd int, so *gcore.SocketOptions) error {
+	var err error
+	set := func(level, opt, v int) {
+		if e := syscall.SetsockoptInt(fd, level, opt, v); e != nil && err == nil {
+			err = os.NewSyscallError("setsockopt", e)
+		}
+	}
+	if so.KeepAliveIdle < 0 {
+		set(syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 0)
+	} else {
+		set(syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1)
+		set(syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, seconds(so.KeepAliveIdle, defaultKeepAliveIdle))
+		set(syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, seconds(so.KeepAliveInterval, defaultKeepAliveInterval))
+		count := so.KeepAliveCount
+		if count <= 0 {
+			count = defaultKeepAliveCount
+		}
+		set(syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, count)
+	}
+	if so.Delay {
+		set(syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 0)
+	} else {
+		set(syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1)
+	}
+	if so.ReadBufferSize > 0 {
+		set(syscall.SOL_SOCKET, syscall.SO_RCVBUF, so.ReadBufferSize)
+	}
+	if so.WriteBufferSize > 0 {
+		set(syscall.SOL_SOCKET, syscall.SO_SNDBUF, so.WriteBufferSize)
+	}
+	if so.Linger != 0 {
+		l := &syscall.Linger{Onoff: 1}
+		if so.Linger > 0 {
+			l.Linger = int32(so.Linger)
+		}
+		if e := syscall.SetsockoptLinger(fd, syscall.SOL_SOCKET, syscall.SO_LINGER, l); e != nil && err == nil {
+			err = os.NewSyscallError("setsockopt", e)
+		}
+	}
+	if so.UserTimeout > 0 {
+		set(syscall.IPPROTO_TCP, tcpUserTimeout, int(so.UserTimeout.Milliseconds()))
+	}
+	if so.QuickAck {
+		set(syscall.IPPROTO_TCP, syscall.TCP_QUICKACK, 1)
+	}
+	return err
+}
+
+// SetListenSockopts applies the listener options of so to fd before bind, reusePort: sets SO_REUSEPORT
+func SetListenSockopts(fd int, so *gcore.SocketOptions, reusePort bool) error {
+	v := 1
+	if so.DisableReuseAddr {
+		v = 0
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, v); err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	if reusePort {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soReusePort, 1); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	return nil
+}
+
+func listenControl(so *gcore.SocketOptions, reusePort bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = SetListenSockopts(int(fd), so, reusePort)
+		}); err != nil {
+			return err
+		}
+		return serr
+	}
+}
+
+// setBacklog calling listen again on a listening socket updates its backlog
+func setBacklog(l *net.TCPListener, backlog int) error {
+	if backlog <= 0 {
+		return nil
+	}
+	raw, err := l.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err = raw.Control(func(fd uintptr) {
+		serr = syscall.Listen(int(fd), backlog)
+	}); err != nil {
+		return err
+	}
+	if serr != nil {
+		return os.NewSyscallError("listen", serr)
+	}
+	return nil
+}
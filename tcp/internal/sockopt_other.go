@@ -0,0 +1,71 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// +build !linux
+
+package internal
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+)
+
+// ReusePortSupported whether listeners can be opened with SO_REUSEPORT
+const ReusePortSupported = false
+
+// ApplySocketOptions applies so to conn, the linux only options are ignored
+func ApplySocketOptions(conn *net.TCPConn, so *gcore.SocketOptions) error {
+	var err error
+	check := func(e error) {
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	if so.KeepAliveIdle < 0 {
+		check(conn.SetKeepAlive(false))
+	} else {
+		check(conn.SetKeepAlive(true))
+		check(conn.SetKeepAlivePeriod(time.Duration(seconds(so.KeepAliveIdle, defaultKeepAliveIdle)) * time.Second))
+	}
+	check(conn.SetNoDelay(!so.Delay))
+	if so.ReadBufferSize > 0 {
+		check(conn.SetReadBuffer(so.ReadBufferSize))
+	}
+	if so.WriteBufferSize > 0 {
+		check(conn.SetWriteBuffer(so.WriteBufferSize))
+	}
+	if so.Linger > 0 {
+		check(conn.SetLinger(so.Linger))
+	} else if so.Linger < 0 {
+		check(conn.SetLinger(0))
+	}
+	return err
+}
+
+func listenControl(so *gcore.SocketOptions, reusePort bool) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+func setBacklog(l *net.TCPListener, backlog int) error {
+	return nil
+}
@@ -18,27 +18,19 @@
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
 // SOFTWARE.
 
-package server
+package internal
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"net"
-	"syscall"
 )
 
-// Sets additional keepalive parameters
-// count: probe count
-// interval: retry interval(seconds)
-func setKeepaliveParameters(conn *net.TCPConn, count, interval int) error {
-	rawConn, err := conn.SyscallConn()
-	if err != nil {
-		return err
+// PeerCertificates returns the peer certificate chain of conn,
+// nil if conn is not a TLS connection, or a conn wrapping one such as the conns of tcp/mux.
+func PeerCertificates(conn net.Conn) []*x509.Certificate {
+	if tc, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		return tc.ConnectionState().PeerCertificates
 	}
-	err = rawConn.Control(
-		func(fd uintptr) {
-			// probe count
-			syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, count)
-			// retry interval after an unsuccessful probe
-			syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, interval)
-		})
-	return err
+	return nil
 }
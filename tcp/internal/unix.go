@@ -0,0 +1,75 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package internal
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// UnixScheme prefix of unix socket addresses, like unix:///tmp/app.sock,
+// or unix://@app for the abstract namespace of linux
+const UnixScheme = "unix://"
+
+// SplitAddr returns the network and address of addr, "unix" for UnixScheme, "tcp" otherwise
+func SplitAddr(addr string) (network, address string) {
+	if strings.HasPrefix(addr, UnixScheme) {
+		return "unix", addr[len(UnixScheme):]
+	}
+	return "tcp", addr
+}
+
+// IsUnixAddr whether addr is a unix socket address
+func IsUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, UnixScheme)
+}
+
+// listenUnix listens on the unix socket path, a stale socket file left by a crashed
+// process is removed. The file is removed when the listener is closed.
+func listenUnix(path string) (net.Listener, error) {
+	if path != "" && path[0] != '@' {
+		removeStaleSocket(path)
+	}
+	var lc net.ListenConfig
+	return lc.Listen(context.Background(), "unix", path)
+}
+
+// removeStaleSocket removes the socket file at path if nobody is listening on it
+func removeStaleSocket(path string) {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	if ne, ok := err.(*net.OpError); ok {
+		if se, ok := ne.Err.(*os.SyscallError); ok && se.Err == syscall.ECONNREFUSED {
+			os.Remove(path)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package internal
+
+import (
+	"net"
+	"time"
+
+	"github.com/izhw/gnet/internal/connstat"
+)
+
+// maxRetainedBufLen the copy buffer larger than it is released after writing
+const maxRetainedBufLen = 64 * 1024
+
+// BatchWriter writes the frames queued in a SendQueue in batches,
+// a batch is written by one writev if supported by the conn, otherwise it is copied into one buffer
+type BatchWriter struct {
+	conn     net.Conn
+	maxBytes int
+	vectored bool
+	stats    *connstat.Stats
+	frames   []Frame
+	bufs     [][]byte
+	buf      []byte
+}
+
+// NewBatchWriter maxBytes: max bytes of a batch, <= 0 means one frame per batch,
+// stats: stats of the conn updated with the frames written
+func NewBatchWriter(conn net.Conn, maxBytes int, stats *connstat.Stats) *BatchWriter {
+	w := &BatchWriter{
+		conn:     conn,
+		maxBytes: maxBytes,
+		stats:    stats,
+	}
+	// net.Buffers uses writev only for these conns, e.g. a tls.Conn writes each buffer as a record
+	switch conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		w.vectored = true
+	}
+	return w
+}
+
+// WriteQueued writes the frames in q until q is empty, the write deadline of each batch is deadline().
+// On error, it returns the frames of the failed batch, the rest are left in q.
+func (w *BatchWriter) WriteQueued(q *SendQueue, deadline func() time.Time) (failed []Frame, err error) {
+	for {
+		w.frames = q.PopBatch(w.frames[:0], w.maxBytes)
+		if len(w.frames) == 0 {
+			return nil, nil
+		}
+		_ = w.conn.SetWriteDeadline(deadline())
+		n := 0
+		for _, f := range w.frames {
+			n += f.Len()
+		}
+		if err = w.write(); err != nil {
+			failed = append([]Frame(nil), w.frames...)
+			w.stats.WriteFailed()
+		} else {
+			w.stats.Written(len(w.frames), n)
+		}
+		for i := range w.frames {
+			w.frames[i] = Frame{}
+		}
+		if err != nil {
+			return failed, err
+		}
+	}
+}
+
+func (w *BatchWriter) write() (err error) {
+	if len(w.frames) == 1 && w.frames[0].Data != nil {
+		_, err = w.conn.Write(w.frames[0].Data)
+		return
+	}
+	if w.vectored {
+		w.bufs = w.bufs[:0]
+		for _, f := range w.frames {
+			w.bufs = f.AppendTo(w.bufs)
+		}
+		bufs := net.Buffers(w.bufs)
+		_, err = bufs.WriteTo(w.conn)
+		for i := range w.bufs {
+			w.bufs[i] = nil
+		}
+		return
+	}
+	w.buf = w.buf[:0]
+	for _, f := range w.frames {
+		if f.Data != nil {
+			w.buf = append(w.buf, f.Data...)
+		} else {
+			w.buf = append(w.buf, f.Header...)
+			w.buf = append(w.buf, f.Body...)
+		}
+	}
+	_, err = w.conn.Write(w.buf)
+	if cap(w.buf) > maxRetainedBufLen {
+		w.buf = nil
+	}
+	return
+}
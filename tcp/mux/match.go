@@ -0,0 +1,305 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mux
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// maxClientHelloLen max length of a ClientHello read for the SNI
+const maxClientHelloLen = 64 * 1024
+
+var errPeekTooLong = errors.New("mux: MaxPeekLen exceeded")
+
+// Matcher reports whether a conn matches by reading its first bytes from r, which fails at the
+// peek timeout or MaxPeekLen. Each Matcher reads from the first byte, the bytes are read again
+// by the server the conn is routed to.
+type Matcher func(r io.Reader) bool
+
+// sniffer buffers the bytes read from a conn for the matchers
+type sniffer struct {
+	conn net.Conn
+	buf  []byte
+	max  int
+	err  error // of reading conn, sticky
+}
+
+// fill reads more bytes from the conn into buf
+func (s *sniffer) fill() error {
+	if s.err != nil {
+		return s.err
+	}
+	if len(s.buf) >= s.max {
+		return errPeekTooLong
+	}
+	if len(s.buf) == cap(s.buf) {
+		n := 2 * cap(s.buf)
+		if n < 512 {
+			n = 512
+		}
+		if n > s.max {
+			n = s.max
+		}
+		buf := make([]byte, len(s.buf), n)
+		copy(buf, s.buf)
+		s.buf = buf
+	}
+	n, err := s.conn.Read(s.buf[len(s.buf):cap(s.buf)])
+	s.buf = s.buf[:len(s.buf)+n]
+	if err != nil {
+		s.err = err
+	}
+	if n > 0 {
+		return nil
+	}
+	return err
+}
+
+// replayReader reads the bytes buffered by the sniffer from the first one, then reads more
+type replayReader struct {
+	s   *sniffer
+	pos int
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	if r.pos == len(r.s.buf) {
+		if err := r.s.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.s.buf[r.pos:])
+	r.pos += n
+	return n, nil
+}
+
+// Any matches every conn without reading, e.g. as the last one for gnet frames
+func Any() Matcher {
+	return func(io.Reader) bool {
+		return true
+	}
+}
+
+// Prefix matches the conns starting with one of prefixes
+func Prefix(prefixes ...[]byte) Matcher {
+	max := 0
+	for _, p := range prefixes {
+		if len(p) > max {
+			max = len(p)
+		}
+	}
+	return func(r io.Reader) bool {
+		buf := make([]byte, 0, max)
+		for {
+			possible := false
+			for _, p := range prefixes {
+				if len(buf) >= len(p) {
+					if bytes.HasPrefix(buf, p) {
+						return true
+					}
+				} else if bytes.HasPrefix(p, buf) {
+					possible = true
+				}
+			}
+			if !possible {
+				return false
+			}
+			n, err := r.Read(buf[len(buf):max])
+			buf = buf[:len(buf)+n]
+			if err != nil {
+				return false
+			}
+		}
+	}
+}
+
+// HTTP matches HTTP/1 requests of methods, default: all the methods of net/http
+func HTTP(methods ...string) Matcher {
+	if len(methods) == 0 {
+		methods = []string{
+			http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+			http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace,
+		}
+	}
+	prefixes := make([][]byte, len(methods))
+	for i, m := range methods {
+		prefixes[i] = []byte(m + " ")
+	}
+	return Prefix(prefixes...)
+}
+
+// WebSocket matches the WebSocket upgrade requests, by reading the request header.
+// It must be before HTTP to take the upgrade requests.
+func WebSocket() Matcher {
+	get := HTTP(http.MethodGet)
+	return func(r io.Reader) bool {
+		if !get(r) {
+			return false
+		}
+		req, err := http.ReadRequest(bufio.NewReader(io.MultiReader(strings.NewReader("GET "), r)))
+		if err != nil {
+			return false
+		}
+		for _, v := range req.Header.Values("Upgrade") {
+			for _, t := range strings.Split(v, ",") {
+				if strings.EqualFold(strings.TrimSpace(t), "websocket") {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// TLS matches TLS conns by the ClientHello, the server names are matched with the SNI if any,
+// "*.example.com" matches the subdomains. default: any TLS conn
+func TLS(serverNames ...string) Matcher {
+	return func(r io.Reader) bool {
+		// record header: type, version, length, handshake header: type, length
+		var h [9]byte
+		if _, err := io.ReadFull(r, h[:]); err != nil {
+			return false
+		}
+		if h[0] != 0x16 || h[1] != 0x03 || h[5] != 0x01 {
+			return false
+		}
+		if len(serverNames) == 0 {
+			return true
+		}
+		name, ok := readServerName(r, h)
+		if !ok {
+			return false
+		}
+		for _, n := range serverNames {
+			if matchName(n, name) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// readServerName reads the rest of the ClientHello starting with h, and returns the SNI,
+// the ClientHello may span records
+func readServerName(r io.Reader, h [9]byte) (string, bool) {
+	recordLen := int(binary.BigEndian.Uint16(h[3:])) - 4
+	msgLen := int(h[6])<<16 | int(h[7])<<8 | int(h[8])
+	if msgLen > maxClientHelloLen {
+		return "", false
+	}
+	msg := make([]byte, 0, msgLen)
+	for {
+		n := recordLen
+		if n > msgLen-len(msg) {
+			n = msgLen - len(msg)
+		}
+		if n < 0 {
+			return "", false
+		}
+		start := len(msg)
+		msg = append(msg, make([]byte, n)...)
+		if _, err := io.ReadFull(r, msg[start:]); err != nil {
+			return "", false
+		}
+		if len(msg) == msgLen {
+			break
+		}
+		// next record of the handshake
+		var rh [5]byte
+		if _, err := io.ReadFull(r, rh[:]); err != nil || rh[0] != 0x16 {
+			return "", false
+		}
+		recordLen = int(binary.BigEndian.Uint16(rh[3:]))
+	}
+	return parseServerName(msg)
+}
+
+// parseServerName returns the server_name extension of the body of a ClientHello
+func parseServerName(b []byte) (string, bool) {
+	// version, random
+	if len(b) < 34 {
+		return "", false
+	}
+	b = b[34:]
+	// session id, cipher suites, compression methods
+	for _, l := range []int{1, 2, 1} {
+		if len(b) < l {
+			return "", false
+		}
+		n := int(b[0])
+		if l == 2 {
+			n = int(binary.BigEndian.Uint16(b))
+		}
+		if len(b) < l+n {
+			return "", false
+		}
+		b = b[l+n:]
+	}
+	if len(b) < 2 {
+		return "", false
+	}
+	exts := b[2:]
+	for len(exts) >= 4 {
+		typ := binary.BigEndian.Uint16(exts)
+		n := int(binary.BigEndian.Uint16(exts[2:]))
+		if len(exts) < 4+n {
+			return "", false
+		}
+		data := exts[4 : 4+n]
+		exts = exts[4+n:]
+		if typ != 0 {
+			continue
+		}
+		// server_name_list
+		if len(data) < 2 {
+			return "", false
+		}
+		list := data[2:]
+		for len(list) >= 3 {
+			l := int(binary.BigEndian.Uint16(list[1:]))
+			if len(list) < 3+l {
+				return "", false
+			}
+			if list[0] == 0 {
+				return string(list[3 : 3+l]), true
+			}
+			list = list[3+l:]
+		}
+	}
+	return "", false
+}
+
+// matchName whether the server name matches pattern, which may start with "*." for the subdomains
+func matchName(pattern, name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, "*.") {
+		i := strings.IndexByte(name, '.')
+		return i > 0 && name[i:] == pattern[1:]
+	}
+	return name == pattern
+}
@@ -0,0 +1,266 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package mux serves several protocols on one port, each conn accepted is routed by its first bytes
+// to the listener of the first matching Matcher, e.g. to a gnet server with gcore.WithListener,
+// or to an http.Server. TLS can be terminated by the Mux, and the decrypted conns routed again.
+//
+//	m := mux.New(l, mux.Config{})
+//	wsl := m.Match(mux.WebSocket())
+//	httpl := m.Match(mux.HTTP())
+//	gnetl := m.Match(mux.Any())
+//	go m.Serve()
+package mux
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/util/delay"
+	"github.com/izhw/gnet/logger"
+	"github.com/izhw/gnet/tcp/internal"
+)
+
+const (
+	DefaultPeekTimeout = 3 * time.Second
+	DefaultMaxPeekLen  = 32 * 1024
+)
+
+var ErrListenerClosed = errors.New("mux: listener closed")
+
+// Config of a Mux, the zero value is the default
+type Config struct {
+	// PeekTimeout bounds reading the bytes matched, including the TLS handshake of a Mux returned by TLS.
+	// Matchers fail when it is exceeded, but Any still matches. default: DefaultPeekTimeout
+	PeekTimeout time.Duration
+	// MaxPeekLen max bytes read for matching, default: DefaultMaxPeekLen
+	MaxPeekLen int
+	// Socket options applied to the accepted TCP conns, which are wrapped, so the servers
+	// can't apply their own. default: nil, none
+	Socket *gcore.SocketOptions
+	// Logger default: logger.DefaultLogger()
+	Logger logger.Logger
+}
+
+// Mux routes the conns accepted from a listener to the listeners of matchers
+type Mux struct {
+	l        net.Listener
+	cfg      Config
+	routes   []route
+	children []*Mux // returned by TLS
+	done     chan struct{}
+	once     sync.Once
+}
+
+type route struct {
+	matchers []Matcher
+	l        *listener
+}
+
+func New(l net.Listener, cfg Config) *Mux {
+	if cfg.PeekTimeout <= 0 {
+		cfg.PeekTimeout = DefaultPeekTimeout
+	}
+	if cfg.MaxPeekLen <= 0 {
+		cfg.MaxPeekLen = DefaultMaxPeekLen
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = logger.DefaultLogger()
+	}
+	return &Mux{
+		l:    l,
+		cfg:  cfg,
+		done: make(chan struct{}),
+	}
+}
+
+// Match returns a listener of the conns matching any of matchers, the matchers of the listeners
+// are tried in the order of Match calls, conns matching none are closed. Called before Serve.
+func (m *Mux) Match(matchers ...Matcher) net.Listener {
+	l := &listener{
+		addr:  m.l.Addr(),
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	m.routes = append(m.routes, route{matchers: matchers, l: l})
+	return l
+}
+
+// TLS terminates TLS with cfg on the conns matching any of matchers, default TLS(),
+// the decrypted conns are routed by the Mux returned, which is served by Serve of m.
+// PeerCertificates of the gnet conns routed by it return the certificates of the TLS conns.
+func (m *Mux) TLS(cfg *tls.Config, matchers ...Matcher) *Mux {
+	if len(matchers) == 0 {
+		matchers = []Matcher{TLS()}
+	}
+	child := New(tls.NewListener(m.Match(matchers...), cfg), Config{
+		PeekTimeout: m.cfg.PeekTimeout,
+		MaxPeekLen:  m.cfg.MaxPeekLen,
+		Logger:      m.cfg.Logger,
+	})
+	m.children = append(m.children, child)
+	return child
+}
+
+// Serve accepts conns until the listener is closed, then closes the listeners of the matchers
+func (m *Mux) Serve() error {
+	defer func() {
+		for _, r := range m.routes {
+			r.l.Close()
+		}
+	}()
+	for _, child := range m.children {
+		go child.Serve()
+	}
+
+	td := delay.NewTempDelay(5*time.Millisecond, time.Second)
+	for {
+		conn, err := m.l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				d := td.GetDelay()
+				m.cfg.Logger.Warnf("Mux accept temporary error:[%v], delay:%v", ne, d)
+				time.Sleep(d)
+				continue
+			}
+			select {
+			case <-m.done:
+				return nil
+			default:
+			}
+			return err
+		}
+		td.Reset()
+		if tc, ok := conn.(*net.TCPConn); ok && m.cfg.Socket != nil {
+			if err := internal.ApplySocketOptions(tc, m.cfg.Socket); err != nil {
+				m.cfg.Logger.Warnf("Mux conn:%s set socket options error:[%v]", tc.RemoteAddr(), err)
+			}
+		}
+		go m.route(conn)
+	}
+}
+
+// Close closes the listener, Serve returns nil
+func (m *Mux) Close() error {
+	m.once.Do(func() {
+		close(m.done)
+	})
+	return m.l.Close()
+}
+
+// route matches conn and passes it to the listener matched
+func (m *Mux) route(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(m.cfg.PeekTimeout))
+	s := &sniffer{conn: conn, max: m.cfg.MaxPeekLen}
+	for _, r := range m.routes {
+		for _, match := range r.matchers {
+			if !match(&replayReader{s: s}) {
+				continue
+			}
+			_ = conn.SetReadDeadline(time.Time{})
+			r.l.deliver(wrap(conn, s.buf))
+			return
+		}
+	}
+	if s.err != nil {
+		m.cfg.Logger.Debugf("Mux conn:%s unmatched, read error:[%v]", conn.RemoteAddr(), s.err)
+	} else {
+		m.cfg.Logger.Debugf("Mux conn:%s unmatched", conn.RemoteAddr())
+	}
+	conn.Close()
+}
+
+// listener the conns of a Matcher, Close stops passing conns to it, the Mux is not closed
+type listener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+// Addr returns the address of the listener of the Mux
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+// deliver waits for c to be accepted, c is closed if l is closed
+func (l *listener) deliver(c net.Conn) {
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+// Conn a conn routed by a Mux, the bytes read for matching are read first
+type Conn struct {
+	net.Conn
+	peeked []byte
+}
+
+// tlsConn a Conn over a TLS conn, for the peer certificates
+type tlsConn struct {
+	*Conn
+}
+
+func wrap(conn net.Conn, peeked []byte) net.Conn {
+	c := &Conn{Conn: conn, peeked: peeked}
+	if _, ok := conn.(*tls.Conn); ok {
+		return tlsConn{c}
+	}
+	return c
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(b, c.peeked)
+		c.peeked = c.peeked[n:]
+		if len(c.peeked) == 0 {
+			c.peeked = nil
+		}
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// ConnectionState returns the state of the TLS conn terminated by the Mux
+func (c tlsConn) ConnectionState() tls.ConnectionState {
+	return c.Conn.Conn.(*tls.Conn).ConnectionState()
+}
@@ -22,6 +22,8 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"net"
 	"sync"
@@ -29,31 +31,64 @@ import (
 	"time"
 
 	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/connstat"
+	"github.com/izhw/gnet/internal/registry"
 	"github.com/izhw/gnet/tcp/internal"
 )
 
-var _ gcore.Conn = &Conn{}
+var (
+	_ gcore.Conn            = &Conn{}
+	_ gcore.PeerCredConn    = &Conn{}
+	_ gcore.ProxyHeaderConn = &Conn{}
+)
 
 type Conn struct {
+	id        uint64
 	s         *Server
-	conn      *net.TCPConn
+	conn      net.Conn            // TLS conn over proxy or raw if TLS is enabled
+	raw       net.Conn            // accepted TCP or unix socket conn
+	proxy     *internal.ProxyConn // over raw if the PROXY protocol header is read, otherwise nil
 	buffer    *internal.ReaderBuffer
-	sendChan  chan []byte
+	queue     *internal.SendQueue
+	writer    *internal.BatchWriter
+	stats     *connstat.Stats
+	heart     *connstat.HeartWatch
 	closeChan chan struct{}
 	wwg       sync.WaitGroup
 	rwg       sync.WaitGroup
+	hwg       sync.WaitGroup // msgs dispatched to workers
+	mu        sync.Mutex     // guards tag and registered
 	closed    int32
+	draining  int32
 	tag       string
+	// registered c is in the registry of the server
+	registered bool
 }
 
-func newConn(ctx context.Context, s *Server, conn *net.TCPConn) *Conn {
+func newConn(ctx context.Context, s *Server, conn net.Conn) *Conn {
 	c := &Conn{
+		id:        registry.NextID(),
 		s:         s,
 		conn:      conn,
-		sendChan:  make(chan []byte, 100),
+		raw:       conn,
 		closeChan: make(chan struct{}),
 	}
+	// written without the ProxyConn, which hides writev of the TCP conn
+	wc := conn
+	if s.proxyTrusted(conn.RemoteAddr()) {
+		c.proxy = internal.NewProxyConn(conn)
+		c.conn = c.proxy
+	}
+	if s.opts.TLSConfig != nil {
+		c.conn = tls.Server(c.conn, s.opts.TLSConfig)
+		wc = c.conn
+	}
+	c.queue = internal.NewSendQueue(s.opts.SendQueueLen, s.opts.SendQueueBytes, c.closeChan)
+	c.stats = connstat.NewStats(&s.metrics.IO)
+	c.writer = internal.NewBatchWriter(wc, s.opts.WriteBatchBytes, c.stats)
+	c.heart = s.heart.Watch(c.stats, c.onIdle, c.ping)
 	c.buffer = internal.NewReaderBuffer(c.conn, int(s.opts.InitReadBufLen), int(s.opts.MaxReadBufLen))
+	c.register()
 	c.wwg.Add(1)
 	go c.handleWriteLoop(ctx)
 	c.rwg.Add(1)
@@ -61,6 +96,10 @@ func newConn(ctx context.Context, s *Server, conn *net.TCPConn) *Conn {
 	return c
 }
 
+func (c *Conn) ID() uint64 {
+	return c.id
+}
+
 func (c *Conn) Init(opts ...gcore.Option) error {
 	return nil
 }
@@ -78,14 +117,55 @@ func (c *Conn) WriteRead(req []byte) (body []byte, err error) {
 }
 
 func (c *Conn) Write(data []byte) error {
-	if len(data) > 0 {
-		select {
-		case <-c.closeChan:
-			return gcore.ErrConnClosed
-		case c.sendChan <- data:
+	return c.enqueue(context.Background(), data, true)
+}
+
+func (c *Conn) TryWrite(data []byte) error {
+	return c.enqueue(context.Background(), data, false)
+}
+
+func (c *Conn) WriteContext(ctx context.Context, data []byte) error {
+	return c.enqueue(ctx, data, true)
+}
+
+// enqueue passes data through the interceptors and queues it,
+// wait: whether SendQueueBlock waits for room
+func (c *Conn) enqueue(ctx context.Context, data []byte, wait bool) error {
+	if is := c.s.opts.Interceptors; len(is) > 0 {
+		return gcore.InterceptWrite(is, c, data, func(_ gcore.Conn, data []byte) error {
+			return c.send(ctx, data, wait)
+		})
+	}
+	return c.send(ctx, data, wait)
+}
+
+// send encodes data and queues it
+func (c *Conn) send(ctx context.Context, data []byte, wait bool) error {
+	if len(data) == 0 {
+		return nil
+	}
+	f, err := internal.EncodeFrame(c.s.opts.HeaderCodec, data)
+	if err != nil {
+		return err
+	}
+	return c.push(ctx, f, c.s.opts.SendQueuePolicy, wait)
+}
+
+// push queues the encoded frame f with policy
+func (c *Conn) push(ctx context.Context, f internal.Frame, policy gcore.SendQueuePolicy, wait bool) error {
+	full, err := c.queue.Push(ctx, f, policy, wait)
+	if full {
+		c.s.metrics.SendQueueFull.Add(1)
+		if h, ok := c.s.opts.Handler.(gcore.SendQueueFullHandler); ok {
+			h.OnSendQueueFull(c, f.Body)
 		}
 	}
-	return nil
+	if err == gcore.ErrSendQueueFull && policy == gcore.SendQueueClose {
+		c.s.opts.Logger.Infof("TCP conn:%d %s send queue full, closing", c.id, c.RemoteAddr())
+		// the read loop closes c, queued data is dropped
+		c.forceClose()
+	}
+	return err
 }
 
 func (c *Conn) Close() (err error) {
@@ -94,18 +174,22 @@ func (c *Conn) Close() (err error) {
 	}
 	close(c.closeChan)
 	c.wwg.Wait()
-	for len(c.sendChan) > 0 {
-		data := <-c.sendChan
-		if err := c.write(data); err != nil {
-			c.s.opts.Handler.OnWriteError(c, data, err)
+	for {
+		failed, err := c.writer.WriteQueued(c.queue, c.getWriteDeadLine)
+		if err == nil {
+			break
+		}
+		for _, f := range failed {
+			c.s.opts.Handler.OnWriteError(c, f.Body, err)
 		}
 	}
 	err = c.conn.Close()
 	c.rwg.Wait()
+	c.heart.Stop()
 	c.buffer.Release()
+	c.unregister()
 	c.s.opts.Handler.OnClosed(c)
 	c.s.onConnClose()
-	c.s = nil
 	return
 }
 
@@ -116,18 +200,108 @@ func (c *Conn) Closed() bool {
 	return false
 }
 
+// RemoteAddr returns the source address of the PROXY protocol header if any
 func (c *Conn) RemoteAddr() net.Addr {
-	return c.conn.RemoteAddr()
+	if c.proxy != nil {
+		return c.proxy.RemoteAddr()
+	}
+	return c.raw.RemoteAddr()
+}
+
+// LocalAddr returns the destination address of the PROXY protocol header if any
+func (c *Conn) LocalAddr() net.Addr {
+	if c.proxy != nil {
+		return c.proxy.LocalAddr()
+	}
+	return c.raw.LocalAddr()
+}
+
+func (c *Conn) ProxyHeader() *gcore.ProxyHeader {
+	if c.proxy == nil {
+		return nil
+	}
+	return c.proxy.Header()
+}
+
+func (c *Conn) PeerCertificates() []*x509.Certificate {
+	return internal.PeerCertificates(c.conn)
+}
+
+func (c *Conn) PeerCred() (gcore.PeerCred, error) {
+	uc, ok := c.raw.(*net.UnixConn)
+	if !ok {
+		return gcore.PeerCred{}, gcore.ErrPeerCredUnavailable
+	}
+	return internal.PeerCred(uc)
+}
+
+func (c *Conn) Stats() (st gcore.ConnStats) {
+	c.stats.Fill(&st)
+	st.SendQueueLen, st.SendQueueBytes = c.queue.Size()
+	return
 }
 
 func (c *Conn) SetTag(tag string) {
+	c.mu.Lock()
+	if c.registered {
+		c.s.conns.Retag(c, c.tag, tag)
+	}
 	c.tag = tag
+	c.mu.Unlock()
 }
 
 func (c *Conn) GetTag() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.tag
 }
 
+func (c *Conn) register() {
+	c.mu.Lock()
+	c.s.conns.Add(c, c.tag)
+	c.registered = true
+	c.mu.Unlock()
+}
+
+func (c *Conn) unregister() {
+	c.mu.Lock()
+	c.s.conns.Remove(c, c.tag)
+	c.registered = false
+	c.mu.Unlock()
+}
+
+// shutdown stops reading new msgs, the read loop exits after the in-flight OnReadMsg returns,
+// then c is closed after the send queue is flushed
+func (c *Conn) shutdown() {
+	atomic.StoreInt32(&c.draining, 1)
+	_ = c.conn.SetReadDeadline(time.Now())
+}
+
+func (c *Conn) isDraining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
+
+// onIdle called by the heart keeper when c has received nothing for HeartTimeout
+func (c *Conn) onIdle() {
+	go func() {
+		c.s.opts.Logger.Infof("TCP conn:%d %s idle timeout, closing", c.id, c.RemoteAddr())
+		if h, ok := c.s.opts.Handler.(gcore.IdleTimeoutHandler); ok {
+			h.OnIdleTimeout(c)
+		}
+		c.Close()
+	}()
+}
+
+// ping called by the heart keeper when c is silent for HeartPingInterval
+func (c *Conn) ping() {
+	_ = c.TryWrite(c.s.opts.HeartData)
+}
+
+// forceClose closes the underlying conn, pending reads and writes fail immediately
+func (c *Conn) forceClose() {
+	_ = c.conn.Close()
+}
+
 func (c *Conn) getReadDeadLine() (t time.Time) {
 	if c.s.opts.ReadTimeout > 0 {
 		t = time.Now().Add(c.s.opts.ReadTimeout)
@@ -144,10 +318,31 @@ func (c *Conn) getWriteDeadLine() (t time.Time) {
 
 func (c *Conn) handleReadLoop(ctx context.Context) {
 	defer func() {
+		// in-flight msgs are handled before closing when shutting down
+		if c.isDraining() {
+			c.hwg.Wait()
+		}
 		c.rwg.Done()
 		c.Close()
 	}()
 
+	// the PROXY protocol header precedes the TLS handshake
+	if c.proxy != nil {
+		_ = c.raw.SetReadDeadline(c.getReadDeadLine())
+		if err := c.proxy.ReadHeader(c.s.opts.ProxyProtocol.Optional); err != nil {
+			c.s.opts.Logger.Debugf("TCP conn:%s PROXY protocol header error:[%v]", c.raw.RemoteAddr(), err)
+			return
+		}
+	}
+	// complete the TLS handshake first, so that peer certificates are available in OnOpened
+	if tc, ok := c.conn.(*tls.Conn); ok {
+		_ = tc.SetReadDeadline(c.getReadDeadLine())
+		if err := tc.Handshake(); err != nil {
+			c.s.opts.Logger.Debugf("TLS conn:%s handshake error:[%v]", c.RemoteAddr(), err)
+			return
+		}
+	}
+
 	h := c.s.opts.Handler
 	h.OnOpened(c)
 
@@ -163,38 +358,53 @@ func (c *Conn) handleReadLoop(ctx context.Context) {
 		if err := c.conn.SetReadDeadline(c.getReadDeadLine()); err != nil {
 			c.s.opts.Logger.Warnf("TCP conn SetReadDeadline error:[%v]", err)
 		}
-		if _, err := c.buffer.ReadFromReader(); err != nil {
+		// checked after setting the deadline, which may override the one set by shutdown
+		if c.isDraining() {
+			return
+		}
+		n, err := c.buffer.ReadFromReader()
+		c.stats.Read(n, c.buffer.Cap())
+		if err != nil {
 			select {
 			case <-c.closeChan:
 				return
 			default:
 			}
+			if c.isDraining() {
+				return
+			}
 			if err != io.EOF {
 				c.s.opts.Logger.Debugf("TCP conn read error:[%v]", err)
 			}
 			return
 		}
-		for c.buffer.Len() > 0 {
-			bodyLen, headerLen := c.s.opts.HeaderCodec.Decode(c.buffer.Data())
-			if headerLen == 0 {
-				break
-			}
-			msgLen := bodyLen + headerLen
-			if msgLen > c.s.opts.MaxReadBufLen {
-				c.s.opts.Logger.Errorf("msg len:%d greater than max:%d", msgLen, c.s.opts.MaxReadBufLen)
+		for c.buffer.Len() > 0 && !c.isDraining() {
+			buf, ok, err := c.buffer.ReadFrame(c.s.opts.HeaderCodec, c.s.opts.MaxReadBufLen)
+			if err != nil {
+				c.s.opts.Logger.Errorf("TCP conn decode error:[%v]", err)
 				return
 			}
-			if uint32(c.buffer.Len()) < msgLen {
+			if !ok {
 				break
 			}
-			buf := make([]byte, bodyLen)
-			c.buffer.Read(int(headerLen), int(bodyLen), buf)
-			if bodyLen == c.s.heartLen {
+			if c.s.heartLen > 0 && uint32(len(buf)) == c.s.heartLen {
 				if c.s.isHeartBeat(buf) {
-					_ = c.Write(buf)
+					c.stats.Heartbeat()
+					if c.s.opts.HeartPingInterval <= 0 {
+						_ = c.Write(buf)
+					}
 					continue
 				}
 			}
+			c.stats.MsgRead()
+			if c.s.workers != nil {
+				c.hwg.Add(1)
+				if err := c.s.workers.Dispatch(c, buf, c.closeChan, c.hwg.Done); err != nil {
+					c.s.opts.Logger.Infof("TcpConn dispatch error:[%v]", err)
+					return
+				}
+				continue
+			}
 			if err := h.OnReadMsg(c, buf); err != nil {
 				c.s.opts.Logger.Infof("TcpConn OnReadMsg error:[%v]", err)
 				return
@@ -215,21 +425,13 @@ func (c *Conn) handleWriteLoop(ctx context.Context) {
 			return
 		case <-c.closeChan:
 			return
-		case data, ok := <-c.sendChan:
-			if !ok {
-				return
-			}
-			if err := c.write(data); err != nil {
-				c.s.opts.Handler.OnWriteError(c, data, err)
+		case <-c.queue.Ready():
+			if failed, err := c.writer.WriteQueued(c.queue, c.getWriteDeadLine); err != nil {
+				for _, f := range failed {
+					c.s.opts.Handler.OnWriteError(c, f.Body, err)
+				}
 				return
 			}
 		}
 	}
 }
-
-func (c *Conn) write(data []byte) (err error) {
-	data = c.s.opts.HeaderCodec.Encode(data)
-	_ = c.conn.SetWriteDeadline(c.getWriteDeadLine())
-	_, err = c.conn.Write(data)
-	return
-}
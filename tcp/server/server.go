@@ -23,6 +23,7 @@ package server
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
 	"os"
 	"os/signal"
@@ -32,8 +33,13 @@ import (
 	"time"
 
 	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/connstat"
+	"github.com/izhw/gnet/internal/metric"
+	"github.com/izhw/gnet/internal/registry"
 	"github.com/izhw/gnet/internal/util/delay"
 	"github.com/izhw/gnet/internal/util/limter"
+	"github.com/izhw/gnet/internal/worker"
+	"github.com/izhw/gnet/tcp/internal"
 )
 
 const DefaultAddr = "0.0.0.0:7777"
@@ -41,14 +47,22 @@ const DefaultAddr = "0.0.0.0:7777"
 var _ gcore.Server = &Server{}
 
 type Server struct {
-	opts     gcore.Options
-	listener net.Listener
-	limiter  limter.Limiter
-	stopChan chan struct{}
-	wg       sync.WaitGroup
-	heartLen uint32
-	connNum  uint32
-	stopped  int32
+	opts      gcore.Options
+	listeners []net.Listener // more than one with SO_REUSEPORT, see WithReusePort
+	limiter   limter.Limiter
+	ctx       context.Context // ctx of conns, canceled when stopped
+	cancel    context.CancelFunc
+	stopChan  chan struct{}
+	wg        sync.WaitGroup // accept goroutines
+	cwg       sync.WaitGroup // conns
+	conns     *registry.Registry
+	workers   *worker.Pool // nil if WorkerNum is 0
+	metrics   *metric.Server
+	heart     *connstat.HeartKeeper // nil if HeartTimeout and HeartPingInterval are 0
+	trusted   []*net.IPNet          // sources of PROXY protocol headers
+	heartLen  uint32
+	connNum   uint32
+	stopped   int32
 }
 
 func NewServer() *Server {
@@ -68,15 +82,39 @@ func (s *Server) Init(opts ...gcore.Option) error {
 	if s.opts.Addr == "" {
 		s.opts.Addr = DefaultAddr
 	}
-	l, err := net.Listen("tcp", s.opts.Addr)
-	if err != nil {
+	if cfg := s.opts.TLSConfig; cfg != nil {
+		if len(cfg.Certificates) == 0 && cfg.GetCertificate == nil && cfg.GetConfigForClient == nil {
+			return errors.New("tls: neither Certificates, GetCertificate, nor GetConfigForClient set in TLSConfig")
+		}
+	}
+	if s.opts.HeartPingInterval > 0 && len(s.opts.HeartData) == 0 {
+		return errors.New("server ping: HeartData not set")
+	}
+	if pp := s.opts.ProxyProtocol; pp.Enabled {
+		if len(pp.TrustedCIDRs) == 0 {
+			return errors.New("proxy protocol: TrustedCIDRs not set")
+		}
+		trusted, err := internal.ParseCIDRs(pp.TrustedCIDRs)
+		if err != nil {
+			return fmt.Errorf("proxy protocol trusted sources:%w", err)
+		}
+		s.trusted = trusted
+	}
+	if err := s.listen(); err != nil {
 		return err
 	}
-	s.listener = l
+	s.opts.Handler = gcore.WrapHandler(s.opts.Handler, s.opts.Interceptors)
 	if s.opts.ConnLimit > 0 {
 		s.limiter = limter.NewLimiter(s.opts.ConnLimit)
 	}
+	s.ctx, s.cancel = context.WithCancel(s.opts.Ctx)
 	s.stopChan = make(chan struct{})
+	s.conns = registry.New()
+	s.metrics = metric.NewServer(&s.opts)
+	if s.opts.WorkerNum > 0 {
+		s.workers = worker.NewPool(&s.opts)
+	}
+	s.heart = connstat.NewHeartKeeper(s.opts.HeartTimeout, s.opts.HeartPingInterval)
 	s.heartLen = uint32(len(s.opts.HeartData))
 	s.stopped = 0
 
@@ -87,29 +125,126 @@ func (s *Server) Serve() error {
 	if atomic.LoadInt32(&s.stopped) == 1 {
 		return errors.New("server uninitialized")
 	}
-	s.wg.Add(1)
-	go s.work()
+	if s.workers != nil {
+		s.workers.Start()
+	}
+	s.heart.Start()
+	for _, l := range s.listeners {
+		s.wg.Add(1)
+		go s.work(l)
+	}
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	var rc chan os.Signal
+	if s.opts.RestartSignal != nil {
+		rc = make(chan os.Signal, 1)
+		signal.Notify(rc, s.opts.RestartSignal)
+		defer signal.Stop(rc)
+	}
 
-	select {
-	case <-s.opts.Ctx.Done():
-		s.Stop()
-		return s.opts.Ctx.Err()
-	case <-s.stopChan:
-		s.wait()
-	case sig := <-c:
-		s.Stop()
-		return errors.New("signal:" + sig.String())
+	for {
+		select {
+		case <-s.opts.Ctx.Done():
+			s.Stop()
+			return s.opts.Ctx.Err()
+		case <-s.stopChan:
+			// conns are waited for by Stop or Shutdown
+			s.wg.Wait()
+		case sig := <-c:
+			s.Stop()
+			return errors.New("signal:" + sig.String())
+		case <-rc:
+			if err := s.handOver(); err != nil {
+				s.opts.Logger.Errorf("TCP server restart error:[%v]", err)
+				continue
+			}
+			ctx := context.Background()
+			if s.opts.RestartTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, s.opts.RestartTimeout)
+				defer cancel()
+			}
+			return s.Shutdown(ctx)
+		}
+		return nil
+	}
+}
+
+// Restart hands the listeners over to a new process of the same executable with the same
+// args and env, which adopts them in Init, then shuts down gracefully like Shutdown.
+// New conns wait in the accept queue until the new process accepts them, none are refused.
+func (s *Server) Restart(ctx context.Context) error {
+	if err := s.handOver(); err != nil {
+		return err
+	}
+	return s.Shutdown(ctx)
+}
+
+// handOver starts the new process with the listeners
+func (s *Server) handOver() error {
+	if atomic.LoadInt32(&s.stopped) == 1 {
+		return errors.New("server stopped")
 	}
+	pid, err := internal.StartChild(s.listeners)
+	if err != nil {
+		return err
+	}
+	s.opts.Logger.Infof("TCP server listeners handed over to process:%d", pid)
 	return nil
 }
 
+// listen uses Listener if set, or adopts the listeners handed over by the parent process if any,
+// see Restart, otherwise opens ListenerNum listeners on Addr, with SO_REUSEPORT if more than one
+func (s *Server) listen() error {
+	if s.opts.Listener != nil {
+		s.listeners = []net.Listener{s.opts.Listener}
+		return nil
+	}
+	ls, err := internal.InheritedListeners()
+	if err != nil {
+		return err
+	}
+	if len(ls) > 0 {
+		s.opts.Logger.Infof("TCP server adopted %d listeners on %s from the parent process", len(ls), ls[0].Addr())
+		s.listeners = ls
+		return nil
+	}
+	num := s.opts.ListenerNum
+	if num > 1 && (!internal.ReusePortSupported || internal.IsUnixAddr(s.opts.Addr)) {
+		s.opts.Logger.Warnf("TCP server SO_REUSEPORT not supported, using one listener")
+		num = 1
+	}
+	if num < 1 {
+		num = 1
+	}
+	reusePort := num > 1
+	addr := s.opts.Addr
+	s.listeners = make([]net.Listener, 0, num)
+	for i := 0; i < num; i++ {
+		l, err := internal.Listen(addr, &s.opts.Socket, reusePort)
+		if err != nil {
+			s.closeListeners()
+			return err
+		}
+		if i == 0 && num > 1 {
+			addr = internal.WithPort(addr, l.Addr().(*net.TCPAddr).Port)
+		}
+		s.listeners = append(s.listeners, l)
+	}
+	return nil
+}
+
+func (s *Server) closeListeners() {
+	for _, l := range s.listeners {
+		l.Close()
+	}
+}
+
+// wait waits for the accept goroutines to exit and all conns to be closed
 func (s *Server) wait() {
 	s.wg.Wait()
-	for atomic.LoadUint32(&s.connNum) > 0 {
-	}
+	s.cwg.Wait()
 }
 
 func (s *Server) Stop() {
@@ -117,19 +252,170 @@ func (s *Server) Stop() {
 		return
 	}
 	close(s.stopChan)
-	s.listener.Close()
+	s.closeListeners()
+	s.cancel()
 	s.wait()
+	s.release()
+}
+
+// Shutdown stops accepting, calls OnShutdown of the handler for each conn if implemented,
+// then each conn stops reading, and is closed after the in-flight OnReadMsg returns
+// and its send queue is flushed. Conns which are still open when ctx is done are closed
+// forcibly, and ctx.Err() is returned without waiting for them to exit.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.stopped, 0, 1) {
+		s.wait()
+		return nil
+	}
+	close(s.stopChan)
+	s.closeListeners()
+	s.wg.Wait()
+
+	h, _ := s.opts.Handler.(gcore.ShutdownHandler)
+	s.conns.Range(func(c gcore.Conn) bool {
+		if h != nil {
+			h.OnShutdown(c)
+		}
+		c.(*Conn).shutdown()
+		return true
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.cwg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		s.cancel()
+		s.release()
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		s.conns.Range(func(c gcore.Conn) bool {
+			c.(*Conn).forceClose()
+			return true
+		})
+		// a conn may still be in a stuck OnReadMsg, the workers are released after it returns
+		go func() {
+			<-done
+			s.release()
+		}()
+		return ctx.Err()
+	}
+}
+
+// release stops the workers and the heart keeper, called after all conns are closed
+func (s *Server) release() {
+	if s.workers != nil {
+		s.workers.Stop()
+	}
+	s.heart.Stop()
+}
+
+func (s *Server) WorkerStats() gcore.WorkerStats {
+	return s.workers.Stats()
 }
 
 func (s *Server) ConnNum() uint32 {
 	return atomic.LoadUint32(&s.connNum)
 }
 
+func (s *Server) GetConn(id uint64) (gcore.Conn, bool) {
+	return s.conns.Get(id)
+}
+
+func (s *Server) GetConnsByTag(tag string) []gcore.Conn {
+	return s.conns.GetByTag(tag)
+}
+
+func (s *Server) RangeConns(f func(c gcore.Conn) bool) {
+	s.conns.Range(f)
+}
+
+func (s *Server) CloseConn(id uint64, reason string) error {
+	c, ok := s.conns.Get(id)
+	if !ok {
+		return gcore.ErrConnNotFound
+	}
+	s.opts.Logger.Infof("TCP server close conn:%d %s, reason:%s", id, c.RemoteAddr(), reason)
+	return c.Close()
+}
+
+func (s *Server) JoinGroup(group string, c gcore.Conn) error {
+	if !s.conns.Join(c, group) {
+		return gcore.ErrConnNotFound
+	}
+	return nil
+}
+
+func (s *Server) LeaveGroup(group string, c gcore.Conn) {
+	s.conns.Leave(c, group)
+}
+
+func (s *Server) Broadcast(data []byte, policy gcore.SlowReceiverPolicy) (n int, err error) {
+	f, err := internal.EncodeFrame(s.opts.HeaderCodec, data)
+	if err != nil {
+		return 0, err
+	}
+	s.conns.Range(func(c gcore.Conn) bool {
+		if s.send(c.(*Conn), f, policy) {
+			n++
+		}
+		return true
+	})
+	return n, nil
+}
+
+func (s *Server) GroupBroadcast(group string, data []byte, policy gcore.SlowReceiverPolicy) (n int, err error) {
+	f, err := internal.EncodeFrame(s.opts.HeaderCodec, data)
+	if err != nil {
+		return 0, err
+	}
+	for _, c := range s.conns.GetGroup(group) {
+		if s.send(c.(*Conn), f, policy) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// send queues the shared frame f to c with policy
+func (s *Server) send(c *Conn, f internal.Frame, policy gcore.SlowReceiverPolicy) bool {
+	p := gcore.SendQueueDropNewest
+	switch policy {
+	case gcore.SlowReceiverBlock:
+		p = gcore.SendQueueBlock
+	case gcore.SlowReceiverDisconnect:
+		p = gcore.SendQueueClose
+	}
+	return c.push(context.Background(), f, p, true) == nil
+}
+
+// proxyTrusted whether the PROXY protocol header of a conn from addr is read
+func (s *Server) proxyTrusted(addr net.Addr) bool {
+	if !s.opts.ProxyProtocol.Enabled {
+		return false
+	}
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range s.trusted {
+		if n.Contains(ta.IP) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Server) onConnClose() {
 	if s.limiter != nil {
 		s.limiter.Revert()
 	}
 	atomic.AddUint32(&s.connNum, ^uint32(0))
+	s.metrics.Conns.Add(-1)
+	s.cwg.Done()
 }
 
 // isHeartBeat called when len(data) == len(s.opts.HeartData)
@@ -142,17 +428,16 @@ func (s *Server) isHeartBeat(data []byte) bool {
 	return true
 }
 
-func (s *Server) work() {
-	ctx, cancel := context.WithCancel(s.opts.Ctx)
+// work accepts conns from l, there is one for each listener
+func (s *Server) work(l net.Listener) {
 	defer func() {
-		cancel()
 		s.wg.Done()
 		s.Stop()
 	}()
 
 	td := delay.NewTempDelay(5*time.Millisecond, time.Second)
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				d := td.GetDelay()
@@ -171,24 +456,20 @@ func (s *Server) work() {
 		td.Reset()
 		if s.limiter != nil && !s.limiter.Allow() {
 			conn.Close()
+			s.metrics.Rejected.Add(1)
 			s.opts.Logger.Warnf("TCP server accepted max num:%d, new conn rejected", s.opts.ConnLimit)
 			continue
 		}
-		tcpConn := conn.(*net.TCPConn)
-
-		// TCP keepalive
-		if err = tcpConn.SetKeepAlive(true); err != nil {
-			s.opts.Logger.Warnf("TCP server conn:%s SetKeepAlive error:[%v]", tcpConn.RemoteAddr(), err)
-		}
-		if err = tcpConn.SetKeepAlivePeriod(time.Minute * 1); err != nil {
-			s.opts.Logger.Warnf("TCP server conn:%s SetKeepAlivePeriod error:[%v]", tcpConn.RemoteAddr(), err)
-		}
-		// setting keepalive retry count and interval
-		if err := setKeepaliveParameters(tcpConn, 6, 10); err != nil {
-			s.opts.Logger.Warnf("TCP server conn:%s setKeepaliveParameters error:[%v]", tcpConn.RemoteAddr(), err)
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			if err := internal.ApplySocketOptions(tcpConn, &s.opts.Socket); err != nil {
+				s.opts.Logger.Warnf("TCP server conn:%s set socket options error:[%v]", tcpConn.RemoteAddr(), err)
+			}
 		}
 		// new conn
-		newConn(ctx, s, tcpConn)
 		atomic.AddUint32(&s.connNum, 1)
+		s.metrics.Accepted.Add(1)
+		s.metrics.Conns.Add(1)
+		s.cwg.Add(1)
+		newConn(s.ctx, s, conn)
 	}
 }
@@ -0,0 +1,450 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/connstat"
+	"github.com/izhw/gnet/internal/metric"
+	"github.com/izhw/gnet/internal/registry"
+	"github.com/izhw/gnet/tcp/internal"
+)
+
+var _ gcore.Conn = &Client{}
+
+// Client a WebSocket client dialing Addr as a ws:// or wss:// URL, each msg received is passed
+// to OnReadMsg like AsyncClient, and each Write sends a msg, see gcore.WebSocketOptions.
+// If HeartData is set, it is sent in a ping frame when nothing is written for HeartInterval.
+type Client struct {
+	id        uint64
+	opts      gcore.Options
+	conn      net.Conn
+	hr        *handshakeReader
+	br        *bufio.Reader
+	buffer    *internal.ReaderBuffer
+	reader    msgReader
+	queue     *internal.SendQueue
+	writer    *internal.BatchWriter
+	metrics   *metric.Client
+	stats     *connstat.Stats
+	closeChan chan struct{}
+	wwg       sync.WaitGroup
+	rwg       sync.WaitGroup
+	mu        sync.Mutex // guards the close code
+	closed    int32
+	tag       string
+	opcode    byte // of data frames
+	// set by the handshake
+	subprotocol string
+	deflate     bool
+	closeCode   int // sent in the close frame, 0 if not decided yet
+	closeReason string
+}
+
+func NewClient() *Client {
+	return &Client{
+		id: registry.NextID(),
+	}
+}
+
+func (c *Client) WithOptions(opts gcore.Options) {
+	c.opts = opts
+}
+
+func (c *Client) ID() uint64 {
+	return c.id
+}
+
+func (c *Client) Init(opts ...gcore.Option) error {
+	for _, opt := range opts {
+		opt(&c.opts)
+	}
+	if len(c.opts.HeartData) > maxControlPayload {
+		return errors.New("websocket ping: HeartData longer than 125 bytes")
+	}
+	c.metrics = metric.NewClient(&c.opts)
+	c.stats = connstat.NewStats(&c.metrics.IO)
+	if err := c.dial(); err != nil {
+		c.metrics.ConnectErrors.Add(1)
+		return err
+	}
+	c.metrics.Connects.Add(1)
+	c.opts.Handler = gcore.WrapHandler(c.opts.Handler, c.opts.Interceptors)
+	c.opcode = opBinary
+	if c.opts.WebSocket.Text {
+		c.opcode = opText
+	}
+	c.closeChan = make(chan struct{})
+	c.queue = internal.NewSendQueue(c.opts.SendQueueLen, c.opts.SendQueueBytes, c.closeChan)
+	c.writer = internal.NewBatchWriter(c.conn, c.opts.WriteBatchBytes, c.stats)
+	c.buffer = internal.NewReaderBuffer(c.br, int(c.opts.InitReadBufLen), int(c.opts.MaxReadBufLen)+maxHeaderLen)
+	c.reader = msgReader{deflate: c.deflate, max: maxMsgLen(c.opts.MaxReadBufLen)}
+	c.wwg.Add(1)
+	go c.handleWriteLoop()
+	c.rwg.Add(1)
+	go c.handleReadLoop()
+	return nil
+}
+
+// dial connects to the URL of Addr, performs the TLS handshake for wss, then the WebSocket handshake
+func (c *Client) dial() error {
+	u, err := url.Parse(c.opts.Addr)
+	if err != nil {
+		return err
+	}
+	var port string
+	switch u.Scheme {
+	case "ws":
+		port = "80"
+	case "wss":
+		port = "443"
+	default:
+		return errors.New("websocket: Addr must be a ws:// or wss:// URL")
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	conn, err := internal.Dial(addr, &c.opts.Socket)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "wss" {
+		cfg := c.opts.TLSConfig
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg = cfg.Clone()
+			cfg.ServerName = u.Hostname()
+		}
+		conn = tls.Client(conn, cfg)
+	}
+	c.hr = &handshakeReader{r: conn, n: maxHandshakeLen}
+	c.br = bufio.NewReader(c.hr)
+	_ = conn.SetDeadline(c.getReadDeadLine())
+	c.subprotocol, c.deflate, err = clientHandshake(conn, c.br, u, &c.opts.WebSocket)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	c.hr.n = -1
+	c.conn = conn
+	return nil
+}
+
+func (c *Client) Read(buf []byte) (n int, err error) {
+	return 0, gcore.ErrConnInvalidCall
+}
+
+func (c *Client) ReadFull(buf []byte) (n int, err error) {
+	return 0, gcore.ErrConnInvalidCall
+}
+
+func (c *Client) WriteRead(req []byte) (body []byte, err error) {
+	return nil, gcore.ErrConnInvalidCall
+}
+
+// Write sends data as a msg, in a text frame if WebSocketOptions.Text is set, otherwise a binary frame
+func (c *Client) Write(data []byte) error {
+	return c.enqueue(context.Background(), data, true)
+}
+
+func (c *Client) TryWrite(data []byte) error {
+	return c.enqueue(context.Background(), data, false)
+}
+
+func (c *Client) WriteContext(ctx context.Context, data []byte) error {
+	return c.enqueue(ctx, data, true)
+}
+
+// enqueue passes data through the interceptors and queues it,
+// wait: whether SendQueueBlock waits for room
+func (c *Client) enqueue(ctx context.Context, data []byte, wait bool) error {
+	if is := c.opts.Interceptors; len(is) > 0 {
+		return gcore.InterceptWrite(is, c, data, func(_ gcore.Conn, data []byte) error {
+			return c.send(ctx, data, wait)
+		})
+	}
+	return c.send(ctx, data, wait)
+}
+
+// send encodes data and queues it
+func (c *Client) send(ctx context.Context, data []byte, wait bool) error {
+	if len(data) == 0 {
+		return nil
+	}
+	deflate := c.deflate && len(data) >= c.opts.WebSocket.CompressThreshold
+	return c.push(ctx, encodeFrame(c.opcode, data, deflate, true), c.opts.SendQueuePolicy, wait)
+}
+
+// push queues the encoded frame f with policy
+func (c *Client) push(ctx context.Context, f internal.Frame, policy gcore.SendQueuePolicy, wait bool) error {
+	full, err := c.queue.Push(ctx, f, policy, wait)
+	if full {
+		c.metrics.SendQueueFull.Add(1)
+		if h, ok := c.opts.Handler.(gcore.SendQueueFullHandler); ok {
+			h.OnSendQueueFull(c, f.Body)
+		}
+	}
+	if err == gcore.ErrSendQueueFull && policy == gcore.SendQueueClose {
+		c.opts.Logger.Infof("WebSocket client send queue full, closing")
+		go c.CloseWithReason(ClosePolicyViolation, "send queue full")
+	}
+	return err
+}
+
+// Close closes c with CloseNormal
+func (c *Client) Close() error {
+	return c.CloseWithReason(CloseNormal, "")
+}
+
+// CloseWithReason sends a close frame of code and reason after the queued msgs, waits a while
+// for the close frame of the server, then closes the connection.
+// code should be one of the Close codes which may be sent, or in 3000-4999 for applications.
+func (c *Client) CloseWithReason(code int, reason string) (err error) {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return
+	}
+	c.setCloseCode(code, reason)
+	close(c.closeChan)
+	c.wwg.Wait()
+	for {
+		failed, err := c.writer.WriteQueued(c.queue, c.getWriteDeadLine)
+		if err == nil {
+			break
+		}
+		for _, f := range failed {
+			c.opts.Handler.OnWriteError(c, f.Body, err)
+		}
+	}
+	if c.writeClose() == nil {
+		// the read loop exits on the close frame of the server
+		_ = c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+		c.rwg.Wait()
+	}
+	err = c.conn.Close()
+	c.rwg.Wait()
+	c.buffer.Release()
+	c.opts.Handler.OnClosed(c)
+	return
+}
+
+// setCloseCode sets the code of the close frame, the first one is used
+func (c *Client) setCloseCode(code int, reason string) {
+	c.mu.Lock()
+	if c.closeCode == 0 {
+		c.closeCode, c.closeReason = code, reason
+	}
+	c.mu.Unlock()
+}
+
+// writeClose writes the close frame directly after the send queue is flushed
+func (c *Client) writeClose() error {
+	c.mu.Lock()
+	code, reason := c.closeCode, c.closeReason
+	c.mu.Unlock()
+	return c.writeControl(opClose, closePayload(code, reason), time.Now().Add(closeTimeout))
+}
+
+// writeControl writes a control frame directly, called by the write loop or after it exits
+func (c *Client) writeControl(opcode byte, payload []byte, deadline time.Time) error {
+	f := encodeFrame(opcode, payload, false, true)
+	_ = c.conn.SetWriteDeadline(deadline)
+	n, err := c.conn.Write(f.Data)
+	c.stats.Written(0, n)
+	if err != nil {
+		c.stats.WriteFailed()
+	}
+	return err
+}
+
+func (c *Client) Closed() bool {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return true
+	}
+	return false
+}
+
+func (c *Client) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Client) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Client) PeerCertificates() []*x509.Certificate {
+	return internal.PeerCertificates(c.conn)
+}
+
+// Subprotocol returns the subprotocol selected by the server, "" if none
+func (c *Client) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (c *Client) Stats() (st gcore.ConnStats) {
+	c.stats.Fill(&st)
+	st.SendQueueLen, st.SendQueueBytes = c.queue.Size()
+	return
+}
+
+func (c *Client) SetTag(tag string) {
+	c.tag = tag
+}
+
+func (c *Client) GetTag() string {
+	return c.tag
+}
+
+func (c *Client) getReadDeadLine() (t time.Time) {
+	if c.opts.ReadTimeout > 0 {
+		t = time.Now().Add(c.opts.ReadTimeout)
+	}
+	return
+}
+
+func (c *Client) getWriteDeadLine() (t time.Time) {
+	if c.opts.WriteTimeout > 0 {
+		t = time.Now().Add(c.opts.WriteTimeout)
+	}
+	return
+}
+
+func (c *Client) handleReadLoop() {
+	defer func() {
+		c.rwg.Done()
+		c.Close()
+	}()
+
+	h := c.opts.Handler
+	h.OnOpened(c)
+
+	for {
+		if c.Closed() {
+			_ = c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+		}
+		n, err := c.buffer.ReadFromReader()
+		c.stats.Read(n, c.buffer.Cap())
+		if err != nil {
+			if !c.Closed() && err != io.EOF {
+				c.opts.Logger.Debugf("WebSocket client read error:[%v]", err)
+			}
+			return
+		}
+		for c.buffer.Len() > 0 {
+			opcode, msg, ok, err := c.reader.next(c.buffer)
+			if err != nil {
+				c.opts.Logger.Warnf("WebSocket client read error:[%v]", err)
+				if ce, ok := err.(*CloseError); ok {
+					c.setCloseCode(ce.Code, ce.Reason)
+				}
+				return
+			}
+			if !ok {
+				break
+			}
+			switch opcode {
+			case 0:
+				// a fragment
+				continue
+			case opPing:
+				_ = c.push(context.Background(), encodeFrame(opPong, msg, false, true), gcore.SendQueueDropNewest, false)
+				continue
+			case opPong:
+				continue
+			case opClose:
+				ce, err := parseClose(msg)
+				if err != nil {
+					c.setCloseCode(CloseProtocolError, "")
+					return
+				}
+				// echo the code
+				c.setCloseCode(ce.Code, "")
+				return
+			}
+			// msgs received after Close are dropped while waiting for the close frame
+			if c.Closed() {
+				continue
+			}
+			c.stats.MsgRead()
+			if err := h.OnReadMsg(c, msg); err != nil {
+				c.opts.Logger.Infof("WebSocket client OnReadMsg error:[%v]", err)
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) handleWriteLoop() {
+	var heartbeat <-chan time.Time
+	if len(c.opts.HeartData) > 0 && c.opts.HeartInterval > 0 {
+		ticker := time.NewTicker(c.opts.HeartInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	defer func() {
+		c.wwg.Done()
+		c.Close()
+	}()
+
+	written := false // since the last tick
+	for {
+		select {
+		case <-c.opts.Ctx.Done():
+			c.setCloseCode(CloseGoingAway, "")
+			return
+		case <-c.closeChan:
+			return
+		case <-c.queue.Ready():
+			if failed, err := c.writer.WriteQueued(c.queue, c.getWriteDeadLine); err != nil {
+				for _, f := range failed {
+					c.opts.Handler.OnWriteError(c, f.Body, err)
+				}
+				return
+			}
+			written = true
+		case <-heartbeat:
+			if written {
+				written = false
+				continue
+			}
+			c.stats.Heartbeat()
+			if err := c.writeControl(opPing, c.opts.HeartData, c.getWriteDeadLine()); err != nil {
+				c.opts.Logger.Infof("WebSocket client write ping error:[%v]", err)
+				return
+			}
+		}
+	}
+}
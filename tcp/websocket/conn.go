@@ -0,0 +1,519 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/connstat"
+	"github.com/izhw/gnet/internal/registry"
+	"github.com/izhw/gnet/tcp/internal"
+)
+
+// closeTimeout bounds writing the close frame and waiting for the one of the peer
+const closeTimeout = time.Second
+
+var (
+	_ gcore.Conn         = &Conn{}
+	_ gcore.PeerCredConn = &Conn{}
+)
+
+type Conn struct {
+	id        uint64
+	s         *Server
+	conn      net.Conn // TLS conn over raw if TLS is enabled
+	raw       net.Conn // accepted TCP or unix socket conn
+	hr        *handshakeReader
+	br        *bufio.Reader
+	buffer    *internal.ReaderBuffer
+	reader    msgReader
+	queue     *internal.SendQueue
+	writer    *internal.BatchWriter
+	stats     *connstat.Stats
+	heart     *connstat.HeartWatch
+	closeChan chan struct{}
+	wwg       sync.WaitGroup
+	rwg       sync.WaitGroup
+	hwg       sync.WaitGroup // msgs dispatched to workers
+	mu        sync.Mutex     // guards tag, registered and the close code
+	closed    int32
+	draining  int32
+	opened    int32 // the handshake is completed
+	tag       string
+	// registered c is in the registry of the server
+	registered  bool
+	closeCode   int // sent in the close frame, 0 if not decided yet
+	closeReason string
+	// set by the handshake
+	request     *http.Request
+	subprotocol string
+	deflate     bool
+}
+
+func newConn(ctx context.Context, s *Server, conn net.Conn) *Conn {
+	c := &Conn{
+		id:        registry.NextID(),
+		s:         s,
+		conn:      conn,
+		raw:       conn,
+		closeChan: make(chan struct{}),
+	}
+	if s.opts.TLSConfig != nil {
+		c.conn = tls.Server(conn, s.opts.TLSConfig)
+	}
+	c.queue = internal.NewSendQueue(s.opts.SendQueueLen, s.opts.SendQueueBytes, c.closeChan)
+	c.stats = connstat.NewStats(&s.metrics.IO)
+	c.writer = internal.NewBatchWriter(c.conn, s.opts.WriteBatchBytes, c.stats)
+	c.heart = s.heart.Watch(c.stats, c.onIdle, c.ping)
+	c.hr = &handshakeReader{r: c.conn, n: maxHandshakeLen}
+	c.br = bufio.NewReader(c.hr)
+	c.buffer = internal.NewReaderBuffer(c.br, int(s.opts.InitReadBufLen), int(s.opts.MaxReadBufLen)+maxHeaderLen)
+	c.reader = msgReader{server: true, max: maxMsgLen(s.opts.MaxReadBufLen)}
+	c.wwg.Add(1)
+	go c.handleWriteLoop(ctx)
+	c.rwg.Add(1)
+	go c.handleReadLoop(ctx)
+	return c
+}
+
+func (c *Conn) ID() uint64 {
+	return c.id
+}
+
+func (c *Conn) Init(opts ...gcore.Option) error {
+	return nil
+}
+
+func (c *Conn) Read(buf []byte) (n int, err error) {
+	return 0, gcore.ErrConnInvalidCall
+}
+
+func (c *Conn) ReadFull(buf []byte) (n int, err error) {
+	return 0, gcore.ErrConnInvalidCall
+}
+
+func (c *Conn) WriteRead(req []byte) (body []byte, err error) {
+	return nil, gcore.ErrConnInvalidCall
+}
+
+// Write sends data as a msg, in a text frame if WebSocketOptions.Text is set, otherwise a binary frame
+func (c *Conn) Write(data []byte) error {
+	return c.enqueue(context.Background(), data, true)
+}
+
+func (c *Conn) TryWrite(data []byte) error {
+	return c.enqueue(context.Background(), data, false)
+}
+
+func (c *Conn) WriteContext(ctx context.Context, data []byte) error {
+	return c.enqueue(ctx, data, true)
+}
+
+// enqueue passes data through the interceptors and queues it,
+// wait: whether SendQueueBlock waits for room
+func (c *Conn) enqueue(ctx context.Context, data []byte, wait bool) error {
+	if is := c.s.opts.Interceptors; len(is) > 0 {
+		return gcore.InterceptWrite(is, c, data, func(_ gcore.Conn, data []byte) error {
+			return c.send(ctx, data, wait)
+		})
+	}
+	return c.send(ctx, data, wait)
+}
+
+// send encodes data and queues it
+func (c *Conn) send(ctx context.Context, data []byte, wait bool) error {
+	if len(data) == 0 {
+		return nil
+	}
+	f := encodeFrame(c.s.opcode, data, c.s.compressed(c, len(data)), false)
+	return c.push(ctx, f, c.s.opts.SendQueuePolicy, wait)
+}
+
+// control queues a control frame without waiting
+func (c *Conn) control(opcode byte, payload []byte) error {
+	f := encodeFrame(opcode, payload, false, false)
+	return c.push(context.Background(), f, gcore.SendQueueDropNewest, false)
+}
+
+// push queues the encoded frame f with policy
+func (c *Conn) push(ctx context.Context, f internal.Frame, policy gcore.SendQueuePolicy, wait bool) error {
+	full, err := c.queue.Push(ctx, f, policy, wait)
+	if full {
+		c.s.metrics.SendQueueFull.Add(1)
+		if h, ok := c.s.opts.Handler.(gcore.SendQueueFullHandler); ok {
+			h.OnSendQueueFull(c, f.Body)
+		}
+	}
+	if err == gcore.ErrSendQueueFull && policy == gcore.SendQueueClose {
+		c.s.opts.Logger.Infof("WebSocket conn:%d %s send queue full, closing", c.id, c.conn.RemoteAddr())
+		c.setCloseCode(ClosePolicyViolation, "send queue full")
+		// the read loop closes c, queued data is dropped
+		c.forceClose()
+	}
+	return err
+}
+
+// Close closes c with CloseNormal, or CloseGoingAway if the server is shutting down
+func (c *Conn) Close() error {
+	return c.CloseWithReason(CloseNormal, "")
+}
+
+// CloseWithReason sends a close frame of code and reason after the queued msgs, waits a while
+// for the close frame of the peer, then closes the connection.
+// code should be one of the Close codes which may be sent, or in 3000-4999 for applications.
+func (c *Conn) CloseWithReason(code int, reason string) (err error) {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return
+	}
+	c.setCloseCode(code, reason)
+	close(c.closeChan)
+	c.wwg.Wait()
+	for {
+		failed, err := c.writer.WriteQueued(c.queue, c.getWriteDeadLine)
+		if err == nil {
+			break
+		}
+		for _, f := range failed {
+			c.s.opts.Handler.OnWriteError(c, f.Body, err)
+		}
+	}
+	opened := atomic.LoadInt32(&c.opened) == 1
+	if opened && c.writeClose() == nil {
+		// the read loop exits on the close frame of the peer
+		_ = c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+		c.rwg.Wait()
+	}
+	err = c.conn.Close()
+	c.rwg.Wait()
+	c.heart.Stop()
+	c.buffer.Release()
+	c.unregister()
+	// OnOpened is not called if the handshake failed
+	if opened {
+		c.s.opts.Handler.OnClosed(c)
+	}
+	c.s.onConnClose()
+	return
+}
+
+// setCloseCode sets the code of the close frame, the first one is used
+func (c *Conn) setCloseCode(code int, reason string) {
+	c.mu.Lock()
+	if c.closeCode == 0 {
+		c.closeCode, c.closeReason = code, reason
+	}
+	c.mu.Unlock()
+}
+
+// writeClose writes the close frame directly after the send queue is flushed
+func (c *Conn) writeClose() error {
+	c.mu.Lock()
+	code, reason := c.closeCode, c.closeReason
+	c.mu.Unlock()
+	f := encodeFrame(opClose, closePayload(code, reason), false, false)
+	bufs := net.Buffers(f.AppendTo(nil))
+	_ = c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	_, err := bufs.WriteTo(c.conn)
+	return err
+}
+
+func (c *Conn) Closed() bool {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return true
+	}
+	return false
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) PeerCertificates() []*x509.Certificate {
+	return internal.PeerCertificates(c.conn)
+}
+
+func (c *Conn) PeerCred() (gcore.PeerCred, error) {
+	uc, ok := c.raw.(*net.UnixConn)
+	if !ok {
+		return gcore.PeerCred{}, gcore.ErrPeerCredUnavailable
+	}
+	return internal.PeerCred(uc)
+}
+
+// Request returns the handshake request, e.g. for the URL, cookies or headers, nil before OnOpened
+func (c *Conn) Request() *http.Request {
+	return c.request
+}
+
+// Subprotocol returns the subprotocol selected by the handshake, "" if none
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (c *Conn) Stats() (st gcore.ConnStats) {
+	c.stats.Fill(&st)
+	st.SendQueueLen, st.SendQueueBytes = c.queue.Size()
+	return
+}
+
+func (c *Conn) SetTag(tag string) {
+	c.mu.Lock()
+	if c.registered {
+		c.s.conns.Retag(c, c.tag, tag)
+	}
+	c.tag = tag
+	c.mu.Unlock()
+}
+
+func (c *Conn) GetTag() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tag
+}
+
+// register called after the handshake, so that no broadcast frame precedes the response
+func (c *Conn) register() {
+	c.mu.Lock()
+	c.s.conns.Add(c, c.tag)
+	c.registered = true
+	c.mu.Unlock()
+}
+
+func (c *Conn) unregister() {
+	c.mu.Lock()
+	if c.registered {
+		c.s.conns.Remove(c, c.tag)
+		c.registered = false
+	}
+	c.mu.Unlock()
+}
+
+// shutdown stops reading new msgs, the read loop exits after the in-flight OnReadMsg returns,
+// then c is closed with CloseGoingAway after the send queue is flushed
+func (c *Conn) shutdown() {
+	c.setCloseCode(CloseGoingAway, "server shutting down")
+	atomic.StoreInt32(&c.draining, 1)
+	_ = c.conn.SetReadDeadline(time.Now())
+}
+
+func (c *Conn) isDraining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
+
+// onIdle called by the heart keeper when c has received nothing for HeartTimeout
+func (c *Conn) onIdle() {
+	go func() {
+		c.s.opts.Logger.Infof("WebSocket conn:%d %s idle timeout, closing", c.id, c.conn.RemoteAddr())
+		if h, ok := c.s.opts.Handler.(gcore.IdleTimeoutHandler); ok {
+			h.OnIdleTimeout(c)
+		}
+		c.CloseWithReason(CloseGoingAway, "idle timeout")
+	}()
+}
+
+// ping called by the heart keeper when c is silent for HeartPingInterval
+func (c *Conn) ping() {
+	if atomic.LoadInt32(&c.opened) == 1 {
+		_ = c.control(opPing, c.s.opts.HeartData)
+	}
+}
+
+// forceClose closes the underlying conn, pending reads and writes fail immediately
+func (c *Conn) forceClose() {
+	_ = c.conn.Close()
+}
+
+func (c *Conn) getReadDeadLine() (t time.Time) {
+	if c.s.opts.ReadTimeout > 0 {
+		t = time.Now().Add(c.s.opts.ReadTimeout)
+	}
+	return
+}
+
+func (c *Conn) getWriteDeadLine() (t time.Time) {
+	if c.s.opts.WriteTimeout > 0 {
+		t = time.Now().Add(c.s.opts.WriteTimeout)
+	}
+	return
+}
+
+// handshake completes the TLS and WebSocket handshakes, the msgs read after them are framed
+func (c *Conn) handshake() bool {
+	_ = c.conn.SetReadDeadline(c.getReadDeadLine())
+	// complete the TLS handshake first, so that peer certificates are available in OnOpened
+	if tc, ok := c.conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			c.s.opts.Logger.Debugf("TLS conn:%s handshake error:[%v]", c.conn.RemoteAddr(), err)
+			return false
+		}
+	}
+	_ = c.conn.SetWriteDeadline(c.getWriteDeadLine())
+	req, protocol, deflate, err := serverHandshake(c.conn, c.br, &c.s.opts.WebSocket)
+	if err != nil {
+		c.s.opts.Logger.Debugf("WebSocket conn:%s handshake error:[%v]", c.conn.RemoteAddr(), err)
+		return false
+	}
+	c.hr.n = -1
+	c.request, c.subprotocol, c.deflate = req, protocol, deflate
+	c.reader.deflate = deflate
+	return true
+}
+
+// fail closes c with the code of err, which is a *CloseError
+func (c *Conn) fail(err error) {
+	c.s.opts.Logger.Infof("WebSocket conn:%d %s error:[%v]", c.id, c.conn.RemoteAddr(), err)
+	if ce, ok := err.(*CloseError); ok {
+		c.setCloseCode(ce.Code, ce.Reason)
+	}
+}
+
+func (c *Conn) handleReadLoop(ctx context.Context) {
+	defer func() {
+		// in-flight msgs are handled before closing when shutting down
+		if c.isDraining() {
+			c.hwg.Wait()
+		}
+		c.rwg.Done()
+		c.Close()
+	}()
+
+	if !c.handshake() {
+		return
+	}
+	c.register()
+	atomic.StoreInt32(&c.opened, 1)
+	h := c.s.opts.Handler
+	h.OnOpened(c)
+
+	for {
+		select {
+		case <-ctx.Done():
+			c.setCloseCode(CloseGoingAway, "server stopped")
+			return
+		default:
+		}
+
+		if err := c.conn.SetReadDeadline(c.getReadDeadLine()); err != nil {
+			c.s.opts.Logger.Warnf("WebSocket conn SetReadDeadline error:[%v]", err)
+		}
+		// checked after setting the deadline, which may override the ones set by shutdown and Close
+		if c.isDraining() {
+			return
+		}
+		if c.Closed() {
+			_ = c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+		}
+		n, err := c.buffer.ReadFromReader()
+		c.stats.Read(n, c.buffer.Cap())
+		if err != nil {
+			if !c.Closed() && !c.isDraining() && err != io.EOF {
+				c.s.opts.Logger.Debugf("WebSocket conn read error:[%v]", err)
+			}
+			return
+		}
+		for c.buffer.Len() > 0 && !c.isDraining() {
+			opcode, msg, ok, err := c.reader.next(c.buffer)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			if !ok {
+				break
+			}
+			switch opcode {
+			case 0:
+				// a fragment
+				continue
+			case opPing:
+				c.stats.Heartbeat()
+				_ = c.control(opPong, msg)
+				continue
+			case opPong:
+				c.stats.Heartbeat()
+				continue
+			case opClose:
+				ce, err := parseClose(msg)
+				if err != nil {
+					c.fail(err)
+					return
+				}
+				// echo the code
+				c.setCloseCode(ce.Code, "")
+				return
+			}
+			// msgs received after Close are dropped while waiting for the close frame
+			if c.Closed() {
+				continue
+			}
+			c.stats.MsgRead()
+			if c.s.workers != nil {
+				c.hwg.Add(1)
+				if err := c.s.workers.Dispatch(c, msg, c.closeChan, c.hwg.Done); err != nil {
+					c.s.opts.Logger.Infof("WebSocket conn dispatch error:[%v]", err)
+					return
+				}
+				continue
+			}
+			if err := h.OnReadMsg(c, msg); err != nil {
+				c.s.opts.Logger.Infof("WebSocket conn OnReadMsg error:[%v]", err)
+				return
+			}
+		}
+	}
+}
+
+func (c *Conn) handleWriteLoop(ctx context.Context) {
+	defer func() {
+		c.wwg.Done()
+		c.Close()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			c.setCloseCode(CloseGoingAway, "server stopped")
+			return
+		case <-c.closeChan:
+			return
+		case <-c.queue.Ready():
+			if failed, err := c.writer.WriteQueued(c.queue, c.getWriteDeadLine); err != nil {
+				for _, f := range failed {
+					c.s.opts.Handler.OnWriteError(c, f.Body, err)
+				}
+				return
+			}
+		}
+	}
+}
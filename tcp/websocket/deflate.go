@@ -0,0 +1,168 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// permessage-deflate of RFC 7692 without context takeover, each msg is compressed independently
+const (
+	extDeflate       = "permessage-deflate"
+	extDeflateParams = "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+)
+
+// deflateTail is removed from the end of a compressed msg, and appended with a final empty block
+// to inflate it
+var (
+	deflateTail  = []byte{0x00, 0x00, 0xff, 0xff}
+	inflateTail  = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+	flateWriters = sync.Pool{New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	}}
+	flateReaders sync.Pool
+)
+
+// compress compresses msg for a frame with rsv1 set
+func compress(msg []byte) []byte {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(&buf)
+	_, _ = w.Write(msg)
+	_ = w.Flush()
+	flateWriters.Put(w)
+	b := buf.Bytes()
+	if bytes.HasSuffix(b, deflateTail) {
+		b = b[:len(b)-len(deflateTail)]
+	}
+	return b
+}
+
+// decompress decompresses a msg of at most max bytes
+func decompress(data []byte, max int) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(data), bytes.NewReader(inflateTail))
+	r, _ := flateReaders.Get().(io.ReadCloser)
+	if r == nil {
+		r = flate.NewReader(src)
+	} else {
+		_ = r.(flate.Resetter).Reset(src, nil)
+	}
+	defer flateReaders.Put(r)
+	msg, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, &CloseError{Code: CloseInvalidPayload, Reason: "invalid compressed data"}
+	}
+	if len(msg) > max {
+		return nil, &CloseError{Code: CloseTooLarge, Reason: "msg too large"}
+	}
+	return msg, nil
+}
+
+// extension an offer or a response in Sec-WebSocket-Extensions
+type extension struct {
+	name   string
+	params map[string]string
+}
+
+// parseExtensions parses the values of Sec-WebSocket-Extensions
+func parseExtensions(values []string) []extension {
+	var exts []extension
+	for _, v := range values {
+		for _, e := range strings.Split(v, ",") {
+			parts := strings.Split(e, ";")
+			name := strings.TrimSpace(parts[0])
+			if name == "" {
+				continue
+			}
+			ext := extension{name: strings.ToLower(name), params: make(map[string]string)}
+			for _, p := range parts[1:] {
+				kv := strings.SplitN(p, "=", 2)
+				k := strings.ToLower(strings.TrimSpace(kv[0]))
+				if k == "" {
+					continue
+				}
+				val := ""
+				if len(kv) == 2 {
+					val = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+				}
+				ext.params[k] = val
+			}
+			exts = append(exts, ext)
+		}
+	}
+	return exts
+}
+
+// acceptDeflate whether the server accepts one of the permessage-deflate offers of the client.
+// Only the default window of 15 bits is supported for compressing.
+func acceptDeflate(offers []extension) bool {
+	for _, e := range offers {
+		if e.name != extDeflate {
+			continue
+		}
+		ok := true
+		for k, v := range e.params {
+			switch k {
+			case "server_no_context_takeover", "client_no_context_takeover", "client_max_window_bits":
+			case "server_max_window_bits":
+				ok = v == "15"
+			default:
+				ok = false
+			}
+			if !ok {
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDeflateResponse whether the response of the server to the offer of the client is acceptable,
+// deflate reports whether permessage-deflate is negotiated
+func checkDeflateResponse(exts []extension, offered bool) (deflate bool, ok bool) {
+	for _, e := range exts {
+		if e.name != extDeflate || !offered || deflate {
+			return false, false
+		}
+		for k, v := range e.params {
+			switch k {
+			case "server_no_context_takeover", "client_no_context_takeover", "server_max_window_bits":
+			case "client_max_window_bits":
+				if v != "" && v != "15" {
+					return false, false
+				}
+			default:
+				return false, false
+			}
+		}
+		deflate = true
+	}
+	return deflate, true
+}
@@ -0,0 +1,354 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package websocket
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/izhw/gnet/tcp/internal"
+)
+
+// opcodes of frames
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+const (
+	finBit  = 0x80
+	rsv1Bit = 0x40 // compressed msg of permessage-deflate
+	rsvBits = 0x70
+	maskBit = 0x80
+
+	maxControlPayload = 125
+	maxHeaderLen      = 14
+)
+
+// status codes of close frames
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005 // no code in the close frame, never sent
+	CloseAbnormal        = 1006 // closed without a close frame, never sent
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseTooLarge        = 1009
+	CloseMandatoryExt    = 1010
+	CloseInternalError   = 1011
+)
+
+// CloseError a close frame received, or the reason the conn is failed
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Reason)
+}
+
+func protocolError(reason string) error {
+	return &CloseError{Code: CloseProtocolError, Reason: reason}
+}
+
+// validCloseCode whether code may be sent in a close frame
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+type header struct {
+	fin    bool
+	rsv1   bool
+	opcode byte
+	masked bool
+	mask   [4]byte
+	length int
+}
+
+// appendHeader appends a frame header to dst, the payload is masked with mask by the caller if not nil
+func appendHeader(dst []byte, fin, rsv1 bool, opcode byte, n int, mask *[4]byte) []byte {
+	b0 := opcode
+	if fin {
+		b0 |= finBit
+	}
+	if rsv1 {
+		b0 |= rsv1Bit
+	}
+	var b1 byte
+	if mask != nil {
+		b1 = maskBit
+	}
+	switch {
+	case n <= 125:
+		dst = append(dst, b0, b1|byte(n))
+	case n <= 0xffff:
+		dst = append(dst, b0, b1|126, byte(n>>8), byte(n))
+	default:
+		var l [8]byte
+		binary.BigEndian.PutUint64(l[:], uint64(n))
+		dst = append(dst, b0, b1|127)
+		dst = append(dst, l[:]...)
+	}
+	if mask != nil {
+		dst = append(dst, mask[:]...)
+	}
+	return dst
+}
+
+// parseHeader parses the frame header at the beginning of b, n is 0 if it is incomplete.
+// A payload longer than max is an error, so the length always fits in an int.
+func parseHeader(b []byte, max int) (h header, n int, err error) {
+	if len(b) < 2 {
+		return h, 0, nil
+	}
+	if b[0]&rsvBits&^rsv1Bit != 0 {
+		return h, 0, protocolError("reserved bits set")
+	}
+	h.fin = b[0]&finBit != 0
+	h.rsv1 = b[0]&rsv1Bit != 0
+	h.opcode = b[0] & 0xf
+	h.masked = b[1]&maskBit != 0
+	switch h.opcode {
+	case opContinuation, opText, opBinary:
+	case opClose, opPing, opPong:
+		if !h.fin {
+			return h, 0, protocolError("fragmented control frame")
+		}
+	default:
+		return h, 0, protocolError("unknown opcode")
+	}
+	n = 2
+	switch l := b[1] &^ maskBit; l {
+	case 126:
+		if len(b) < 4 {
+			return h, 0, nil
+		}
+		h.length = int(binary.BigEndian.Uint16(b[2:]))
+		n = 4
+	case 127:
+		if len(b) < 10 {
+			return h, 0, nil
+		}
+		l := binary.BigEndian.Uint64(b[2:])
+		if l > 1<<62 {
+			return h, 0, protocolError("invalid payload length")
+		}
+		if l > uint64(max) {
+			return h, 0, &CloseError{Code: CloseTooLarge, Reason: "msg too large"}
+		}
+		h.length = int(l)
+		n = 10
+	default:
+		h.length = int(l)
+	}
+	if h.opcode >= opClose && h.length > maxControlPayload {
+		return h, 0, protocolError("control frame too large")
+	}
+	if h.masked {
+		if len(b) < n+4 {
+			return h, 0, nil
+		}
+		copy(h.mask[:], b[n:])
+		n += 4
+	}
+	return h, n, nil
+}
+
+// maskBytes masks or unmasks b with key, pos is the position of b in the payload
+func maskBytes(key [4]byte, pos int, b []byte) {
+	for i := range b {
+		b[i] ^= key[(pos+i)&3]
+	}
+}
+
+func newMaskKey() (key [4]byte) {
+	if _, err := rand.Read(key[:]); err != nil {
+		binary.LittleEndian.PutUint32(key[:], uint32(time.Now().UnixNano()))
+	}
+	return
+}
+
+// encodeFrame encodes a frame of one msg, compressed if deflate, masked by the client, Body of the frame is msg.
+// Uncompressed unmasked msgs are not copied, unmasked frames can be shared by the conns of a broadcast.
+func encodeFrame(opcode byte, msg []byte, deflate, masked bool) internal.Frame {
+	if !deflate && !masked {
+		return internal.Frame{Body: msg, Header: appendHeader(nil, true, false, opcode, len(msg), nil)}
+	}
+	payload := msg
+	if deflate {
+		payload = compress(msg)
+	}
+	var key *[4]byte
+	if masked {
+		k := newMaskKey()
+		key = &k
+	}
+	data := appendHeader(make([]byte, 0, maxHeaderLen+len(payload)), true, deflate, opcode, len(payload), key)
+	n := len(data)
+	data = append(data, payload...)
+	if key != nil {
+		maskBytes(*key, 0, data[n:])
+	}
+	return internal.Frame{Body: msg, Data: data}
+}
+
+// closePayload the payload of a close frame with code and reason
+func closePayload(code int, reason string) []byte {
+	if code == CloseNoStatus {
+		return nil
+	}
+	if len(reason) > maxControlPayload-2 {
+		reason = reason[:maxControlPayload-2]
+	}
+	b := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(b, uint16(code))
+	return append(b, reason...)
+}
+
+// parseClose parses the payload of a close frame received
+func parseClose(payload []byte) (*CloseError, error) {
+	switch {
+	case len(payload) == 0:
+		return &CloseError{Code: CloseNoStatus}, nil
+	case len(payload) == 1:
+		return nil, protocolError("invalid close frame")
+	}
+	code := int(binary.BigEndian.Uint16(payload))
+	if !validCloseCode(code) {
+		return nil, protocolError("invalid close code")
+	}
+	if !utf8.Valid(payload[2:]) {
+		return nil, &CloseError{Code: CloseInvalidPayload, Reason: "invalid close reason"}
+	}
+	return &CloseError{Code: code, Reason: string(payload[2:])}, nil
+}
+
+// maxMsgLen converts MaxReadBufLen to the max of msgReader, which overflows int on 32-bit platforms
+func maxMsgLen(n uint32) int {
+	if uint64(n) > uint64(^uint(0)>>1) {
+		return int(^uint(0) >> 1)
+	}
+	return int(n)
+}
+
+// msgReader assembles msgs from the frames read into a ReaderBuffer
+type msgReader struct {
+	server     bool // frames must be masked by the client
+	deflate    bool // permessage-deflate is negotiated
+	max        int  // max length of a msg
+	opcode     byte // opcode of the fragmented msg being read, 0 if none
+	compressed bool
+	fragments  []byte
+}
+
+// next reads the next frame in b, it returns the opcode and payload of a data msg
+// or a control frame if complete. consumed is false if the frame is incomplete,
+// opcode is 0 if the frame is a fragment of a msg.
+func (r *msgReader) next(b *internal.ReaderBuffer) (opcode byte, payload []byte, consumed bool, err error) {
+	h, n, err := parseHeader(b.Data(), r.max)
+	if err != nil || n == 0 {
+		return 0, nil, false, err
+	}
+	if h.masked != r.server {
+		if r.server {
+			return 0, nil, false, protocolError("unmasked client frame")
+		}
+		return 0, nil, false, protocolError("masked server frame")
+	}
+	if h.length > r.max || (h.opcode == opContinuation && h.length > r.max-len(r.fragments)) {
+		return 0, nil, false, &CloseError{Code: CloseTooLarge, Reason: "msg too large"}
+	}
+	if b.Len() < n+h.length {
+		return 0, nil, false, nil
+	}
+	payload = make([]byte, h.length)
+	b.Read(n, h.length, payload)
+	if h.masked {
+		maskBytes(h.mask, 0, payload)
+	}
+
+	switch h.opcode {
+	case opClose, opPing, opPong:
+		if h.rsv1 {
+			return 0, nil, true, protocolError("compressed control frame")
+		}
+		return h.opcode, payload, true, nil
+	case opContinuation:
+		if r.opcode == 0 {
+			return 0, nil, true, protocolError("continuation frame without a msg")
+		}
+		if h.rsv1 {
+			return 0, nil, true, protocolError("compressed continuation frame")
+		}
+		r.fragments = append(r.fragments, payload...)
+		if !h.fin {
+			return 0, nil, true, nil
+		}
+		opcode, payload = r.opcode, r.fragments
+		compressed := r.compressed
+		r.opcode, r.compressed, r.fragments = 0, false, nil
+		payload, err = r.complete(opcode, payload, compressed)
+		return opcode, payload, true, err
+	default:
+		if r.opcode != 0 {
+			return 0, nil, true, protocolError("msg started before the fragmented msg ends")
+		}
+		if h.rsv1 && !r.deflate {
+			return 0, nil, true, protocolError("compressed frame without permessage-deflate")
+		}
+		if !h.fin {
+			r.opcode, r.compressed, r.fragments = h.opcode, h.rsv1, payload
+			return 0, nil, true, nil
+		}
+		payload, err = r.complete(h.opcode, payload, h.rsv1)
+		return h.opcode, payload, true, err
+	}
+}
+
+// complete decompresses and validates a msg assembled
+func (r *msgReader) complete(opcode byte, payload []byte, compressed bool) ([]byte, error) {
+	if compressed {
+		var err error
+		if payload, err = decompress(payload, r.max); err != nil {
+			return nil, err
+		}
+	}
+	if opcode == opText && !utf8.Valid(payload) {
+		return nil, &CloseError{Code: CloseInvalidPayload, Reason: "invalid UTF-8 text"}
+	}
+	return payload, nil
+}
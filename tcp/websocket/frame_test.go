@@ -0,0 +1,42 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package websocket
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestParseHeaderLength64(t *testing.T) {
+	for _, l := range []uint64{0xFFFFFFFF, 1<<32 + 16, 1 << 62} {
+		b := []byte{0x82, 127, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(b[2:], l)
+		_, _, err := parseHeader(b, 1<<20)
+		if ce, ok := err.(*CloseError); !ok || ce.Code != CloseTooLarge {
+			t.Fatalf("length %#x: %v, want CloseTooLarge", l, err)
+		}
+	}
+	b := []byte{0x82, 127, 0, 0, 0, 0, 0, 1, 0, 0}
+	h, n, err := parseHeader(b, 1<<20)
+	if err != nil || n != 10 || h.length != 1<<16 {
+		t.Fatalf("length 65536: %+v %d %v", h, n, err)
+	}
+}
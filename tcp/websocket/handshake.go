@@ -0,0 +1,228 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/izhw/gnet/gcore"
+)
+
+const (
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// maxHandshakeLen max bytes of the handshake request or response
+	maxHandshakeLen = 64 * 1024
+)
+
+var (
+	ErrBadHandshake       = errors.New("websocket: bad handshake")
+	errHandshakeTooLarge  = errors.New("websocket: handshake too large")
+	errUnsupportedVersion = errors.New("unsupported version")
+)
+
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// handshakeReader limits the bytes read by the handshake, the limit is lifted after it by n = -1
+type handshakeReader struct {
+	r io.Reader
+	n int
+}
+
+func (h *handshakeReader) Read(p []byte) (int, error) {
+	if h.n < 0 {
+		return h.r.Read(p)
+	}
+	if h.n == 0 {
+		return 0, errHandshakeTooLarge
+	}
+	if len(p) > h.n {
+		p = p[:h.n]
+	}
+	n, err := h.r.Read(p)
+	h.n -= n
+	return n, err
+}
+
+// headerContains whether the comma-separated values of the header name contain token, case-insensitive
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkRequest returns the HTTP status of the error response if req is not acceptable, 0 if ok
+func checkRequest(req *http.Request, wo *gcore.WebSocketOptions) (status int, err error) {
+	switch {
+	case req.Method != http.MethodGet:
+		return http.StatusMethodNotAllowed, errors.New("method not GET")
+	case !req.ProtoAtLeast(1, 1):
+		return http.StatusBadRequest, errors.New("HTTP/1.1 required")
+	case !headerContains(req.Header, "Connection", "upgrade") || !headerContains(req.Header, "Upgrade", "websocket"):
+		return http.StatusBadRequest, errors.New("not a websocket upgrade")
+	case req.Header.Get("Sec-WebSocket-Version") != "13":
+		return http.StatusUpgradeRequired, errUnsupportedVersion
+	}
+	if key, err := base64.StdEncoding.DecodeString(req.Header.Get("Sec-WebSocket-Key")); err != nil || len(key) != 16 {
+		return http.StatusBadRequest, errors.New("invalid Sec-WebSocket-Key")
+	}
+	if wo.Path != "" && req.URL.Path != wo.Path {
+		return http.StatusNotFound, errors.New("path not found")
+	}
+	if wo.CheckOrigin != nil && !wo.CheckOrigin(req) {
+		return http.StatusForbidden, errors.New("origin not allowed")
+	}
+	return 0, nil
+}
+
+// selectSubprotocol returns the first of supported offered by the client
+func selectSubprotocol(req *http.Request, supported []string) string {
+	for _, p := range supported {
+		if headerContains(req.Header, "Sec-WebSocket-Protocol", p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// serverHandshake reads the upgrade request from br and writes the response to conn,
+// an error response is written if the request is not acceptable
+func serverHandshake(conn net.Conn, br *bufio.Reader, wo *gcore.WebSocketOptions) (req *http.Request, protocol string, deflate bool, err error) {
+	req, err = http.ReadRequest(br)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if status, err := checkRequest(req, wo); err != nil {
+		writeErrorResponse(conn, status, err.Error())
+		return nil, "", false, fmt.Errorf("%w: %v", ErrBadHandshake, err)
+	}
+	protocol = selectSubprotocol(req, wo.Subprotocols)
+	deflate = wo.Compression && acceptDeflate(parseExtensions(req.Header.Values("Sec-WebSocket-Extensions")))
+
+	var b strings.Builder
+	b.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: ")
+	b.WriteString(acceptKey(req.Header.Get("Sec-WebSocket-Key")))
+	b.WriteString("\r\n")
+	if protocol != "" {
+		b.WriteString("Sec-WebSocket-Protocol: " + protocol + "\r\n")
+	}
+	if deflate {
+		b.WriteString("Sec-WebSocket-Extensions: " + extDeflateParams + "\r\n")
+	}
+	b.WriteString("\r\n")
+	if _, err = io.WriteString(conn, b.String()); err != nil {
+		return nil, "", false, err
+	}
+	return req, protocol, deflate, nil
+}
+
+func writeErrorResponse(conn net.Conn, status int, text string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n",
+		status, http.StatusText(status), len(text))
+	if status == http.StatusUpgradeRequired {
+		b.WriteString("Sec-WebSocket-Version: 13\r\n")
+	}
+	b.WriteString("\r\n")
+	b.WriteString(text)
+	_, _ = io.WriteString(conn, b.String())
+}
+
+// clientHandshake writes the upgrade request of u to conn and reads the response from br
+func clientHandshake(conn net.Conn, br *bufio.Reader, u *url.URL, wo *gcore.WebSocketOptions) (protocol string, deflate bool, err error) {
+	var k [16]byte
+	if _, err = rand.Read(k[:]); err != nil {
+		return "", false, err
+	}
+	key := base64.StdEncoding.EncodeToString(k[:])
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	for name, values := range wo.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if len(wo.Subprotocols) > 0 {
+		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(wo.Subprotocols, ", "))
+	}
+	if wo.Compression {
+		req.Header.Set("Sec-WebSocket-Extensions", extDeflateParams)
+	}
+	if err = req.Write(conn); err != nil {
+		return "", false, err
+	}
+
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return "", false, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return "", false, fmt.Errorf("%w: status %s", ErrBadHandshake, resp.Status)
+	}
+	if !headerContains(resp.Header, "Connection", "upgrade") || !headerContains(resp.Header, "Upgrade", "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return "", false, fmt.Errorf("%w: invalid upgrade response", ErrBadHandshake)
+	}
+	protocol = resp.Header.Get("Sec-WebSocket-Protocol")
+	if protocol != "" && !contains(wo.Subprotocols, protocol) {
+		return "", false, fmt.Errorf("%w: subprotocol %s not offered", ErrBadHandshake, protocol)
+	}
+	deflate, ok := checkDeflateResponse(parseExtensions(resp.Header.Values("Sec-WebSocket-Extensions")), wo.Compression)
+	if !ok {
+		return "", false, fmt.Errorf("%w: extensions not offered", ErrBadHandshake)
+	}
+	return protocol, deflate, nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,416 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/connstat"
+	"github.com/izhw/gnet/internal/metric"
+	"github.com/izhw/gnet/internal/registry"
+	"github.com/izhw/gnet/internal/util/delay"
+	"github.com/izhw/gnet/internal/util/limter"
+	"github.com/izhw/gnet/internal/worker"
+	"github.com/izhw/gnet/tcp/internal"
+)
+
+const DefaultAddr = "0.0.0.0:8080"
+
+var _ gcore.Server = &Server{}
+
+// Server a WebSocket server, each msg received is passed to OnReadMsg, and each Write sends a msg,
+// see gcore.WebSocketOptions. HeaderCodec is not used, msgs are framed by WebSocket.
+// HeartPingInterval sends ping frames with HeartData, pings and pongs received are heartbeats.
+// RestartSignal is not supported.
+type Server struct {
+	opts      gcore.Options
+	listeners []net.Listener // more than one with SO_REUSEPORT, see WithReusePort
+	limiter   limter.Limiter
+	ctx       context.Context // ctx of conns, canceled when stopped
+	cancel    context.CancelFunc
+	stopChan  chan struct{}
+	wg        sync.WaitGroup // accept goroutines
+	cwg       sync.WaitGroup // conns
+	conns     *registry.Registry
+	workers   *worker.Pool // nil if WorkerNum is 0
+	metrics   *metric.Server
+	heart     *connstat.HeartKeeper // nil if HeartTimeout and HeartPingInterval are 0
+	opcode    byte                  // of data frames
+	connNum   uint32
+	stopped   int32
+}
+
+func NewServer() *Server {
+	return &Server{
+		stopped: 1,
+	}
+}
+
+func (s *Server) WithOptions(opts gcore.Options) {
+	s.opts = opts
+}
+
+func (s *Server) Init(opts ...gcore.Option) error {
+	for _, opt := range opts {
+		opt(&s.opts)
+	}
+	if s.opts.Addr == "" {
+		s.opts.Addr = DefaultAddr
+	}
+	if cfg := s.opts.TLSConfig; cfg != nil {
+		if len(cfg.Certificates) == 0 && cfg.GetCertificate == nil && cfg.GetConfigForClient == nil {
+			return errors.New("tls: neither Certificates, GetCertificate, nor GetConfigForClient set in TLSConfig")
+		}
+	}
+	if s.opts.HeartPingInterval > 0 && len(s.opts.HeartData) > maxControlPayload {
+		return errors.New("websocket ping: HeartData longer than 125 bytes")
+	}
+	if s.opts.RestartSignal != nil {
+		s.opts.Logger.Warnf("WebSocket server RestartSignal not supported")
+	}
+	if err := s.listen(); err != nil {
+		return err
+	}
+	s.opts.Handler = gcore.WrapHandler(s.opts.Handler, s.opts.Interceptors)
+	if s.opts.ConnLimit > 0 {
+		s.limiter = limter.NewLimiter(s.opts.ConnLimit)
+	}
+	s.ctx, s.cancel = context.WithCancel(s.opts.Ctx)
+	s.stopChan = make(chan struct{})
+	s.conns = registry.New()
+	s.metrics = metric.NewServer(&s.opts)
+	if s.opts.WorkerNum > 0 {
+		s.workers = worker.NewPool(&s.opts)
+	}
+	s.heart = connstat.NewHeartKeeper(s.opts.HeartTimeout, s.opts.HeartPingInterval)
+	s.opcode = opBinary
+	if s.opts.WebSocket.Text {
+		s.opcode = opText
+	}
+	s.stopped = 0
+
+	return nil
+}
+
+func (s *Server) Serve() error {
+	if atomic.LoadInt32(&s.stopped) == 1 {
+		return errors.New("server uninitialized")
+	}
+	if s.workers != nil {
+		s.workers.Start()
+	}
+	s.heart.Start()
+	for _, l := range s.listeners {
+		s.wg.Add(1)
+		go s.work(l)
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case <-s.opts.Ctx.Done():
+		s.Stop()
+		return s.opts.Ctx.Err()
+	case <-s.stopChan:
+		// conns are waited for by Stop or Shutdown
+		s.wg.Wait()
+	case sig := <-c:
+		s.Stop()
+		return errors.New("signal:" + sig.String())
+	}
+	return nil
+}
+
+// listen uses Listener if set, otherwise opens ListenerNum listeners on Addr, with SO_REUSEPORT if more than one
+func (s *Server) listen() error {
+	if s.opts.Listener != nil {
+		s.listeners = []net.Listener{s.opts.Listener}
+		return nil
+	}
+	num := s.opts.ListenerNum
+	if num > 1 && (!internal.ReusePortSupported || internal.IsUnixAddr(s.opts.Addr)) {
+		s.opts.Logger.Warnf("WebSocket server SO_REUSEPORT not supported, using one listener")
+		num = 1
+	}
+	if num < 1 {
+		num = 1
+	}
+	reusePort := num > 1
+	addr := s.opts.Addr
+	s.listeners = make([]net.Listener, 0, num)
+	for i := 0; i < num; i++ {
+		l, err := internal.Listen(addr, &s.opts.Socket, reusePort)
+		if err != nil {
+			s.closeListeners()
+			return err
+		}
+		if i == 0 && num > 1 {
+			addr = internal.WithPort(addr, l.Addr().(*net.TCPAddr).Port)
+		}
+		s.listeners = append(s.listeners, l)
+	}
+	return nil
+}
+
+func (s *Server) closeListeners() {
+	for _, l := range s.listeners {
+		l.Close()
+	}
+}
+
+// Addr returns the address of the first listener, e.g. the port chosen for ":0"
+func (s *Server) Addr() net.Addr {
+	return s.listeners[0].Addr()
+}
+
+// wait waits for the accept goroutines to exit and all conns to be closed
+func (s *Server) wait() {
+	s.wg.Wait()
+	s.cwg.Wait()
+}
+
+func (s *Server) Stop() {
+	if !atomic.CompareAndSwapInt32(&s.stopped, 0, 1) {
+		return
+	}
+	close(s.stopChan)
+	s.closeListeners()
+	s.cancel()
+	s.wait()
+	s.release()
+}
+
+// Shutdown stops accepting, calls OnShutdown of the handler for each conn if implemented,
+// then each conn stops reading, and is closed with CloseGoingAway after the in-flight OnReadMsg
+// returns and its send queue is flushed. Conns which are still open when ctx is done are closed
+// forcibly, and ctx.Err() is returned without waiting for them to exit.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.stopped, 0, 1) {
+		s.wait()
+		return nil
+	}
+	close(s.stopChan)
+	s.closeListeners()
+	s.wg.Wait()
+
+	h, _ := s.opts.Handler.(gcore.ShutdownHandler)
+	s.conns.Range(func(c gcore.Conn) bool {
+		if h != nil {
+			h.OnShutdown(c)
+		}
+		c.(*Conn).shutdown()
+		return true
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.cwg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		s.cancel()
+		s.release()
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		s.conns.Range(func(c gcore.Conn) bool {
+			c.(*Conn).forceClose()
+			return true
+		})
+		// a conn may still be in a stuck OnReadMsg, the workers are released after it returns
+		go func() {
+			<-done
+			s.release()
+		}()
+		return ctx.Err()
+	}
+}
+
+// release stops the workers and the heart keeper, called after all conns are closed
+func (s *Server) release() {
+	if s.workers != nil {
+		s.workers.Stop()
+	}
+	s.heart.Stop()
+}
+
+func (s *Server) WorkerStats() gcore.WorkerStats {
+	return s.workers.Stats()
+}
+
+func (s *Server) ConnNum() uint32 {
+	return atomic.LoadUint32(&s.connNum)
+}
+
+func (s *Server) GetConn(id uint64) (gcore.Conn, bool) {
+	return s.conns.Get(id)
+}
+
+func (s *Server) GetConnsByTag(tag string) []gcore.Conn {
+	return s.conns.GetByTag(tag)
+}
+
+func (s *Server) RangeConns(f func(c gcore.Conn) bool) {
+	s.conns.Range(f)
+}
+
+func (s *Server) CloseConn(id uint64, reason string) error {
+	c, ok := s.conns.Get(id)
+	if !ok {
+		return gcore.ErrConnNotFound
+	}
+	s.opts.Logger.Infof("WebSocket server close conn:%d %s, reason:%s", id, c.RemoteAddr(), reason)
+	return c.(*Conn).CloseWithReason(CloseNormal, reason)
+}
+
+func (s *Server) JoinGroup(group string, c gcore.Conn) error {
+	if !s.conns.Join(c, group) {
+		return gcore.ErrConnNotFound
+	}
+	return nil
+}
+
+func (s *Server) LeaveGroup(group string, c gcore.Conn) {
+	s.conns.Leave(c, group)
+}
+
+func (s *Server) Broadcast(data []byte, policy gcore.SlowReceiverPolicy) (n int, err error) {
+	fs := frames{s: s, msg: data}
+	s.conns.Range(func(c gcore.Conn) bool {
+		if s.send(c.(*Conn), fs.get(c.(*Conn)), policy) {
+			n++
+		}
+		return true
+	})
+	return n, nil
+}
+
+func (s *Server) GroupBroadcast(group string, data []byte, policy gcore.SlowReceiverPolicy) (n int, err error) {
+	fs := frames{s: s, msg: data}
+	for _, c := range s.conns.GetGroup(group) {
+		if s.send(c.(*Conn), fs.get(c.(*Conn)), policy) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// send queues the shared frame f to c with policy
+func (s *Server) send(c *Conn, f internal.Frame, policy gcore.SlowReceiverPolicy) bool {
+	p := gcore.SendQueueDropNewest
+	switch policy {
+	case gcore.SlowReceiverBlock:
+		p = gcore.SendQueueBlock
+	case gcore.SlowReceiverDisconnect:
+		p = gcore.SendQueueClose
+	}
+	return c.push(context.Background(), f, p, true) == nil
+}
+
+// compressed whether a msg of n bytes is compressed for c
+func (s *Server) compressed(c *Conn, n int) bool {
+	return c.deflate && n >= s.opts.WebSocket.CompressThreshold
+}
+
+// frames encodes a msg of a broadcast lazily, at most once for each form
+type frames struct {
+	s       *Server
+	msg     []byte
+	encoded [2]bool
+	f       [2]internal.Frame // uncompressed, compressed
+}
+
+func (fs *frames) get(c *Conn) internal.Frame {
+	i := 0
+	if fs.s.compressed(c, len(fs.msg)) {
+		i = 1
+	}
+	if !fs.encoded[i] {
+		fs.f[i] = encodeFrame(fs.s.opcode, fs.msg, i == 1, false)
+		fs.encoded[i] = true
+	}
+	return fs.f[i]
+}
+
+func (s *Server) onConnClose() {
+	if s.limiter != nil {
+		s.limiter.Revert()
+	}
+	atomic.AddUint32(&s.connNum, ^uint32(0))
+	s.metrics.Conns.Add(-1)
+	s.cwg.Done()
+}
+
+// work accepts conns from l, there is one for each listener
+func (s *Server) work(l net.Listener) {
+	defer func() {
+		s.wg.Done()
+		s.Stop()
+	}()
+
+	td := delay.NewTempDelay(5*time.Millisecond, time.Second)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				d := td.GetDelay()
+				s.opts.Logger.Warnf("WebSocket server accept temporary error:[%v], delay:%v", ne, d)
+				time.Sleep(d)
+				continue
+			}
+			select {
+			case <-s.stopChan:
+				return
+			default:
+			}
+			s.opts.Logger.Errorf("WebSocket server accept error:[%v]", err)
+			return
+		}
+		td.Reset()
+		if s.limiter != nil && !s.limiter.Allow() {
+			conn.Close()
+			s.metrics.Rejected.Add(1)
+			s.opts.Logger.Warnf("WebSocket server accepted max num:%d, new conn rejected", s.opts.ConnLimit)
+			continue
+		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			if err := internal.ApplySocketOptions(tcpConn, &s.opts.Socket); err != nil {
+				s.opts.Logger.Warnf("WebSocket server conn:%s set socket options error:[%v]", tcpConn.RemoteAddr(), err)
+			}
+		}
+		// new conn
+		atomic.AddUint32(&s.connNum, 1)
+		s.metrics.Accepted.Add(1)
+		s.metrics.Conns.Add(1)
+		s.cwg.Add(1)
+		newConn(s.ctx, s, conn)
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/connstat"
+	"github.com/izhw/gnet/internal/metric"
+	"github.com/izhw/gnet/internal/registry"
+	"github.com/izhw/gnet/udp/internal"
+)
+
+// batchSize max number of datagrams read by one syscall
+const batchSize = 4
+
+var _ gcore.Conn = &Client{}
+
+// Client is a UDP client on a connected socket, received msgs are passed to OnReadMsg
+// in the read loop like AsyncClient. HeartData is sent every HeartInterval if set,
+// received HeartData is not passed to the handler.
+type Client struct {
+	id        uint64
+	opts      gcore.Options
+	conn      *net.UDPConn
+	bc        *internal.BatchConn
+	metrics   *metric.Client
+	stats     *connstat.Stats
+	closeChan chan struct{}
+	closed    int32
+	mu        sync.Mutex // guards tag
+	tag       string
+}
+
+func NewClient() *Client {
+	return &Client{
+		id: registry.NextID(),
+	}
+}
+
+func (c *Client) WithOptions(opts gcore.Options) {
+	c.opts = opts
+}
+
+func (c *Client) ID() uint64 {
+	return c.id
+}
+
+func (c *Client) Init(opts ...gcore.Option) error {
+	for _, opt := range opts {
+		opt(&c.opts)
+	}
+	c.metrics = metric.NewClient(&c.opts)
+	conn, err := dial(&c.opts)
+	if err != nil {
+		c.metrics.ConnectErrors.Add(1)
+		return err
+	}
+	bc, err := internal.NewBatchConn(conn, batchSize)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	c.metrics.Connects.Add(1)
+	c.conn, c.bc = conn, bc
+	c.stats = connstat.NewStats(&c.metrics.IO)
+	c.opts.Handler = gcore.WrapHandler(c.opts.Handler, c.opts.Interceptors)
+	c.closeChan = make(chan struct{})
+	c.opts.Handler.OnOpened(c)
+	go c.handleReadLoop()
+	if len(c.opts.HeartData) > 0 && c.opts.HeartInterval > 0 {
+		go c.handleHeartbeatLoop()
+	}
+	return nil
+}
+
+func dial(opts *gcore.Options) (*net.UDPConn, error) {
+	var d net.Dialer
+	conn, err := d.Dial("udp", opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	uc := conn.(*net.UDPConn)
+	if err = internal.SetBuffers(uc, &opts.Socket); err != nil {
+		uc.Close()
+		return nil, err
+	}
+	return uc, nil
+}
+
+func (c *Client) Read(buf []byte) (n int, err error) {
+	return 0, gcore.ErrConnInvalidCall
+}
+
+func (c *Client) ReadFull(buf []byte) (n int, err error) {
+	return 0, gcore.ErrConnInvalidCall
+}
+
+func (c *Client) WriteRead(req []byte) (body []byte, err error) {
+	return nil, gcore.ErrConnInvalidCall
+}
+
+// Write sends data in a datagram, data is passed through the interceptors
+func (c *Client) Write(data []byte) error {
+	return gcore.InterceptWrite(c.opts.Interceptors, c, data, func(_ gcore.Conn, data []byte) error {
+		return c.write(context.Background(), data)
+	})
+}
+
+// TryWrite same as Write, Client has no send queue
+func (c *Client) TryWrite(data []byte) error {
+	return c.Write(data)
+}
+
+// WriteContext is like Write, the write deadline is the earlier of WriteTimeout and the deadline of ctx
+func (c *Client) WriteContext(ctx context.Context, data []byte) error {
+	return gcore.InterceptWrite(c.opts.Interceptors, c, data, func(_ gcore.Conn, data []byte) error {
+		return c.write(ctx, data)
+	})
+}
+
+func (c *Client) write(ctx context.Context, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if c.Closed() {
+		return gcore.ErrConnClosed
+	}
+	d, err := internal.EncodeDatagram(&c.opts, data)
+	if err != nil {
+		return err
+	}
+	var t time.Time
+	if c.opts.WriteTimeout > 0 {
+		t = time.Now().Add(c.opts.WriteTimeout)
+	}
+	if dl, ok := ctx.Deadline(); ok && (t.IsZero() || dl.Before(t)) {
+		t = dl
+	}
+	_ = c.conn.SetWriteDeadline(t)
+	n, err := c.conn.Write(d)
+	if err != nil {
+		c.stats.WriteFailed()
+		return err
+	}
+	c.stats.Written(1, n)
+	return nil
+}
+
+// Close closes the socket, OnClosed is called before it returns
+func (c *Client) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	close(c.closeChan)
+	err := c.conn.Close()
+	c.opts.Handler.OnClosed(c)
+	return err
+}
+
+func (c *Client) Closed() bool {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return true
+	}
+	return false
+}
+
+func (c *Client) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Client) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// PeerCertificates DTLS is not supported
+func (c *Client) PeerCertificates() []*x509.Certificate {
+	return nil
+}
+
+// Stats the send queue fields are zero, as Client has no send queue
+func (c *Client) Stats() (st gcore.ConnStats) {
+	c.stats.Fill(&st)
+	return
+}
+
+func (c *Client) SetTag(tag string) {
+	c.mu.Lock()
+	c.tag = tag
+	c.mu.Unlock()
+}
+
+func (c *Client) GetTag() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tag
+}
+
+func (c *Client) handleReadLoop() {
+	pkts := internal.NewPackets(batchSize)
+	for {
+		n, err := c.bc.ReadBatch(pkts)
+		if err != nil {
+			if c.Closed() {
+				return
+			}
+			// ICMP port unreachable of a previous datagram, the server may not be started yet
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				c.opts.Logger.Debugf("UDP client %s read error:[%v]", c.opts.Addr, err)
+				continue
+			}
+			c.opts.Logger.Errorf("UDP client %s read error:[%v]", c.opts.Addr, err)
+			c.Close()
+			return
+		}
+		for i := 0; i < n; i++ {
+			c.stats.Read(pkts[i].N, 0)
+			if err := internal.DecodeDatagram(&c.opts, pkts[i].Buf[:pkts[i].N], c.handleMsg); err != nil {
+				if c.Closed() {
+					return
+				}
+				c.opts.Logger.Debugf("UDP client %s datagram dropped, decode error:[%v]", c.opts.Addr, err)
+			}
+		}
+	}
+}
+
+// handleMsg handles a msg decoded from a datagram, returns an error if c is closed
+func (c *Client) handleMsg(msg []byte) error {
+	if len(c.opts.HeartData) > 0 && bytes.Equal(msg, c.opts.HeartData) {
+		return nil
+	}
+	c.stats.MsgRead()
+	if err := c.opts.Handler.OnReadMsg(c, msg); err != nil {
+		c.opts.Logger.Infof("UDP client OnReadMsg error:[%v]", err)
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+func (c *Client) handleHeartbeatLoop() {
+	ticker := time.NewTicker(c.opts.HeartInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closeChan:
+			return
+		case <-c.opts.Ctx.Done():
+			c.Close()
+			return
+		case <-ticker.C:
+			if err := c.write(context.Background(), c.opts.HeartData); err != nil {
+				c.opts.Logger.Debugf("UDP client %s heartbeat error:[%v]", c.opts.Addr, err)
+				continue
+			}
+			c.stats.Heartbeat()
+		}
+	}
+}
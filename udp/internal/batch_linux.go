@@ -0,0 +1,250 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package internal
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// mmsghdr struct mmsghdr of recvmmsg and sendmmsg
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// mmsgs buffers of a recvmmsg or sendmmsg call
+type mmsgs struct {
+	msgs  []mmsghdr
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrInet6 // large enough for both families
+}
+
+func newMmsgs(n int) mmsgs {
+	return mmsgs{
+		msgs:  make([]mmsghdr, n),
+		iovs:  make([]syscall.Iovec, n),
+		names: make([]syscall.RawSockaddrInet6, n),
+	}
+}
+
+// BatchConn reads and writes datagrams in batches by recvmmsg and sendmmsg.
+// ReadBatch and WriteBatch can be called concurrently, but not themselves.
+type BatchConn struct {
+	conn *net.UDPConn
+	raw  syscall.RawConn
+	v6   bool // the socket is AF_INET6, IPv4 addresses are mapped
+	rd   mmsgs
+	wr   mmsgs
+}
+
+// NewBatchConn size: max number of datagrams of a batch
+func NewBatchConn(conn *net.UDPConn, size int) (*BatchConn, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	b := &BatchConn{
+		conn: conn,
+		raw:  raw,
+		rd:   newMmsgs(size),
+		wr:   newMmsgs(size),
+	}
+	var sa syscall.Sockaddr
+	var serr error
+	if err = raw.Control(func(fd uintptr) {
+		sa, serr = syscall.Getsockname(int(fd))
+	}); err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, os.NewSyscallError("getsockname", serr)
+	}
+	_, b.v6 = sa.(*syscall.SockaddrInet6)
+	return b, nil
+}
+
+// ReadBatch reads at most len(pkts) datagrams, blocks until one is available,
+// returns the number of packets filled
+func (b *BatchConn) ReadBatch(pkts []Packet) (int, error) {
+	n := len(pkts)
+	if n > len(b.rd.msgs) {
+		n = len(b.rd.msgs)
+	}
+	for i := 0; i < n; i++ {
+		b.rd.iovs[i] = syscall.Iovec{Base: &pkts[i].Buf[0]}
+		b.rd.iovs[i].SetLen(len(pkts[i].Buf))
+		b.rd.msgs[i] = mmsghdr{hdr: syscall.Msghdr{
+			Name:    (*byte)(unsafe.Pointer(&b.rd.names[i])),
+			Namelen: syscall.SizeofSockaddrInet6,
+			Iov:     &b.rd.iovs[i],
+			Iovlen:  1,
+		}}
+	}
+	var got int
+	var serr error
+	err := b.raw.Read(func(fd uintptr) bool {
+		r, _, errno := syscall.Syscall6(syscall.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&b.rd.msgs[0])),
+			uintptr(n), syscall.MSG_DONTWAIT, 0, 0)
+		if errno == syscall.EAGAIN {
+			return false
+		}
+		if errno != 0 {
+			serr = os.NewSyscallError("recvmmsg", errno)
+		}
+		got = int(r)
+		return true
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < got; i++ {
+		pkts[i].N = int(b.rd.msgs[i].len)
+		pkts[i].Addr = decodeAddr(&b.rd.names[i], b.rd.msgs[i].hdr.Namelen)
+	}
+	return got, nil
+}
+
+// WriteBatch writes the datagrams of pkts in order, returns the number written,
+// which is less than len(pkts) only if err is not nil, pkts[n] is the one failed
+func (b *BatchConn) WriteBatch(pkts []Packet) (n int, err error) {
+	for n < len(pkts) {
+		m := len(pkts) - n
+		if m > len(b.wr.msgs) {
+			m = len(b.wr.msgs)
+		}
+		for i := 0; i < m; i++ {
+			p := &pkts[n+i]
+			b.wr.iovs[i] = syscall.Iovec{}
+			if len(p.Buf) > 0 {
+				b.wr.iovs[i].Base = &p.Buf[0]
+			}
+			b.wr.iovs[i].SetLen(len(p.Buf))
+			b.wr.msgs[i] = mmsghdr{hdr: syscall.Msghdr{
+				Iov:    &b.wr.iovs[i],
+				Iovlen: 1,
+			}}
+			if p.Addr != nil {
+				namelen, ok := encodeAddr(&b.wr.names[i], p.Addr, b.v6)
+				if !ok {
+					if i == 0 {
+						return n, &net.AddrError{Err: "unsupported address family", Addr: p.Addr.String()}
+					}
+					m = i
+					break
+				}
+				b.wr.msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&b.wr.names[i]))
+				b.wr.msgs[i].hdr.Namelen = namelen
+			}
+		}
+		var sent int
+		var serr error
+		if err = b.raw.Write(func(fd uintptr) bool {
+			r, _, errno := syscall.Syscall6(sysSendmmsg, fd, uintptr(unsafe.Pointer(&b.wr.msgs[0])),
+				uintptr(m), syscall.MSG_DONTWAIT, 0, 0)
+			if errno == syscall.EAGAIN {
+				return false
+			}
+			if errno != 0 {
+				// r is -1, none of the batch is sent
+				serr = os.NewSyscallError("sendmmsg", errno)
+				return true
+			}
+			sent = int(r)
+			return true
+		}); err == nil {
+			err = serr
+		}
+		n += sent
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// decodeAddr decodes the address filled by recvmmsg
+func decodeAddr(rsa *syscall.RawSockaddrInet6, namelen uint32) *net.UDPAddr {
+	switch rsa.Family {
+	case syscall.AF_INET:
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, sa.Addr[:])
+		return &net.UDPAddr{IP: ip, Port: ntohs(sa.Port)}
+	case syscall.AF_INET6:
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, rsa.Addr[:])
+		addr := &net.UDPAddr{IP: ip, Port: ntohs(rsa.Port)}
+		if rsa.Scope_id != 0 {
+			if ifi, err := net.InterfaceByIndex(int(rsa.Scope_id)); err == nil {
+				addr.Zone = ifi.Name
+			}
+		}
+		return addr
+	}
+	return nil
+}
+
+// encodeAddr encodes addr for sendmmsg, IPv4 addresses are mapped to IPv6 if v6
+func encodeAddr(rsa *syscall.RawSockaddrInet6, addr *net.UDPAddr, v6 bool) (uint32, bool) {
+	*rsa = syscall.RawSockaddrInet6{}
+	if !v6 {
+		ip4 := addr.IP.To4()
+		if ip4 == nil {
+			return 0, false
+		}
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		sa.Family = syscall.AF_INET
+		sa.Port = htons(addr.Port)
+		copy(sa.Addr[:], ip4)
+		return syscall.SizeofSockaddrInet4, true
+	}
+	ip := addr.IP.To16()
+	if ip == nil {
+		return 0, false
+	}
+	rsa.Family = syscall.AF_INET6
+	rsa.Port = htons(addr.Port)
+	copy(rsa.Addr[:], ip)
+	if addr.Zone != "" {
+		if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+			rsa.Scope_id = uint32(ifi.Index)
+		}
+	}
+	return syscall.SizeofSockaddrInet6, true
+}
+
+// ntohs the port of sockaddrs is in network byte order
+func ntohs(port uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return int(b[0])<<8 | int(b[1])
+}
+
+func htons(port int) (v uint16) {
+	b := (*[2]byte)(unsafe.Pointer(&v))
+	b[0], b[1] = byte(port>>8), byte(port)
+	return
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package internal
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWriteBatchOversized(t *testing.T) {
+	ln, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	bc, err := NewBatchConn(conn, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := ln.LocalAddr().(*net.UDPAddr)
+	pkts := []Packet{
+		{Buf: make([]byte, 65520), Addr: addr},
+		{Buf: []byte("ok"), Addr: addr},
+	}
+	n, err := bc.WriteBatch(pkts)
+	if n != 0 || err == nil {
+		t.Fatalf("WriteBatch oversized: n=%d err=%v, want n=0 and an error", n, err)
+	}
+	if n, err = bc.WriteBatch(pkts[1:]); n != 1 || err != nil {
+		t.Fatalf("WriteBatch: n=%d err=%v", n, err)
+	}
+	buf := make([]byte, maxReadLen)
+	ln.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err = ln.ReadFromUDP(buf); err != nil || string(buf[:n]) != "ok" {
+		t.Fatalf("read %q %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// +build !linux
+
+package internal
+
+import (
+	"net"
+)
+
+// BatchConn reads and writes datagrams one by one, recvmmsg and sendmmsg are linux only
+type BatchConn struct {
+	conn *net.UDPConn
+}
+
+func NewBatchConn(conn *net.UDPConn, size int) (*BatchConn, error) {
+	return &BatchConn{conn: conn}, nil
+}
+
+// ReadBatch reads one datagram into pkts[0]
+func (b *BatchConn) ReadBatch(pkts []Packet) (int, error) {
+	n, addr, err := b.conn.ReadFromUDP(pkts[0].Buf)
+	if err != nil {
+		return 0, err
+	}
+	pkts[0].N, pkts[0].Addr = n, addr
+	return 1, nil
+}
+
+// WriteBatch writes the datagrams of pkts in order, returns the number written,
+// which is less than len(pkts) only if err is not nil, pkts[n] is the one failed
+func (b *BatchConn) WriteBatch(pkts []Packet) (n int, err error) {
+	for _, p := range pkts {
+		if p.Addr != nil {
+			_, err = b.conn.WriteToUDP(p.Buf, p.Addr)
+		} else {
+			_, err = b.conn.Write(p.Buf)
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
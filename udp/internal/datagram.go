@@ -0,0 +1,71 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package internal
+
+import (
+	"errors"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/frame"
+)
+
+var ErrIncompleteFrame = errors.New("datagram: incomplete frame")
+
+// EncodeDatagram returns the datagram of msg, encoded with HeaderCodec if DatagramFraming is set
+func EncodeDatagram(opts *gcore.Options, msg []byte) ([]byte, error) {
+	d := msg
+	if opts.DatagramFraming {
+		if d = opts.HeaderCodec.Encode(msg); d == nil {
+			return nil, gcore.ErrTooLarge
+		}
+	}
+	if len(d) > MaxDatagramLen {
+		return nil, gcore.ErrTooLarge
+	}
+	return d, nil
+}
+
+// DecodeDatagram calls f with each msg of the datagram data, msgs are decoded with HeaderCodec
+// if DatagramFraming is set, otherwise data is a msg. msg is a copy, f may retain it.
+// It stops when f returns an error.
+func DecodeDatagram(opts *gcore.Options, data []byte, f func(msg []byte) error) error {
+	if !opts.DatagramFraming {
+		msg := make([]byte, len(data))
+		copy(msg, data)
+		return f(msg)
+	}
+	for len(data) > 0 {
+		body, n, err := frame.Decode(opts.HeaderCodec, data, opts.MaxReadBufLen)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrIncompleteFrame
+		}
+		msg := make([]byte, len(body))
+		copy(msg, body)
+		data = data[n:]
+		if err = f(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
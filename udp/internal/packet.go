@@ -0,0 +1,48 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package internal
+
+import (
+	"net"
+)
+
+// MaxDatagramLen max length of a UDP datagram to write, the payload limit over IPv4:
+// 65535 - 20 bytes IP header - 8 bytes UDP header
+const MaxDatagramLen = 65507
+
+// maxReadLen max length of a UDP datagram to read, IPv6 payloads may be longer than MaxDatagramLen
+const maxReadLen = 65535
+
+// Packet a datagram read or to be written
+type Packet struct {
+	Buf  []byte       // data to write, or the buffer to read into
+	N    int          // length of the datagram read
+	Addr *net.UDPAddr // remote address, nil to write to a connected socket
+}
+
+// NewPackets returns n packets with read buffers of maxReadLen
+func NewPackets(n int) []Packet {
+	pkts := make([]Packet, n)
+	for i := range pkts {
+		pkts[i].Buf = make([]byte, maxReadLen)
+	}
+	return pkts
+}
@@ -18,14 +18,12 @@
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
 // SOFTWARE.
 
-// +build !linux
+// +build !amd64,!386
 
-package server
+package internal
 
 import (
-	"net"
+	"syscall"
 )
 
-func setKeepaliveParameters(conn *net.TCPConn, count, interval int) error {
-	return nil
-}
+const sysSendmmsg = syscall.SYS_SENDMMSG
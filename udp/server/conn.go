@@ -0,0 +1,270 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/connstat"
+	"github.com/izhw/gnet/internal/registry"
+	"github.com/izhw/gnet/udp/internal"
+)
+
+var _ gcore.Conn = &Conn{}
+
+// Conn a virtual conn of a remote address of Server
+type Conn struct {
+	id         uint64
+	s          *Server
+	addr       *net.UDPAddr
+	key        string // addr.String(), key of the conn in the server
+	stats      *connstat.Stats
+	heart      *connstat.HeartWatch
+	closeChan  chan struct{}
+	closed     int32
+	mu         sync.Mutex // guards tag and registered
+	tag        string
+	registered bool // c is in the registry of the server
+}
+
+func newConn(s *Server, addr *net.UDPAddr, key string) *Conn {
+	c := &Conn{
+		id:        registry.NextID(),
+		s:         s,
+		addr:      addr,
+		key:       key,
+		closeChan: make(chan struct{}),
+	}
+	c.stats = connstat.NewStats(&s.metrics.IO)
+	c.heart = s.heart.Watch(c.stats, c.onIdle, c.ping)
+	return c
+}
+
+func (c *Conn) ID() uint64 {
+	return c.id
+}
+
+func (c *Conn) Init(opts ...gcore.Option) error {
+	return nil
+}
+
+func (c *Conn) Read(buf []byte) (n int, err error) {
+	return 0, gcore.ErrConnInvalidCall
+}
+
+func (c *Conn) ReadFull(buf []byte) (n int, err error) {
+	return 0, gcore.ErrConnInvalidCall
+}
+
+func (c *Conn) WriteRead(req []byte) (body []byte, err error) {
+	return nil, gcore.ErrConnInvalidCall
+}
+
+// Write sends data in a datagram, it is queued in the send queue shared by the conns of the server.
+// SendQueueDropOldest behaves like SendQueueDropNewest.
+func (c *Conn) Write(data []byte) error {
+	return c.enqueue(context.Background(), data, true)
+}
+
+func (c *Conn) TryWrite(data []byte) error {
+	return c.enqueue(context.Background(), data, false)
+}
+
+func (c *Conn) WriteContext(ctx context.Context, data []byte) error {
+	return c.enqueue(ctx, data, true)
+}
+
+// enqueue passes data through the interceptors and queues it,
+// wait: whether SendQueueBlock waits for room
+func (c *Conn) enqueue(ctx context.Context, data []byte, wait bool) error {
+	if is := c.s.opts.Interceptors; len(is) > 0 {
+		return gcore.InterceptWrite(is, c, data, func(_ gcore.Conn, data []byte) error {
+			return c.send(ctx, data, wait)
+		})
+	}
+	return c.send(ctx, data, wait)
+}
+
+// send encodes data and queues it
+func (c *Conn) send(ctx context.Context, data []byte, wait bool) error {
+	if len(data) == 0 {
+		return nil
+	}
+	d, err := internal.EncodeDatagram(&c.s.opts, data)
+	if err != nil {
+		return err
+	}
+	return c.push(ctx, data, d, c.s.opts.SendQueuePolicy, wait)
+}
+
+// push queues the datagram d of msg with policy
+func (c *Conn) push(ctx context.Context, msg, d []byte, policy gcore.SendQueuePolicy, wait bool) error {
+	if c.Closed() {
+		return gcore.ErrConnClosed
+	}
+	dg := datagram{c: c, msg: msg, data: d}
+	select {
+	case c.s.out <- dg:
+		return nil
+	default:
+	}
+	if wait && policy == gcore.SendQueueBlock {
+		select {
+		case c.s.out <- dg:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.closeChan:
+			return gcore.ErrConnClosed
+		case <-c.s.quit:
+			return gcore.ErrConnClosed
+		}
+	}
+	c.s.metrics.SendQueueFull.Add(1)
+	if h, ok := c.s.opts.Handler.(gcore.SendQueueFullHandler); ok {
+		h.OnSendQueueFull(c, msg)
+	}
+	if policy == gcore.SendQueueClose {
+		c.s.opts.Logger.Infof("UDP conn:%d %s send queue full, closing", c.id, c.addr)
+		c.Close()
+	}
+	return gcore.ErrSendQueueFull
+}
+
+// Close removes c from the server, datagrams queued are still sent.
+// A new conn is opened if a datagram from the address arrives after.
+func (c *Conn) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	close(c.closeChan)
+	c.heart.Stop()
+	c.unregister()
+	c.s.onConnClose(c)
+	c.s.opts.Handler.OnClosed(c)
+	return nil
+}
+
+func (c *Conn) Closed() bool {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return true
+	}
+	return false
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// LocalAddr returns the address of the server socket
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.conn.LocalAddr()
+}
+
+// PeerCertificates DTLS is not supported
+func (c *Conn) PeerCertificates() []*x509.Certificate {
+	return nil
+}
+
+// Stats the send queue fields are zero, as the send queue is shared by the conns of the server
+func (c *Conn) Stats() (st gcore.ConnStats) {
+	c.stats.Fill(&st)
+	return
+}
+
+func (c *Conn) SetTag(tag string) {
+	c.mu.Lock()
+	if c.registered {
+		c.s.conns.Retag(c, c.tag, tag)
+	}
+	c.tag = tag
+	c.mu.Unlock()
+}
+
+func (c *Conn) GetTag() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tag
+}
+
+func (c *Conn) register() {
+	c.mu.Lock()
+	c.s.conns.Add(c, c.tag)
+	c.registered = true
+	c.mu.Unlock()
+}
+
+func (c *Conn) unregister() {
+	c.mu.Lock()
+	c.s.conns.Remove(c, c.tag)
+	c.registered = false
+	c.mu.Unlock()
+}
+
+// onIdle called by the heart keeper when c has received nothing for the idle timeout
+func (c *Conn) onIdle() {
+	go func() {
+		c.s.opts.Logger.Debugf("UDP conn:%d %s idle timeout, closing", c.id, c.addr)
+		if h, ok := c.s.opts.Handler.(gcore.IdleTimeoutHandler); ok {
+			h.OnIdleTimeout(c)
+		}
+		c.Close()
+	}()
+}
+
+// ping called by the heart keeper when c is silent for HeartPingInterval
+func (c *Conn) ping() {
+	_ = c.TryWrite(c.s.opts.HeartData)
+}
+
+// handleMsg handles a msg decoded from a datagram of c, called in the read loop.
+// It returns an error if c is closed.
+func (c *Conn) handleMsg(msg []byte) error {
+	s := c.s
+	if s.heartLen > 0 && uint32(len(msg)) == s.heartLen && s.isHeartBeat(msg) {
+		c.stats.Heartbeat()
+		if s.opts.HeartPingInterval <= 0 {
+			_ = c.TryWrite(msg)
+		}
+		return nil
+	}
+	c.stats.MsgRead()
+	if s.workers != nil {
+		s.hwg.Add(1)
+		if err := s.workers.Dispatch(c, msg, c.closeChan, s.hwg.Done); err != nil {
+			s.opts.Logger.Infof("UDP conn:%d dispatch error:[%v]", c.id, err)
+			c.Close()
+			return err
+		}
+		return nil
+	}
+	if err := s.opts.Handler.OnReadMsg(c, msg); err != nil {
+		s.opts.Logger.Infof("UDP conn:%d OnReadMsg error:[%v]", c.id, err)
+		c.Close()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,512 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/internal/connstat"
+	"github.com/izhw/gnet/internal/metric"
+	"github.com/izhw/gnet/internal/registry"
+	"github.com/izhw/gnet/internal/util/delay"
+	"github.com/izhw/gnet/internal/util/limter"
+	"github.com/izhw/gnet/internal/worker"
+	"github.com/izhw/gnet/udp/internal"
+)
+
+const DefaultAddr = "0.0.0.0:7777"
+
+// DefaultIdleTimeout idle timeout of conns if both HeartTimeout and ReadTimeout are 0,
+// a conn is opened by any datagram, so conns must expire
+const DefaultIdleTimeout = 2 * time.Minute
+
+const (
+	// batchSize max number of datagrams read or written by one syscall
+	batchSize = 32
+	// outQueueLen max number of datagrams queued for writing, shared by conns
+	outQueueLen = 4096
+)
+
+var _ gcore.Server = &Server{}
+
+// Server is a UDP server, each remote address is a virtual Conn, which is opened by its
+// first datagram and expires after receiving nothing for HeartTimeout, or ReadTimeout if
+// HeartTimeout is 0, or DefaultIdleTimeout if both are 0. OnReadMsg is called in the read loop unless WorkerNum is set.
+// Datagrams are read and written in batches by recvmmsg and sendmmsg on linux.
+type Server struct {
+	opts     gcore.Options
+	conn     *net.UDPConn
+	bc       *internal.BatchConn
+	limiter  limter.Limiter
+	stopChan chan struct{}
+	quit     chan struct{} // stops the write loop
+	out      chan datagram
+	wg       sync.WaitGroup // read and write loops
+	rwg      sync.WaitGroup // read loop
+	cwg      sync.WaitGroup // conns
+	hwg      sync.WaitGroup // msgs dispatched to workers
+	mu       sync.Mutex     // guards peers
+	peers    map[string]*Conn
+	conns    *registry.Registry
+	workers  *worker.Pool // nil if WorkerNum is 0
+	metrics  *metric.Server
+	heart    *connstat.HeartKeeper
+	heartLen uint32
+	connNum  uint32
+	stopped  int32
+}
+
+// datagram queued for writing, flushed is closed when it is reached if c is nil
+type datagram struct {
+	c       *Conn
+	msg     []byte
+	data    []byte
+	flushed chan struct{}
+}
+
+func NewServer() *Server {
+	return &Server{
+		stopped: 1,
+	}
+}
+
+func (s *Server) WithOptions(opts gcore.Options) {
+	s.opts = opts
+}
+
+func (s *Server) Init(opts ...gcore.Option) error {
+	for _, opt := range opts {
+		opt(&s.opts)
+	}
+	if s.opts.Addr == "" {
+		s.opts.Addr = DefaultAddr
+	}
+	if s.opts.HeartPingInterval > 0 && len(s.opts.HeartData) == 0 {
+		return errors.New("server ping: HeartData not set")
+	}
+	addr, err := net.ResolveUDPAddr("udp", s.opts.Addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+	if err = internal.SetBuffers(conn, &s.opts.Socket); err != nil {
+		conn.Close()
+		return err
+	}
+	bc, err := internal.NewBatchConn(conn, batchSize)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s.conn, s.bc = conn, bc
+	s.opts.Handler = gcore.WrapHandler(s.opts.Handler, s.opts.Interceptors)
+	if s.opts.ConnLimit > 0 {
+		s.limiter = limter.NewLimiter(s.opts.ConnLimit)
+	}
+	s.stopChan = make(chan struct{})
+	s.quit = make(chan struct{})
+	s.out = make(chan datagram, outQueueLen)
+	s.peers = make(map[string]*Conn)
+	s.conns = registry.New()
+	s.metrics = metric.NewServer(&s.opts)
+	if s.opts.WorkerNum > 0 {
+		s.workers = worker.NewPool(&s.opts)
+	}
+	idle := s.opts.HeartTimeout
+	if idle <= 0 {
+		idle = s.opts.ReadTimeout
+	}
+	if idle <= 0 {
+		idle = DefaultIdleTimeout
+	}
+	s.heart = connstat.NewHeartKeeper(idle, s.opts.HeartPingInterval)
+	s.heartLen = uint32(len(s.opts.HeartData))
+	s.stopped = 0
+
+	return nil
+}
+
+func (s *Server) Serve() error {
+	if atomic.LoadInt32(&s.stopped) == 1 {
+		return errors.New("server uninitialized")
+	}
+	if s.workers != nil {
+		s.workers.Start()
+	}
+	s.heart.Start()
+	s.wg.Add(2)
+	s.rwg.Add(1)
+	go s.readLoop()
+	go s.writeLoop()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(c)
+
+	select {
+	case <-s.opts.Ctx.Done():
+		s.Stop()
+		return s.opts.Ctx.Err()
+	case <-s.stopChan:
+		s.wait()
+	case sig := <-c:
+		s.Stop()
+		return errors.New("signal:" + sig.String())
+	}
+	return nil
+}
+
+// wait waits for the loops to exit and all conns to be closed
+func (s *Server) wait() {
+	s.wg.Wait()
+	s.cwg.Wait()
+}
+
+// Stop stops reading and writing, closes all conns, queued datagrams are dropped
+func (s *Server) Stop() {
+	if !atomic.CompareAndSwapInt32(&s.stopped, 0, 1) {
+		return
+	}
+	close(s.stopChan)
+	close(s.quit)
+	s.conn.Close()
+	s.wg.Wait()
+	s.closeConns()
+	s.release()
+}
+
+// Shutdown stops reading, calls OnShutdown of the handler for each conn if implemented,
+// waits for the msgs dispatched to workers to be handled and the queued datagrams to be
+// written, then closes all conns. If ctx is done before, queued datagrams are dropped,
+// and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.stopped, 0, 1) {
+		s.wait()
+		return nil
+	}
+	close(s.stopChan)
+	_ = s.conn.SetReadDeadline(time.Now())
+	s.rwg.Wait()
+
+	h, _ := s.opts.Handler.(gcore.ShutdownHandler)
+	s.conns.Range(func(c gcore.Conn) bool {
+		if h != nil {
+			h.OnShutdown(c)
+		}
+		return true
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.hwg.Wait()
+		flushed := make(chan struct{})
+		select {
+		case s.out <- datagram{flushed: flushed}:
+			select {
+			case <-flushed:
+			case <-s.quit:
+			}
+		case <-s.quit:
+		}
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	close(s.quit)
+	s.conn.Close()
+	s.wg.Wait()
+	s.closeConns()
+	s.release()
+	<-done
+	return err
+}
+
+// closeConns closes all conns, called after the loops exit
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	peers := make([]*Conn, 0, len(s.peers))
+	for _, c := range s.peers {
+		peers = append(peers, c)
+	}
+	s.mu.Unlock()
+	for _, c := range peers {
+		c.Close()
+	}
+	s.cwg.Wait()
+}
+
+// release stops the workers and the heart keeper, called after all conns are closed
+func (s *Server) release() {
+	if s.workers != nil {
+		s.workers.Stop()
+	}
+	s.heart.Stop()
+}
+
+func (s *Server) WorkerStats() gcore.WorkerStats {
+	return s.workers.Stats()
+}
+
+func (s *Server) ConnNum() uint32 {
+	return atomic.LoadUint32(&s.connNum)
+}
+
+func (s *Server) GetConn(id uint64) (gcore.Conn, bool) {
+	return s.conns.Get(id)
+}
+
+func (s *Server) GetConnsByTag(tag string) []gcore.Conn {
+	return s.conns.GetByTag(tag)
+}
+
+func (s *Server) RangeConns(f func(c gcore.Conn) bool) {
+	s.conns.Range(f)
+}
+
+func (s *Server) CloseConn(id uint64, reason string) error {
+	c, ok := s.conns.Get(id)
+	if !ok {
+		return gcore.ErrConnNotFound
+	}
+	s.opts.Logger.Infof("UDP server close conn:%d %s, reason:%s", id, c.RemoteAddr(), reason)
+	return c.Close()
+}
+
+func (s *Server) JoinGroup(group string, c gcore.Conn) error {
+	if !s.conns.Join(c, group) {
+		return gcore.ErrConnNotFound
+	}
+	return nil
+}
+
+func (s *Server) LeaveGroup(group string, c gcore.Conn) {
+	s.conns.Leave(c, group)
+}
+
+func (s *Server) Broadcast(data []byte, policy gcore.SlowReceiverPolicy) (n int, err error) {
+	d, err := internal.EncodeDatagram(&s.opts, data)
+	if err != nil {
+		return 0, err
+	}
+	s.conns.Range(func(c gcore.Conn) bool {
+		if s.send(c.(*Conn), data, d, policy) {
+			n++
+		}
+		return true
+	})
+	return n, nil
+}
+
+func (s *Server) GroupBroadcast(group string, data []byte, policy gcore.SlowReceiverPolicy) (n int, err error) {
+	d, err := internal.EncodeDatagram(&s.opts, data)
+	if err != nil {
+		return 0, err
+	}
+	for _, c := range s.conns.GetGroup(group) {
+		if s.send(c.(*Conn), data, d, policy) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// send queues the shared datagram d of msg to c with policy
+func (s *Server) send(c *Conn, msg, d []byte, policy gcore.SlowReceiverPolicy) bool {
+	p := gcore.SendQueueDropNewest
+	switch policy {
+	case gcore.SlowReceiverBlock:
+		p = gcore.SendQueueBlock
+	case gcore.SlowReceiverDisconnect:
+		p = gcore.SendQueueClose
+	}
+	return c.push(context.Background(), msg, d, p, true) == nil
+}
+
+func (s *Server) onConnClose(c *Conn) {
+	s.mu.Lock()
+	if s.peers[c.key] == c {
+		delete(s.peers, c.key)
+	}
+	s.mu.Unlock()
+	if s.limiter != nil {
+		s.limiter.Revert()
+	}
+	atomic.AddUint32(&s.connNum, ^uint32(0))
+	s.metrics.Conns.Add(-1)
+	s.cwg.Done()
+}
+
+// isHeartBeat called when len(data) == len(s.opts.HeartData)
+func (s *Server) isHeartBeat(data []byte) bool {
+	for i := 0; i < len(s.opts.HeartData); i++ {
+		if s.opts.HeartData[i] != data[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// peer returns the conn of addr, a new one is opened for an unknown addr,
+// nil if rejected by ConnLimit
+func (s *Server) peer(addr *net.UDPAddr) *Conn {
+	key := addr.String()
+	s.mu.Lock()
+	c, ok := s.peers[key]
+	if ok {
+		s.mu.Unlock()
+		return c
+	}
+	if s.limiter != nil && !s.limiter.Allow() {
+		s.mu.Unlock()
+		s.metrics.Rejected.Add(1)
+		s.opts.Logger.Warnf("UDP server accepted max num:%d, datagram of new conn %s dropped", s.opts.ConnLimit, key)
+		return nil
+	}
+	atomic.AddUint32(&s.connNum, 1)
+	s.metrics.Accepted.Add(1)
+	s.metrics.Conns.Add(1)
+	s.cwg.Add(1)
+	c = newConn(s, addr, key)
+	s.peers[key] = c
+	s.mu.Unlock()
+	c.register()
+	s.opts.Handler.OnOpened(c)
+	return c
+}
+
+func (s *Server) readLoop() {
+	defer func() {
+		s.rwg.Done()
+		s.wg.Done()
+		s.Stop()
+	}()
+
+	pkts := internal.NewPackets(batchSize)
+	td := delay.NewTempDelay(5*time.Millisecond, time.Second)
+	for {
+		n, err := s.bc.ReadBatch(pkts)
+		if err != nil {
+			select {
+			case <-s.stopChan:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				d := td.GetDelay()
+				s.opts.Logger.Warnf("UDP server read temporary error:[%v], delay:%v", ne, d)
+				time.Sleep(d)
+				continue
+			}
+			s.opts.Logger.Errorf("UDP server read error:[%v]", err)
+			return
+		}
+		td.Reset()
+		for i := 0; i < n; i++ {
+			p := &pkts[i]
+			if p.Addr == nil {
+				continue
+			}
+			c := s.peer(p.Addr)
+			if c == nil || c.Closed() {
+				continue
+			}
+			c.stats.Read(p.N, 0)
+			if err := internal.DecodeDatagram(&s.opts, p.Buf[:p.N], c.handleMsg); err != nil && !c.Closed() {
+				s.opts.Logger.Debugf("UDP conn:%d %s datagram dropped, decode error:[%v]", c.id, c.addr, err)
+			}
+		}
+	}
+}
+
+// writeLoop writes the queued datagrams in batches
+func (s *Server) writeLoop() {
+	defer s.wg.Done()
+
+	ds := make([]datagram, 0, batchSize)
+	pkts := make([]internal.Packet, 0, batchSize)
+	for {
+		var d datagram
+		select {
+		case <-s.quit:
+			return
+		case d = <-s.out:
+		}
+		ds = append(ds[:0], d)
+		// a flush marker ends the batch
+	batch:
+		for len(ds) < batchSize && d.c != nil {
+			select {
+			case d = <-s.out:
+				ds = append(ds, d)
+			default:
+				break batch
+			}
+		}
+		pkts = s.write(ds, pkts[:0])
+	}
+}
+
+// write writes the datagrams of ds by one batch, then closes the flush marker if it is the last one.
+// pkts is the buffer of packets, returned for reuse.
+func (s *Server) write(ds []datagram, pkts []internal.Packet) []internal.Packet {
+	for _, d := range ds {
+		if d.c != nil {
+			pkts = append(pkts, internal.Packet{Buf: d.data, Addr: d.c.addr})
+		}
+	}
+	for i := 0; i < len(pkts); {
+		n, err := s.bc.WriteBatch(pkts[i:])
+		for _, d := range ds[i : i+n] {
+			d.c.stats.Written(1, len(d.data))
+		}
+		i += n
+		if err != nil {
+			// the datagram failed is skipped
+			d := ds[i]
+			d.c.stats.WriteFailed()
+			s.opts.Handler.OnWriteError(d.c, d.msg, err)
+			i++
+		}
+	}
+	if d := ds[len(ds)-1]; d.c == nil {
+		close(d.flushed)
+	}
+	for i := range pkts {
+		pkts[i] = internal.Packet{}
+	}
+	return pkts
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2020 izhw
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/izhw/gnet/gcore"
+	"github.com/izhw/gnet/udp/internal"
+)
+
+// oversizedHandler replies an oversized datagram to "big", echoes others
+type oversizedHandler struct {
+	*gcore.NetEventHandler
+	errs chan error
+}
+
+func (h *oversizedHandler) OnReadMsg(c gcore.Conn, data []byte) error {
+	if string(data) == "big" {
+		h.errs <- c.Write(make([]byte, internal.MaxDatagramLen+1))
+		return nil
+	}
+	return c.Write(data)
+}
+
+func TestServerWriteOversized(t *testing.T) {
+	h := &oversizedHandler{NetEventHandler: &gcore.NetEventHandler{}, errs: make(chan error, 1)}
+	s := NewServer()
+	s.WithOptions(gcore.DefaultOptions())
+	if err := s.Init(gcore.WithAddr("127.0.0.1:17971"), gcore.WithEventHandler(h)); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Stop()
+
+	conn, err := net.Dial("udp", "127.0.0.1:17971")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("big")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-h.errs:
+		if err != gcore.ErrTooLarge {
+			t.Fatalf("Write oversized: %v, want %v", err, gcore.ErrTooLarge)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no datagram read")
+	}
+
+	// the server still serves the peer
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("read %q %v", buf[:n], err)
+	}
+}